@@ -0,0 +1,269 @@
+package etcdplugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// adminHandler builds the admin HTTP API
+func (p *PluginState) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", p.handleLeases)
+	mux.HandleFunc("/leases/", p.handleLeaseByMAC)
+	mux.HandleFunc("/leases/ip/", p.handleLeaseByIP)
+	mux.HandleFunc("/admin/pause", p.handlePause(true))
+	mux.HandleFunc("/admin/resume", p.handlePause(false))
+	mux.HandleFunc("/admin/reconcile", p.handleReconcile)
+	mux.HandleFunc("/admin/config", p.handleConfig)
+	mux.HandleFunc("/stats/utilization", p.handleUtilization)
+	mux.HandleFunc("/ips/problem/", p.handleProblemIPs)
+	mux.Handle("/metrics", expvar.Handler())
+
+	return p.requireToken(mux)
+}
+
+// requireToken only lets requests carrying the AdminToken as their bearer
+// token through to next, none without one
+func (p *PluginState) requireToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + p.config.AdminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if p.config.AdminToken == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveAdmin runs the admin HTTP API until ctx is done
+func (p *PluginState) serveAdmin(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              p.config.AdminListen,
+		Handler:           p.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	log.Infof("admin API listening on %s", p.config.AdminListen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// handleLeases handles GET /leases, listing the leases currently held
+func (p *PluginState) handleLeases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	leases, err := p.Leases(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(leases); err != nil {
+		log.Errorf("could not write leases: %v", err)
+	}
+}
+
+// handleLeaseByMAC handles DELETE /leases/{mac}, freeing the ip the nic
+// holds
+func (p *PluginState) handleLeaseByMAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nic, err := net.ParseMAC(strings.TrimPrefix(r.URL.Path, "/leases/"))
+	if err != nil {
+		http.Error(w, "invalid hardware address", http.StatusBadRequest)
+		return
+	}
+
+	ip, err := p.nicLeasedIP(r.Context(), nic)
+	if err != nil {
+		log.Errorf("could not look up lease of nic %s: %v", nic, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.revokeLease(r.Context(), nic); err != nil {
+		if errors.Is(err, ErrNoLease) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Errorf("could not revoke lease of nic %s: %v", nic, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ip != nil {
+		if err := p.dns.Unregister(r.Context(), p.etcdClient(), ip); err != nil {
+			log.Errorf("could not unregister DNS names of ip %s: %v", ip, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleLeaseByIP handles DELETE /leases/ip/{ip}
+func (p *PluginState) handleLeaseByIP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/leases/ip/"))
+	if ip.To4() == nil {
+		http.Error(w, "invalid IPv4 address", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.revokeLeaseByIP(r.Context(), ip); err != nil {
+		if errors.Is(err, ErrNoLease) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Errorf("could not revoke lease of ip %s: %v", ip, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := p.dns.Unregister(r.Context(), p.etcdClient(), ip); err != nil {
+		log.Errorf("could not unregister DNS names of ip %s: %v", ip, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePause handles POST /admin/pause and POST /admin/resume
+func (p *PluginState) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := p.setPaused(r.Context(), paused); err != nil {
+			log.Errorf("could not change pause state: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleReconcile handles POST /admin/reconcile, running a sweep right away
+// instead of waiting for the monitor
+func (p *PluginState) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summary, err := p.sweep(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Errorf("could not write reconcile summary: %v", err)
+	}
+}
+
+// handleConfig handles GET /admin/config, returning the effective config
+// with its secrets redacted
+func (p *PluginState) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.config.Redacted()); err != nil {
+		log.Errorf("could not write config: %v", err)
+	}
+}
+
+// handleUtilization handles GET /stats/utilization, returning the stored
+// utilization snapshots oldest first
+func (p *PluginState) handleUtilization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshots, err := p.UtilizationHistory(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshots); err != nil {
+		log.Errorf("could not write utilization snapshots: %v", err)
+	}
+}
+
+// handleProblemIPs handles GET /ips/problem/, listing the ips parked after
+// being declined too often, and DELETE /ips/problem/{ip}, returning one to
+// the pool
+func (p *PluginState) handleProblemIPs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ips, err := p.ProblemIPs(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ips); err != nil {
+			log.Errorf("could not write problem ips: %v", err)
+		}
+
+	case http.MethodDelete:
+		ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/ips/problem/"))
+		if ip.To4() == nil {
+			http.Error(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+
+		if err := p.releaseProblemIP(r.Context(), ip); err != nil {
+			if errors.Is(err, ErrNotParked) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Errorf("could not return problem ip %s: %v", ip, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,232 @@
+package etcdplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// adminRequest serves a request of method on path with the admin API of p,
+// carrying the test token
+func adminRequest(t testing.TB, p *PluginState, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret")
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/leases", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		p.adminHandler().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("want %q refused with a bearer challenge, got %d", auth, rec.Code)
+		}
+	}
+
+	if rec := adminRequest(t, p, http.MethodGet, "/leases"); rec.Code != http.StatusOK {
+		t.Errorf("want the token let through, got %d", rec.Code)
+	}
+}
+
+func TestAdminListsLeases(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret")
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+
+	rec := adminRequest(t, p, http.MethodGet, "/leases")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want the leases listed, got %d: %s", rec.Code, rec.Body)
+	}
+	var leases []LeaseRecord
+	if err := json.NewDecoder(rec.Body).Decode(&leases); err != nil {
+		t.Fatalf("could not decode leases: %v", err)
+	}
+	if len(leases) != 1 || !leases[0].IP.Equal(ip) || leases[0].MAC != nic.String() {
+		t.Errorf("want the lease of %s to %s listed, got %+v", ip, nic, leases)
+	}
+
+	if rec := adminRequest(t, p, http.MethodPost, "/leases"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want POST refused, got %d", rec.Code)
+	}
+}
+
+func TestAdminDeletesLeaseByMAC(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret")
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/leases/" + nic.String(), http.StatusNoContent},
+		{"/leases/" + nic.String(), http.StatusNotFound},
+		{"/leases/not-a-mac", http.StatusBadRequest},
+	} {
+		if rec := adminRequest(t, p, http.MethodDelete, tt.path); rec.Code != tt.want {
+			t.Errorf("want DELETE %s answered %d, got %d: %s", tt.path, tt.want, rec.Code, rec.Body)
+		}
+	}
+
+	if got := leasedTo(t, f, p, nic); got != "" {
+		t.Errorf("want %s to lease nothing, got %s", nic, got)
+	}
+	if _, ok := f.get(p.keys.FreeIP(ip)); !ok {
+		t.Errorf("want %s freed", ip)
+	}
+}
+
+func TestAdminDeletesLeaseByIP(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret")
+
+	nic := testMAC(1)
+	ip := discover(t, p, nic)
+	resp := request(t, p, nic, ip, dhcpv4.WithOption(dhcpv4.OptHostName("host")))
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("%s was not acked %s: %v", nic, ip, resp)
+	}
+	nameKey := p.dns.keys.AddressRecord("host", ip)
+	if _, ok := f.get(nameKey); !ok {
+		t.Fatalf("want %s registered", nameKey)
+	}
+
+	unleased := net.IPv4(10, 0, 0, 9).To4()
+	if unleased.Equal(ip) {
+		unleased = net.IPv4(10, 0, 0, 10).To4()
+	}
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/leases/ip/" + ip.String(), http.StatusNoContent},
+		{"/leases/ip/" + ip.String(), http.StatusNotFound},
+		{"/leases/ip/" + unleased.String(), http.StatusNotFound},
+		{"/leases/ip/2001:db8::1", http.StatusBadRequest},
+		{"/leases/ip/not-an-ip", http.StatusBadRequest},
+	} {
+		if rec := adminRequest(t, p, http.MethodDelete, tt.path); rec.Code != tt.want {
+			t.Errorf("want DELETE %s answered %d, got %d: %s", tt.path, tt.want, rec.Code, rec.Body)
+		}
+	}
+
+	if got := leasedTo(t, f, p, nic); got != "" {
+		t.Errorf("want %s to lease nothing, got %s", nic, got)
+	}
+	if _, ok := f.get(p.keys.FreeIP(ip)); !ok {
+		t.Errorf("want %s freed", ip)
+	}
+	if _, ok := f.get(nameKey); ok {
+		t.Errorf("want %s unregistered along with the lease", nameKey)
+	}
+	if _, ok := f.get(p.keys.FreeIP(unleased)); !ok {
+		t.Errorf("want the unleased %s left free", unleased)
+	}
+}
+
+func TestAdminPausesAndRedactsConfig(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret", "Password = hunter2")
+
+	if rec := adminRequest(t, p, http.MethodPost, "/admin/pause"); rec.Code != http.StatusNoContent {
+		t.Fatalf("want the pause accepted, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := f.get(p.keys.Paused()); !ok || !p.isPaused() {
+		t.Error("want granting paused and the pause stored")
+	}
+
+	if rec := adminRequest(t, p, http.MethodPost, "/admin/resume"); rec.Code != http.StatusNoContent {
+		t.Fatalf("want the resume accepted, got %d: %s", rec.Code, rec.Body)
+	}
+	if _, ok := f.get(p.keys.Paused()); ok || p.isPaused() {
+		t.Error("want granting resumed and the pause removed")
+	}
+
+	rec := adminRequest(t, p, http.MethodGet, "/admin/config")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("want the config returned, got %d: %s", rec.Code, rec.Body)
+	}
+	var config Config
+	if err := json.NewDecoder(rec.Body).Decode(&config); err != nil {
+		t.Fatalf("could not decode config: %v", err)
+	}
+	if config.AdminToken != constRedacted || config.Password != constRedacted {
+		t.Errorf("want the secrets redacted, got token %q and password %q", config.AdminToken, config.Password)
+	}
+	if config.Prefix != "test" {
+		t.Errorf("want the prefix returned as is, got %q", config.Prefix)
+	}
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	f := newFakeEtcd()
+	if _, err := newPluginState(testConfig(t, "AdminListen = 127.0.0.1:0"), f.dial); err == nil {
+		t.Error("want AdminListen without AdminToken refused")
+	}
+
+	// an instance without a token serves no admin request
+	p := newTestPlugin(t, f)
+	req := httptest.NewRequest(http.MethodDelete, "/leases/"+testMAC(1).String(), nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("want the request refused without a token configured, got %d", rec.Code)
+	}
+}
+
+func TestPauseServesRenewalsOnly(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "AdminToken = secret")
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+
+	if rec := adminRequest(t, p, http.MethodPost, "/admin/pause"); rec.Code != http.StatusNoContent {
+		t.Fatalf("want the pause accepted, got %d: %s", rec.Code, rec.Body)
+	}
+
+	other := testMAC(2)
+	if got := discover(t, p, other); got != nil {
+		t.Errorf("want no ip offered while paused, got %s", got)
+	}
+	if resp := request(t, p, other, net.IPv4(10, 0, 0, 7)); resp != nil {
+		t.Errorf("want a request for a new lease ignored while paused, got %v", resp.MessageType())
+	}
+	if resp := request(t, p, nic, ip); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want the renewal of %s acked while paused, got %v", ip, resp)
+	}
+
+	// the pause is kept in etcd, where instances starting pick it up
+	if restarted := newTestPlugin(t, f, "AdminToken = secret"); !restarted.isPaused() {
+		t.Error("want an instance starting while paused to start paused")
+	}
+
+	if rec := adminRequest(t, p, http.MethodPost, "/admin/resume"); rec.Code != http.StatusNoContent {
+		t.Fatalf("want the resume accepted, got %d: %s", rec.Code, rec.Body)
+	}
+	if got := discover(t, p, other); got == nil {
+		t.Error("want an ip offered once resumed")
+	}
+}
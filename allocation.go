@@ -0,0 +1,81 @@
+package etcdplugin
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// allocation strategies, deciding which free ip a DISCOVER is offered
+const (
+	// the first free ip through the ranges, or the first from the
+	// instance's region of them when InstanceID is set
+	AllocationLowest = "lowest"
+	// any free ip, making allocations unpredictable
+	AllocationRandom = "random"
+	// the ip freed the longest ago, spreading reuse over the whole range,
+	// relies on FreeValueMetadata to know when ips were freed
+	AllocationLRU = "lru"
+)
+
+// validateAllocationStrategy checks the allocation strategy, defaulting it
+// to lowest
+func validateAllocationStrategy(strategy string) (string, error) {
+	switch strategy {
+	case "":
+		return AllocationLowest, nil
+	case AllocationLowest, AllocationRandom, AllocationLRU:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid allocation strategy: %s", strategy)
+	}
+}
+
+// pickFree picks the free ip to offer among kvs, sorted by key, according
+// to the allocation strategy
+func (p *PluginState) pickFree(ctx context.Context, kvs []*mvccpb.KeyValue) (net.IP, error) {
+	switch p.allocationStrategy {
+	case AllocationRandom:
+		return p.decodeFree(ctx, kvs[rand.Intn(len(kvs))])
+	case AllocationLRU:
+		return p.oldestFree(ctx, kvs)
+	}
+
+	return p.decodeFree(ctx, p.preferredFree(kvs))
+}
+
+// decodeFree returns the ip of a free key
+func (p *PluginState) decodeFree(ctx context.Context, kv *mvccpb.KeyValue) (net.IP, error) {
+	value, err := decodeFreeValue(kv.Value)
+	if err != nil {
+		p.malformed(ctx, kv, err)
+		return nil, errors.WithMessagef(err, "could not decode %s", kv.Key)
+	}
+
+	return net.ParseIP(value.IP), nil
+}
+
+// oldestFree returns the ip freed the longest ago, the ones without a freed
+// time have been free since the range was bootstrapped and come first
+func (p *PluginState) oldestFree(ctx context.Context, kvs []*mvccpb.KeyValue) (net.IP, error) {
+	var oldest *FreeValue
+	for _, kv := range kvs {
+		value, err := decodeFreeValue(kv.Value)
+		if err != nil {
+			p.malformed(ctx, kv, err)
+			continue
+		}
+		if oldest == nil || value.Freed < oldest.Freed {
+			oldest = &value
+		}
+	}
+	if oldest == nil {
+		return nil, errors.New("no decodable free IP addresses")
+	}
+
+	return net.ParseIP(oldest.IP), nil
+}
@@ -0,0 +1,116 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newSeededPlugin brings up a test plugin whose pool holds only the free
+// ips of free, the rest of the range being excluded, lines are further
+// config lines
+func newSeededPlugin(t testing.TB, f *fakeEtcd, free map[string]bool, lines ...string) *PluginState {
+	t.Helper()
+
+	var exclude []string
+	for n := byte(1); n <= 10; n++ {
+		if ip := net.IPv4(10, 0, 0, n).String(); !free[ip] {
+			exclude = append(exclude, ip)
+		}
+	}
+
+	p := newTestPlugin(t, f, append(lines, "Exclude = "+strings.Join(exclude, ","))...)
+	if got := f.keys(p.keys.IP(IPStateFree, "")); len(got) != len(free) {
+		t.Fatalf("want the pool seeded with %v, got %v", free, got)
+	}
+	return p
+}
+
+// pickFree has p pick the free ip it would offer, failing the test if it
+// can't
+func pickFree(t testing.TB, p *PluginState) net.IP {
+	t.Helper()
+
+	ip, err := p.freeIP(context.Background(), testMAC(1), p.ranges)
+	if err != nil {
+		t.Fatalf("could not pick a free ip: %v", err)
+	}
+	return ip
+}
+
+func TestAllocationLowest(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		f := newFakeEtcd()
+		p := newSeededPlugin(t, f, map[string]bool{"10.0.0.3": true, "10.0.0.7": true, "10.0.0.9": true},
+			"AllocationStrategy = lowest", "CacheFreeIPs = "+strconv.FormatBool(cached))
+
+		for i := 0; i < 3; i++ {
+			if ip := pickFree(t, p); !ip.Equal(net.IPv4(10, 0, 0, 3)) {
+				t.Errorf("cached=%t: want the lowest free 10.0.0.3 picked, got %s", cached, ip)
+			}
+		}
+	}
+}
+
+func TestAllocationRandom(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		free := map[string]bool{"10.0.0.2": true, "10.0.0.5": true, "10.0.0.8": true}
+		f := newFakeEtcd()
+		p := newSeededPlugin(t, f, free,
+			"AllocationStrategy = random", "CacheFreeIPs = "+strconv.FormatBool(cached))
+
+		picked := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			ip := pickFree(t, p)
+			if !free[ip.String()] {
+				t.Fatalf("cached=%t: picked %s, which is not free", cached, ip)
+			}
+			picked[ip.String()]++
+		}
+		// all three are picked but with a chance of about 1e-17
+		if len(picked) != len(free) {
+			t.Errorf("cached=%t: want picks spread over all of %v, got %v", cached, free, picked)
+		}
+	}
+}
+
+func TestAllocationLRU(t *testing.T) {
+	f := newFakeEtcd()
+	p := newSeededPlugin(t, f, map[string]bool{"10.0.0.2": true, "10.0.0.4": true, "10.0.0.6": true, "10.0.0.9": true},
+		"AllocationStrategy = lru", "FreeValueMetadata = true")
+
+	for ip, value := range map[string]string{
+		"10.0.0.2": `{"ip":"10.0.0.2","freed":300}`,
+		"10.0.0.4": `{"ip":"10.0.0.4","freed":100,"mac":"02:00:00:00:00:04"}`,
+		"10.0.0.6": `{"ip":"10.0.0.6","freed":200}`,
+		"10.0.0.9": "10.0.0.9",
+	} {
+		f.put(p.keys.FreeIP(net.ParseIP(ip).To4()), value)
+	}
+
+	// an ip freed before FreeValueMetadata was set has no freed time and
+	// comes first
+	if ip := pickFree(t, p); !ip.Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Errorf("want 10.0.0.9, without a freed time, picked, got %s", ip)
+	}
+
+	// once leased and released it goes last
+	nic := testMAC(2)
+	if ip := lease(t, p, nic); !ip.Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Fatalf("want %s leased 10.0.0.9, got %s", nic, ip)
+	}
+	if ip := pickFree(t, p); !ip.Equal(net.IPv4(10, 0, 0, 4)) {
+		t.Errorf("want 10.0.0.4, freed the longest ago, picked, got %s", ip)
+	}
+	if err := p.revokeLease(context.Background(), nic); err != nil {
+		t.Fatalf("could not revoke lease of %s: %v", nic, err)
+	}
+	if value, _ := f.get(p.keys.FreeIP(net.IPv4(10, 0, 0, 9).To4())); !strings.Contains(value, `"freed":`) {
+		t.Fatalf("want the release of 10.0.0.9 timed, got %q", value)
+	}
+	if ip := pickFree(t, p); !ip.Equal(net.IPv4(10, 0, 0, 4)) {
+		t.Errorf("want 10.0.0.4 picked ahead of the released 10.0.0.9, got %s", ip)
+	}
+}
@@ -0,0 +1,114 @@
+package etcdplugin
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/pkg/errors"
+)
+
+// the delayed authentication subset of RFC 3118 that is supported
+const (
+	constAuthProtocolDelayed  = 1
+	constAuthAlgorithmHMACMD5 = 1
+	// replay detection with a monotonically increasing counter
+	constAuthRDMCounter = 0
+	// protocol, algorithm, RDM, replay detection, secret id and HMAC-MD5
+	constAuthOptionLen = 1 + 1 + 1 + 8 + 4 + md5.Size
+	constAuthMACOffset = constAuthOptionLen - md5.Size
+)
+
+// delayedAuth validates the RFC 3118 delayed authentication option of
+// requests against the configured shared secrets.
+//
+// coredhcp hands plugins parsed packets, so the HMAC is computed over the
+// packet as dhcpv4 serializes it, with its options in ascending order
+type delayedAuth struct {
+	// shared secrets by id
+	keys map[uint32][]byte
+
+	// last replay detection counter seen from each nic, replays are only
+	// detected within this instance
+	mu     sync.Mutex
+	replay map[string]uint64
+}
+
+// newDelayedAuth parses shared secrets given as id:secret
+func newDelayedAuth(values []string) (*delayedAuth, error) {
+	keys := make(map[uint32][]byte, len(values))
+	for _, value := range values {
+		id, secret, ok := strings.Cut(value, ":")
+		if !ok || secret == "" {
+			return nil, fmt.Errorf("invalid delayed authentication key, want id:secret: %s", value)
+		}
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delayed authentication key id: %s", id)
+		}
+		keys[uint32(n)] = []byte(secret)
+	}
+
+	return &delayedAuth{
+		keys:   keys,
+		replay: make(map[string]uint64),
+	}, nil
+}
+
+// validate checks req carries a valid authentication option
+func (a *delayedAuth) validate(req *dhcpv4.DHCPv4) error {
+	opt := req.Options.Get(dhcpv4.OptionAuthentication)
+	if opt == nil {
+		return errors.New("missing authentication option")
+	}
+	if len(opt) != constAuthOptionLen {
+		return fmt.Errorf("malformed authentication option of %d bytes", len(opt))
+	}
+	if opt[0] != constAuthProtocolDelayed || opt[1] != constAuthAlgorithmHMACMD5 ||
+		opt[2] != constAuthRDMCounter {
+		return fmt.Errorf("unsupported authentication protocol %d, algorithm %d, RDM %d",
+			opt[0], opt[1], opt[2])
+	}
+
+	counter := binary.BigEndian.Uint64(opt[3:11])
+	id := binary.BigEndian.Uint32(opt[11:15])
+	key, ok := a.keys[id]
+	if !ok {
+		return fmt.Errorf("unknown secret id %d", id)
+	}
+
+	// the HMAC covers the message with hops, giaddr and the HMAC itself
+	// zeroed
+	msg, err := dhcpv4.FromBytes(req.ToBytes())
+	if err != nil {
+		return errors.Wrap(err, "could not copy request")
+	}
+	msg.HopCount = 0
+	msg.GatewayIPAddr = net.IPv4zero
+	zeroed := make([]byte, len(opt))
+	copy(zeroed, opt[:constAuthMACOffset])
+	msg.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionAuthentication, zeroed))
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(msg.ToBytes())
+	if !hmac.Equal(mac.Sum(nil), opt[constAuthMACOffset:]) {
+		return errors.New("authentication failed")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	nic := req.ClientHWAddr.String()
+	if last, ok := a.replay[nic]; ok && counter <= last {
+		return fmt.Errorf("replayed authentication counter %d, last was %d", counter, last)
+	}
+	a.replay[nic] = counter
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package etcdplugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+const (
+	// how many times an operation etcd rejected as overloaded is retried
+	constOverloadRetries = 3
+	// the longest the backoff grows to
+	constMaxOverloadBackoff = 10 * time.Second
+)
+
+// backpressure tracks whether etcd is overloaded, the backoff doubles with
+// every rejection and halves with every success
+type backpressure struct {
+	mu      sync.Mutex
+	initial time.Duration
+	backoff time.Duration
+	until   time.Time
+}
+
+func newBackpressure(initial time.Duration) *backpressure {
+	return &backpressure{
+		initial: initial,
+	}
+}
+
+// reject records that etcd rejected an operation as overloaded, returning
+// how long to back off for
+func (b *backpressure) reject() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.backoff *= 2
+	if b.backoff < b.initial {
+		b.backoff = b.initial
+	}
+	if b.backoff > constMaxOverloadBackoff {
+		b.backoff = constMaxOverloadBackoff
+	}
+	b.until = time.Now().Add(b.backoff)
+	metricEtcdOverloaded.Set(1)
+
+	return b.backoff
+}
+
+// accept records that etcd accepted an operation
+func (b *backpressure) accept() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.backoff == 0 {
+		return
+	}
+
+	b.backoff /= 2
+	if b.backoff < b.initial {
+		b.backoff = 0
+	}
+	b.until = time.Time{}
+	metricEtcdOverloaded.Set(0)
+}
+
+// overloaded reports whether etcd recently rejected an operation as
+// overloaded
+func (b *backpressure) overloaded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Now().Before(b.until)
+}
+
+// isOverloaded reports whether an etcd error means it's rate limiting
+// requests
+func isOverloaded(err error) bool {
+	for err != nil {
+		if rpctypes.Error(err) == rpctypes.ErrTooManyRequests {
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+
+	return false
+}
@@ -1,6 +1,25 @@
 package etcdplugin
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// config keys that must be present
+var requiredKeys = []string{"Endpoints", "Start", "End", "Prefix"}
+
+// matches the field name mapstructure quotes in its errors
+var fieldErrorRegexp = regexp.MustCompile(`'([^']+)'`)
 
 type Config struct {
 	CA        string
@@ -14,9 +33,446 @@ type Config struct {
 	DNSZone   string
 	DNSPrefix string
 	DNSNames  string
+	// MaxDNSRecords caps the number of A records in the DNS zone,
+	// zero means unlimited
+	MaxDNSRecords int
+	// DeclineProbe probes declined ips at the end of their quarantine and
+	// only frees them if nobody answers
+	DeclineProbe bool
+	// QuarantineTime is how long a declined ip is kept out of the free
+	// pool before it's returned to it
+	QuarantineTime time.Duration
+	// ReauthOnExpiry recreates the etcd client when an operation fails
+	// because its auth token expired, and retries the operation
+	ReauthOnExpiry bool
+	// AdminListen is the address the admin HTTP API listens on, the API
+	// is disabled when empty
+	AdminListen string
+	// AdminToken is the bearer token admin API requests must carry, it is
+	// required along with AdminListen
+	AdminToken string
+	// LeaseTime is the lease time given to clients that don't request one
+	LeaseTime time.Duration
+	// MonitorInterval is how often the lease monitor sweeps the range
+	MonitorInterval time.Duration
+	// RequestTimeout bounds the etcd operations of each packet handled
+	RequestTimeout time.Duration
+	// TransientRetries is how many times an etcd operation failing
+	// transiently, eg. during a leader election, is retried while handling
+	// a packet, a negative number disables it. The first retry waits
+	// TransientBackoff, which doubles with every further one
+	TransientRetries int
+	TransientBackoff time.Duration
+	// WatchSettings applies changes to the settings overridden in etcd
+	// without a restart
+	WatchSettings bool
+	// HostnameCollisionPolicy is what to do when a nic registers a
+	// hostname already registered by a different nic: overwrite, append
+	// or refuse
+	HostnameCollisionPolicy string
+	// GlobalRateLimit is the maximum number of packets per second
+	// processed, excess packets are dropped, zero means unlimited
+	GlobalRateLimit float64
+	// GlobalRateBurst is the number of packets that can be processed in
+	// a burst above GlobalRateLimit
+	GlobalRateBurst int
+	// NTPServers are the time servers advertised to clients, option 42
+	NTPServers []string
+	// RespectPeerScope ignores DISCOVERs from clients asking for an
+	// address outside of our range, leaving them to the peer server that
+	// owns it
+	RespectPeerScope bool
+	// PacketTrace dumps the raw bytes of every packet when logging at
+	// trace level, off by default since it logs client data
+	PacketTrace bool
+	// RelaxedRelease honors RELEASEs without a server identifier when the
+	// released address matches the client's lease
+	RelaxedRelease bool
+	// OUIReservations reserve part of the range to nics of an OUI, as
+	// <oui>=<count> or <oui>=<percent>%. The leases other instances grant
+	// are counted against them on the next MonitorInterval
+	OUIReservations []string
+	// PruneOutOfRangeLeases deletes, at startup, leases of ips no longer in
+	// the range instead of letting them expire
+	PruneOutOfRangeLeases bool
+	// StartupJitter is the upper bound of the random delay applied before
+	// bootstrapping the range and before the first monitor sweep
+	StartupJitter time.Duration
+	// TFTPServerName is advertised to clients as option 66
+	TFTPServerName string
+	// WPADURL is the web proxy auto-discovery URL advertised to clients as
+	// option 252
+	WPADURL string
+	// ContradictedLeaseTime is the short lease given on next contact to a
+	// client whose lease from this instance was not held in etcd
+	ContradictedLeaseTime time.Duration
+	// TZPOSIX is the POSIX TZ string advertised to clients as option 100
+	TZPOSIX string
+	// TZDatabase is the tz database name advertised to clients as
+	// option 101
+	TZDatabase string
+	// LeaseValueVersion is the schema version of the lease values written,
+	// values of every version are read. Version 3 records the hostname and
+	// the grant and expiry times of leases
+	LeaseValueVersion int
+	// MigrateLeaseValues rewrites, at startup, the lease values of other
+	// versions into LeaseValueVersion
+	MigrateLeaseValues bool
+	// ServeSubnet scopes the plugin to requests relayed from, or received
+	// on, an address of this subnet, the others are dropped
+	ServeSubnet string
+	// DNSHostnameFilter is a regular expression hostnames must match to
+	// be registered in DNS, clients are leased an address regardless
+	DNSHostnameFilter string
+	// OptionOverload moves options into the sname and file fields when a
+	// reply exceeds the size the client accepts
+	OptionOverload bool
+	// OverloadBackoff is the first backoff when etcd rejects a request as
+	// overloaded, it doubles with every further rejection
+	OverloadBackoff time.Duration
+	// ShedOnOverload ignores discovers while etcd is overloaded, so that
+	// renewals keep being served
+	ShedOnOverload bool
+	// OfferTimeout is how long an ip offered to a client is kept for it,
+	// distinct from the LeaseTime it's granted when it requests it
+	OfferTimeout time.Duration
+	// ReplyUnhandledWithLease answers message types the plugin does not
+	// handle with the lease the client's nic holds, if any
+	ReplyUnhandledWithLease bool
+	// DNSRoundRobinNames are hostnames shared by the nics registering
+	// them, each of their ips is added as an A record of its own
+	DNSRoundRobinNames []string
+	// PersistHostname remembers the last hostname each nic sent and
+	// registers it in DNS when a renewal omits it
+	PersistHostname bool
+	// MinEtcdLeaseTTL is the shortest etcd lease granted to leases, offers
+	// and DNS records, shorter times are raised to it
+	MinEtcdLeaseTTL time.Duration
+	// HealHalfBoundLeases repairs renewals whose nic and ip keys disagree,
+	// when only one of them binds the client, instead of refusing them
+	HealHalfBoundLeases bool
+	// DelayedAuthKeys are the id:secret shared secrets requests must be
+	// authenticated with, RFC 3118 delayed authentication, none disables it
+	DelayedAuthKeys []string
+	// DelayedAuthNak answers unauthenticated requests with a NAK instead of
+	// ignoring them
+	DelayedAuthNak bool
+	// StrictRequestedIP NAKs requests whose requested address and ciaddr
+	// disagree, instead of using the one matching the client's state
+	StrictRequestedIP bool
+	// DNSRegistrationStrict drops requests whose DNS registration fails,
+	// by default the lease is granted and the registration retried
+	DNSRegistrationStrict bool
+	// ForceSharedPrefix starts the plugin even if its prefix holds keys
+	// that are not its own
+	ForceSharedPrefix bool
+	// SendBroadcastOption adds the broadcast address option to replies,
+	// derived from the subnet mask unless BroadcastAddress overrides it
+	SendBroadcastOption bool
+	BroadcastAddress    string
+	// MaxDNSLeases caps the etcd leases held by DNS records, past it a
+	// nic's registrations reuse its current lease or are skipped, zero
+	// means unlimited
+	MaxDNSLeases int
+	// FreeValueMetadata stores when and from which nic an ip was freed in
+	// its free key, plain ip values are still read
+	FreeValueMetadata bool
+	// CheckEtcdQuota refuses to bootstrap when etcd raised a NOSPACE alarm
+	// or the range's keys would likely exceed EtcdQuotaBytes, which should
+	// match etcd's --quota-backend-bytes
+	CheckEtcdQuota bool
+	EtcdQuotaBytes int64
+	// ToggleWindow enables detecting clients alternately requesting
+	// different addresses within it, they are then held to their first
+	// choice for ToggleCooloff
+	ToggleWindow  time.Duration
+	ToggleCooloff time.Duration
+	// SerializeLeases hands packets to a single goroutine that applies their
+	// lease operations one after the other, instead of serializing the
+	// handlers on a lock
+	SerializeLeases bool
+	// UtilizationHistory enables storing a snapshot of the range's
+	// utilization on every monitor pass, kept for as long as it says
+	UtilizationHistory time.Duration
+	// ServerID is the address this server identifies itself with, matched
+	// against the server identifier of requests, releases and declines.
+	// When unset, the one set on the reply upstream is used, and releases
+	// and declines are honored if the nic holds the lease when there's none
+	ServerID string
+	// ProblemDeclines parks an ip declined that many times within
+	// ProblemWindow out of the pool instead of quarantining it again, until
+	// an operator returns it through the admin API
+	ProblemDeclines int
+	ProblemWindow   time.Duration
+	// HonorClientFQDN answers the client FQDN option, only registering the
+	// A record of clients leaving it to the server unless OverrideClientFQDN
+	// is set. The name in the option is used when there's no hostname option
+	HonorClientFQDN    bool
+	OverrideClientFQDN bool
+	// ZeroLeaseTimeReleases treats a request for a lease time of zero as a
+	// release of the address the client holds
+	ZeroLeaseTimeReleases bool
+	// DNSSOA and DNSNameservers are registered at startup as the SOA and NS
+	// records of the zone's apex, the SOA given as its mname, rname,
+	// serial, refresh, retry, expire and minimum fields
+	DNSSOA         string
+	DNSNameservers []string
+	// DNSCNAMEConflictPolicy decides what happens when an alias already has
+	// A records: prefer-a (default) keeps them, prefer-cname replaces them
+	// and error fails the registration
+	DNSCNAMEConflictPolicy string
+	// InstanceID has the instance prefer free ips from a region of the range
+	// it hashes to, so that instances sharing the range contend less
+	InstanceID string
+	// EventsBroker enables publishing lease events to EventsTopic,
+	// nats://<host>:<port> is supported. Up to EventsBuffer events wait to
+	// be published
+	EventsBroker   string
+	EventsTopic    string
+	EventsUser     string
+	EventsPassword string
+	EventsBuffer   int
+	// EventsOverflowPolicy is what to do with an event when EventsBuffer
+	// is full: drop-newest drops it, drop-oldest drops the oldest waiting
+	// one instead, and block-with-timeout waits up to EventsBlockTimeout
+	// for room before dropping it
+	EventsOverflowPolicy string
+	EventsBlockTimeout   time.Duration
+	// QuarantineMalformed moves keys whose value can't be decoded under the
+	// malformed prefix for review, instead of only failing on them
+	QuarantineMalformed bool
+	// DNSWorkers registers DNS names on that many background workers
+	// instead of while handling the request, the reply does not wait on
+	// them
+	DNSWorkers int
+	// Username and Password authenticate to etcd clusters with RBAC enabled,
+	// alongside or instead of client certificates
+	Username string
+	Password string
+	// SubnetMask is sent in offers and acks, eg. 255.255.255.0
+	SubnetMask string
+	// Routers are sent in offers and acks as the clients' default gateways,
+	// in order of preference
+	Routers []string
+	// DNSServers are sent in offers and acks as the clients' resolvers,
+	// independently of DNS registration
+	DNSServers []string
+	// SyncInterval is how often the etcd endpoint list is synced, a failed
+	// sync is retried SyncRetries times with a backoff before reconnecting
+	SyncInterval time.Duration
+	SyncRetries  int
+	// MinLeaseTime and MaxLeaseTime bound the lease times clients request,
+	// zero leaves them unbounded
+	MinLeaseTime time.Duration
+	MaxLeaseTime time.Duration
+	// Reservations is a file pinning ips of the range to nics, one
+	// <mac> <ip> pair per line
+	Reservations string
+	// CacheFreeIPs keeps the free ips in memory, in sync with etcd through
+	// a watch, instead of scanning them on every DISCOVER
+	CacheFreeIPs bool
+	// AllocationStrategy picks the free ip a DISCOVER is offered: lowest
+	// (default), random or lru, the one freed the longest ago
+	AllocationStrategy string
+	// Ranges are leased from once Start-End is exhausted, in order, each
+	// given as <start>-<end>
+	Ranges []string
+	// Exclude are ips or CIDRs within the ranges that are never leased,
+	// such as the gateway's
+	Exclude []string
+	// ReloadDNSNames loads DNSNames again when the process receives
+	// SIGHUP, a file that fails to load leaves the current names in place
+	ReloadDNSNames bool
+	// MaxRangeSize is the most ips the ranges may hold together, larger
+	// ranges are refused at startup
+	MaxRangeSize int
+	// RenewalTime and RebindingTime are the T1 and T2 sent in ACKs, zero
+	// sends half and seven eighths of the lease time
+	RenewalTime   time.Duration
+	RebindingTime time.Duration
+	// RelayPools lease clients behind relays from ranges of the relay's
+	// subnet, each given as <cidr>=<start>-<end>[,<start>-<end>...]. The
+	// subnet is matched against giaddr, directly connected clients and
+	// relays without a pool are leased from Start-End and Ranges
+	RelayPools []string
+	// Namespace scopes the plugin's etcd operations to Prefix through an
+	// etcd namespace instead of prefixing every key, the keys end up the
+	// same either way
+	Namespace bool
+	// HeartbeatTTL has the instance keep a heartbeat in etcd while it's
+	// active, which its standbys watch. It's how long the heartbeat outlives
+	// an instance that stopped keeping it
+	HeartbeatTTL time.Duration
+	// Standby starts the instance as the warm standby of the active one
+	// sharing its prefix, it drops the packets it gets and leaves the leases
+	// alone, keeping its free ip cache in sync, until the heartbeat of the
+	// active instance is gone and it takes over. It needs CacheFreeIPs
+	Standby bool
 }
 
+// String prints every field of the config as <field>=<value>, in the order
+// they are declared, with the secrets masked by Redacted. It's safe to log
 func (c Config) String() string {
-	return fmt.Sprintf("CA=%s Cert=%s Key=%s Endpoints=%v Start=%s End=%s Prefix=%s Separator=%s DNSZone=%s DNSPrefix=%s DNSNames=%s",
-		c.CA, c.Cert, c.Key, c.Endpoints, c.Start, c.End, c.Prefix, c.Separator, c.DNSZone, c.DNSPrefix, c.DNSNames)
+	v := reflect.ValueOf(c.Redacted())
+	fields := make([]string, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		fields = append(fields, fmt.Sprintf("%s=%v", v.Type().Field(i).Name, v.Field(i).Interface()))
+	}
+	return strings.Join(fields, " ")
+}
+
+// constRedacted replaces secrets in a redacted config
+const constRedacted = "***"
+
+// Redacted returns a copy of the config with its secrets masked, file paths
+// are not secrets and are kept
+func (c Config) Redacted() Config {
+	keys := make([]string, 0, len(c.DelayedAuthKeys))
+	for _, key := range c.DelayedAuthKeys {
+		id, _, _ := strings.Cut(key, ":")
+		keys = append(keys, id+":"+constRedacted)
+	}
+	c.DelayedAuthKeys = keys
+
+	if c.EventsPassword != "" {
+		c.EventsPassword = constRedacted
+	}
+	if c.Password != "" {
+		c.Password = constRedacted
+	}
+	if c.AdminToken != "" {
+		c.AdminToken = constRedacted
+	}
+
+	return c
+}
+
+// configLine is a line of the properties config
+type configLine struct {
+	number int
+	key    string
+	value  string
+}
+
+// LoadConfig parses the plugin arguments, one properties line each, into a
+// Config, errors point at the offending line where possible
+func LoadConfig(args []string) (Config, error) {
+	lines := make(map[string]configLine)
+	for i, arg := range args {
+		line := strings.TrimSpace(arg)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		sep := strings.IndexAny(line, "=:")
+		if sep <= 0 {
+			return Config{}, fmt.Errorf("config line %d: want <key> = <value>, got %q", i+1, line)
+		}
+
+		key := strings.TrimSpace(line[:sep])
+		lines[strings.ToLower(key)] = configLine{
+			number: i + 1,
+			key:    key,
+			value:  strings.TrimSpace(line[sep+1:]),
+		}
+	}
+
+	v := viper.New()
+	v.SetConfigType("properties")
+	if err := v.ReadConfig(bytes.NewBufferString(strings.Join(args, "\n"))); err != nil {
+		return Config{}, fmt.Errorf("unable to read config: %w", err)
+	}
+
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		var merr *mapstructure.Error
+		if !errors.As(err, &merr) {
+			return Config{}, fmt.Errorf("unable to unmarshal config: %w", err)
+		}
+
+		problems := make([]string, 0, len(merr.Errors))
+		for _, problem := range merr.Errors {
+			if m := fieldErrorRegexp.FindStringSubmatch(problem); m != nil {
+				if line, ok := lines[strings.ToLower(m[1])]; ok {
+					problem = fmt.Sprintf("line %d (%s = %s): %s",
+						line.number, line.key, line.value, problem)
+				}
+			}
+			problems = append(problems, problem)
+		}
+		return Config{}, fmt.Errorf("unable to unmarshal config: %s", strings.Join(problems, "; "))
+	}
+
+	fields := make(map[string]struct{})
+	t := reflect.TypeOf(config)
+	for i := 0; i < t.NumField(); i++ {
+		fields[strings.ToLower(t.Field(i).Name)] = struct{}{}
+	}
+	for key, line := range lines {
+		if _, ok := fields[key]; !ok {
+			log.Warningf("config line %d: unknown key %s", line.number, line.key)
+		}
+	}
+
+	var missing []string
+	for _, key := range requiredKeys {
+		if line, ok := lines[strings.ToLower(key)]; !ok || line.value == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return Config{}, fmt.Errorf("missing required config keys: %s", strings.Join(missing, ", "))
+	}
+
+	endpoints, err := parseEndpoints(config.Endpoints)
+	if err != nil {
+		return Config{}, err
+	}
+	config.Endpoints = endpoints
+
+	return config, nil
+}
+
+// validatePrefix checks that a key prefix is a single component, keys are
+// split on the separator and one holding it would be misparsed
+func validatePrefix(name, prefix, separator string) error {
+	if prefix == "" {
+		return fmt.Errorf("empty %s", name)
+	}
+	// a prefix ending in part of the separator is as bad, a:: with :: would
+	// be read as a and :
+	if strings.Index(prefix+separator, separator) != len(prefix) {
+		return fmt.Errorf("%s %q must not contain the separator %q, nor end in part of it", name, prefix, separator)
+	}
+	return nil
+}
+
+// parseEndpoints splits endpoints given in a single comma or space separated
+// value, and checks each is a host:port, optionally with an http(s) scheme
+func parseEndpoints(values []string) ([]string, error) {
+	var endpoints []string
+	for _, value := range values {
+		endpoints = append(endpoints, strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
+	}
+
+	for _, endpoint := range endpoints {
+		hostport := endpoint
+		if i := strings.Index(endpoint, "://"); i >= 0 {
+			scheme := endpoint[:i]
+			if scheme != "http" && scheme != "https" {
+				return nil, fmt.Errorf("invalid scheme in Endpoints: %v", endpoint)
+			}
+			hostport = endpoint[i+len("://"):]
+		}
+		if host, port, err := net.SplitHostPort(hostport); err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("invalid host:port in Endpoints: %v", endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints in Endpoints")
+	}
+
+	return endpoints, nil
 }
@@ -0,0 +1,89 @@
+package etcdplugin
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	c := Config{
+		Cert:            "/etc/etcd/client.pem",
+		Username:        "dhcp",
+		Password:        "etcd-secret",
+		EventsPassword:  "nats-secret",
+		AdminToken:      "admin-secret",
+		DelayedAuthKeys: []string{"1:auth-secret"},
+	}
+
+	for _, s := range []string{c.String(), fmt.Sprintf("%v", c)} {
+		for _, secret := range []string{"etcd-secret", "nats-secret", "admin-secret", "auth-secret"} {
+			if strings.Contains(s, secret) {
+				t.Errorf("%s printed in %s", secret, s)
+			}
+		}
+		if !strings.Contains(s, "Cert=/etc/etcd/client.pem") {
+			t.Errorf("want the cert path printed, got %s", s)
+		}
+		if !strings.Contains(s, "DelayedAuthKeys=[1:"+constRedacted+"]") {
+			t.Errorf("want the auth key ids printed, got %s", s)
+		}
+		if !strings.Contains(s, "Username=dhcp Password="+constRedacted) {
+			t.Errorf("want the username printed and the password masked, got %s", s)
+		}
+	}
+}
+
+func TestConfigStringPrintsEveryField(t *testing.T) {
+	s := Config{}.String()
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if name := typ.Field(i).Name; !strings.Contains(s, " "+name+"=") && !strings.HasPrefix(s, name+"=") {
+			t.Errorf("want %s printed, got %s", name, s)
+		}
+	}
+}
+
+func TestLoadConfigReportsProblems(t *testing.T) {
+	valid := []string{"Endpoints = 127.0.0.1:2379", "Start = 10.0.0.1", "End = 10.0.0.10", "Prefix = test"}
+
+	for _, tt := range []struct {
+		name  string
+		lines []string
+		// what the error must mention
+		want []string
+	}{
+		{
+			name:  "malformed line",
+			lines: append(append([]string{}, valid...), "LeaseTime"),
+			want:  []string{"line 5", `"LeaseTime"`},
+		},
+		{
+			name:  "malformed value",
+			lines: append(append([]string{}, valid...), "DeclineProbe = sometimes"),
+			want:  []string{"line 5", "DeclineProbe = sometimes"},
+		},
+		{
+			name:  "missing keys",
+			lines: valid[2:],
+			want:  []string{"missing required config keys", "Endpoints", "Start"},
+		},
+		{
+			name:  "empty required key",
+			lines: append(append([]string{}, valid[1:]...), "Endpoints ="),
+			want:  []string{"missing required config keys: Endpoints"},
+		},
+	} {
+		_, err := LoadConfig(tt.lines)
+		if err == nil {
+			t.Errorf("%s: want %v refused", tt.name, tt.lines)
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: want the error to mention %s, got %v", tt.name, want, err)
+			}
+		}
+	}
+}
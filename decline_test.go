@@ -0,0 +1,117 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubProber answers probes with inUse
+type stubProber struct {
+	inUse  atomic.Bool
+	probes atomic.Int64
+}
+
+func (s *stubProber) InUse(ctx context.Context, ip net.IP) (bool, error) {
+	s.probes.Add(1)
+	return s.inUse.Load(), nil
+}
+
+func TestSetupRejectsNegativeQuarantineTime(t *testing.T) {
+	_, err := newPluginState(testConfig(t, "QuarantineTime = -1m"), newFakeEtcd().dial)
+	if err == nil {
+		t.Fatal("want a negative QuarantineTime rejected")
+	}
+}
+
+func TestDeclinedIPQuarantined(t *testing.T) {
+	f := newFakeEtcd()
+	p := newSeededPlugin(t, f, map[string]bool{"10.0.0.4": true}, "QuarantineTime = 2s")
+	ctx := context.Background()
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+	if err := p.declineLease(ctx, nic); err != nil {
+		t.Fatalf("could not decline lease of %s: %v", nic, err)
+	}
+	if _, ok := f.get(p.keys.IP(IPStateDeclined, ip.String())); !ok {
+		t.Fatalf("want %s declined", ip)
+	}
+
+	// the only ip of the pool is out of it until the quarantine ends, the
+	// end being stored in whole seconds it's at least a second away
+	if promoted, err := p.promoteDeclined(ctx); err != nil || promoted != 0 {
+		t.Fatalf("want %s kept quarantined, got %d promoted: %v", ip, promoted, err)
+	}
+	if got := discover(t, p, testMAC(2)); got != nil {
+		t.Fatalf("want nothing offered during the quarantine, got %s", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		promoted, err := p.promoteDeclined(ctx)
+		if err != nil {
+			t.Fatalf("could not promote declined ips: %v", err)
+		}
+		if promoted == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %s promoted once its quarantine ended", ip)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if got := discover(t, p, testMAC(2)); !got.Equal(ip) {
+		t.Errorf("want %s offered after its quarantine, got %s", ip, got)
+	}
+}
+
+func TestDeclineProbeExtendsQuarantineOfConflictedIP(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "QuarantineTime = 1h")
+	prober := &stubProber{}
+	prober.inUse.Store(true)
+	p.prober = prober
+	ctx := context.Background()
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+	if err := p.declineLease(ctx, nic); err != nil {
+		t.Fatalf("could not decline lease of %s: %v", nic, err)
+	}
+	// the quarantine is over
+	declinedKey := p.keys.IP(IPStateDeclined, ip.String())
+	f.put(declinedKey, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+
+	// something still answers on the ip, it stays quarantined
+	if promoted, err := p.promoteDeclined(ctx); err != nil || promoted != 0 {
+		t.Fatalf("want the conflicted %s kept quarantined, got %d promoted: %v", ip, promoted, err)
+	}
+	if prober.probes.Load() != 1 {
+		t.Errorf("want %s probed once, got %d probes", ip, prober.probes.Load())
+	}
+	value, ok := f.get(declinedKey)
+	if !ok {
+		t.Fatalf("want %s still declined", ip)
+	}
+	if until, err := strconv.ParseInt(value, 10, 64); err != nil || time.Until(time.Unix(until, 0)) < 59*time.Minute {
+		t.Errorf("want the quarantine of %s extended by an hour, got %q", ip, value)
+	}
+	if _, ok := f.get(p.keys.FreeIP(ip)); ok {
+		t.Errorf("want the conflicted %s kept out of the pool", ip)
+	}
+
+	// once the conflict is gone the ip goes back to the pool at the end of
+	// its quarantine
+	prober.inUse.Store(false)
+	f.put(declinedKey, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	if promoted, err := p.promoteDeclined(ctx); err != nil || promoted != 1 {
+		t.Fatalf("want %s promoted, got %d promoted: %v", ip, promoted, err)
+	}
+	if _, ok := f.get(p.keys.FreeIP(ip)); !ok {
+		t.Errorf("want %s free again", ip)
+	}
+}
@@ -0,0 +1,105 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ProblemIP is an ip parked out of the pool after being declined too often
+type ProblemIP struct {
+	IP     net.IP    `json:"ip"`
+	Parked time.Time `json:"parked"`
+}
+
+// recordDecline remembers that ip was declined, reporting whether it was
+// declined ProblemDeclines times within ProblemWindow
+func (p *PluginState) recordDecline(ctx context.Context, ip string) (bool, error) {
+	kvc := p.kv()
+	key := p.keys.Declines(ip)
+
+	resp, err := kvc.Get(ctx, key)
+	if err != nil {
+		return false, errors.Wrap(err, "could not get declines")
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-p.config.ProblemWindow)
+
+	var declines []string
+	if len(resp.Kvs) > 0 {
+		for _, s := range strings.Split(string(resp.Kvs[0].Value), ",") {
+			at, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Warningf("malformed decline time of ip %s: %v", ip, err)
+				continue
+			}
+			if time.Unix(at, 0).After(cutoff) {
+				declines = append(declines, s)
+			}
+		}
+	}
+	declines = append(declines, strconv.FormatInt(now.Unix(), 10))
+
+	if len(declines) >= p.config.ProblemDeclines {
+		if _, err := kvc.Delete(ctx, key); err != nil {
+			return false, errors.Wrap(err, "could not delete declines")
+		}
+		return true, nil
+	}
+
+	if _, err := kvc.Put(ctx, key, strings.Join(declines, ",")); err != nil {
+		return false, errors.Wrap(err, "could not store declines")
+	}
+	log.Debugf("ip %s was declined %d times since %s", ip, len(declines), cutoff)
+
+	return false, nil
+}
+
+// ProblemIPs returns the ips parked out of the pool
+func (p *PluginState) ProblemIPs(ctx context.Context) ([]ProblemIP, error) {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.IP(IPStateProblem, ""), etcd.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list problem ips")
+	}
+
+	ips := make([]ProblemIP, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err != nil {
+			log.Warningf("ignoring key: %v", err)
+			continue
+		}
+		problem := ProblemIP{IP: ip}
+
+		if parked, err := strconv.ParseInt(string(kv.Value), 10, 64); err == nil {
+			problem.Parked = time.Unix(parked, 0)
+		}
+		ips = append(ips, problem)
+	}
+
+	return ips, nil
+}
+
+// releaseProblemIP returns a parked ip to the pool, once an operator dealt
+// with whatever kept declining it
+func (p *PluginState) releaseProblemIP(ctx context.Context, ip net.IP) error {
+	ok, err := p.transition(ctx, ip, IPStateProblem, IPStateFree)
+	if err != nil {
+		return errors.WithMessage(err, "could not move problem ip to free state")
+	}
+	if !ok {
+		return errors.Wrapf(ErrNotParked, "ip %s", ip)
+	}
+
+	log.Infof("returned problem ip %s to free state", ip)
+
+	return nil
+}
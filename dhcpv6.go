@@ -0,0 +1,242 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+func setup6(args0 ...string) (handler.Handler6, error) {
+	config, err := LoadConfig(args0)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("%s", config)
+
+	p, err := newPluginState6(config, NewClient)
+	if err != nil {
+		return nil, err
+	}
+	register(p)
+
+	return p.Handler6, nil
+}
+
+// newPluginState6 brings up an instance of the plugin leasing the IPv6
+// addresses of Start-End on a client created by dial. The DHCPv4 range
+// settings, the DNS registration and the standby do not apply to it
+func newPluginState6(config Config, dial dialer) (_ *PluginState, err error) {
+	config, err = withDefaults(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Standby {
+		return nil, errors.New("Standby is not supported for DHCPv6")
+	}
+
+	range6, err := parseRange6(config.Start, config.End)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancelled by Close, or when setup fails
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// closed after the background goroutines are done with it
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+
+	// a failed setup stops the goroutines it started and closes the client
+	var p *PluginState
+	defer func() {
+		if err == nil {
+			return
+		}
+		if p != nil {
+			if cerr := p.close(); cerr != nil {
+				log.Warningf("could not close the instance that failed to set up: %v", cerr)
+			}
+			return
+		}
+		cancel()
+		clientCancel()
+	}()
+
+	client, err := dial(clientCtx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	grp, ctx := errgroup.WithContext(ctx)
+
+	p = &PluginState{
+		config:       config,
+		keys:         newKeyspace(config),
+		dial:         dial,
+		client:       client,
+		clientCancel: clientCancel,
+		cancel:       cancel,
+		grp:          grp,
+		range6:       &range6,
+		nics:         newNicLocks(),
+		backpressure: newBackpressure(config.OverloadBackoff),
+		current:      fileSettings(config),
+	}
+
+	if err := p.loadSettings(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load config overrides: %w", err)
+	}
+	if config.WatchSettings {
+		p.goOptional("could not watch config overrides", func() error {
+			log.Info("watching config overrides")
+			return p.watchSettings(ctx)
+		})
+	}
+
+	if err := p.checkPrefix(ctx); err != nil {
+		return nil, err
+	}
+
+	grp.Go(func() error {
+		err := p.syncEndpoints(ctx)
+		return errors.Wrap(err, "could not sync etcd endpoints")
+	})
+
+	log.Infof("leasing IPv6 addresses of %s", range6)
+
+	return p, nil
+}
+
+// Handler6 leases IPv6 addresses to the IA_NAs of DHCPv6 clients. Each
+// IA_NA of a SOLICIT is advertised the address its client holds or one it
+// would be leased, REQUEST, RENEW and REBIND lease it, as does a SOLICIT
+// with rapid commit, and RELEASE gives it up. Leases key off the client's
+// DUID and the IAID of the IA_NA, the leases expire along with their etcd
+// lease
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	// the active instance answers
+	if p.isStandby() {
+		return nil, true
+	}
+
+	msg, err := req.GetInnerMessage()
+	if err != nil {
+		log.Errorf("could not decapsulate DHCPv6 packet: %v", err)
+		return nil, true
+	}
+	reply, ok := resp.(*dhcpv6.Message)
+	if !ok {
+		log.Errorf("cannot answer DHCPv6 %v with a %T", msg.Type(), resp)
+		return resp, false
+	}
+
+	log.Debugf("got DHCPv6 packet %v", msg.Type())
+
+	// what's done for each IA_NA, releasing it when nil
+	var lease func(ctx context.Context, b binding6, hint net.IP, ttl time.Duration) (net.IP, error)
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		lease = p.leaseIP6
+		// without rapid commit it's only advertised
+		if reply.Type() != dhcpv6.MessageTypeReply {
+			lease = func(ctx context.Context, b binding6, hint net.IP, _ time.Duration) (net.IP, error) {
+				return p.freeIP6(ctx, b, hint)
+			}
+		}
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		lease = p.leaseIP6
+	case dhcpv6.MessageTypeRelease:
+	default:
+		return resp, false
+	}
+
+	clientID := msg.Options.ClientID()
+	ianas := msg.Options.IANA()
+	if clientID == nil || len(ianas) == 0 {
+		log.Debugf("ignoring DHCPv6 %v without a client id or an IA_NA", msg.Type())
+		return resp, false
+	}
+	duid := hex.EncodeToString(clientID.ToBytes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.RequestTimeout)
+	defer cancel()
+
+	defer p.nics.lockKey(duid)()
+
+	leaseTime := p.settings().LeaseTime
+	t1, t2 := p.renewalTimes(leaseTime)
+	for _, ia := range ianas {
+		b := binding6{duid: duid, iaid: hex.EncodeToString(ia.IaId[:])}
+
+		if lease == nil {
+			var released bool
+			err := p.retry(ctx, func() (err error) {
+				released, err = p.releaseIP6(ctx, b)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to release the address of %s: %v", b, err)
+				return nil, true
+			}
+			status := iana.StatusSuccess
+			if released {
+				log.Infof("released the address of %s", b)
+			} else {
+				status = iana.StatusNoBinding
+			}
+			reply.AddOption(&dhcpv6.OptIANA{
+				IaId:    ia.IaId,
+				Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{&dhcpv6.OptStatusCode{StatusCode: status}}},
+			})
+			continue
+		}
+
+		var hint net.IP
+		if addr := ia.Options.OneAddress(); addr != nil {
+			hint = addr.IPv6Addr
+		}
+
+		var ip net.IP
+		err := p.retry(ctx, func() (err error) {
+			ip, err = lease(ctx, b, hint, leaseTime)
+			return err
+		})
+		if err != nil {
+			log.Errorf("unable to lease an address to %s: %v", b, err)
+			return nil, true
+		}
+		if ip == nil {
+			log.Warningf("no IPv6 address of %s available to %s", p.range6, b)
+			reply.AddOption(&dhcpv6.OptIANA{
+				IaId: ia.IaId,
+				Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{&dhcpv6.OptStatusCode{
+					StatusCode:    iana.StatusNoAddrsAvail,
+					StatusMessage: "no addresses available",
+				}}},
+			})
+			continue
+		}
+
+		log.Infof("returning IPv6 address %s for %s", ip, b)
+		reply.AddOption(&dhcpv6.OptIANA{
+			IaId: ia.IaId,
+			T1:   t1,
+			T2:   t2,
+			Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{&dhcpv6.OptIAAddress{
+				IPv6Addr:          ip,
+				PreferredLifetime: leaseTime,
+				ValidLifetime:     leaseTime,
+			}}},
+		})
+	}
+
+	return reply, false
+}
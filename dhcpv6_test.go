@@ -0,0 +1,299 @@
+package etcdplugin
+
+import (
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// newTestPlugin6 brings up a DHCPv6 plugin instance for the range
+// 2001:db8::1-2001:db8::ffff:ffff:ffff:ffff on f, lines are further config
+// lines overriding it
+func newTestPlugin6(t testing.TB, f *fakeEtcd, lines ...string) *PluginState {
+	t.Helper()
+
+	config, err := LoadConfig(append([]string{
+		"Endpoints = 127.0.0.1:2379",
+		"Start = 2001:db8::1",
+		"End = 2001:db8::ffff:ffff:ffff:ffff",
+		"Prefix = test",
+		"SyncInterval = 1h",
+	}, lines...))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	p, err := newPluginState6(config, f.dial)
+	if err != nil {
+		t.Fatalf("could not set up plugin: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("could not close plugin: %v", err)
+		}
+	})
+
+	return p
+}
+
+// ia is an IA_NA of iaid, holding ip when it's set
+func ia(iaid byte, ip net.IP) *dhcpv6.OptIANA {
+	opt := &dhcpv6.OptIANA{IaId: [4]byte{0, 0, 0, iaid}}
+	if ip != nil {
+		opt.Options.Add(&dhcpv6.OptIAAddress{IPv6Addr: ip})
+	}
+	return opt
+}
+
+// message6 builds a DHCPv6 message of typ from the client of nic, carrying
+// ias
+func message6(t testing.TB, typ dhcpv6.MessageType, nic net.HardwareAddr, ias ...*dhcpv6.OptIANA) *dhcpv6.Message {
+	t.Helper()
+
+	msg, err := dhcpv6.NewMessage(dhcpv6.WithClientID(dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: nic,
+	}))
+	if err != nil {
+		t.Fatalf("could not build message: %v", err)
+	}
+	msg.MessageType = typ
+	for _, opt := range ias {
+		msg.AddOption(opt)
+	}
+	return msg
+}
+
+// exchange6 hands msg to the plugin along with the reply the server would
+// have started, and returns what the plugin answered, nil if dropped
+func exchange6(t testing.TB, p *PluginState, msg *dhcpv6.Message) *dhcpv6.Message {
+	t.Helper()
+
+	var resp *dhcpv6.Message
+	var err error
+	if msg.Type() == dhcpv6.MessageTypeSolicit && msg.GetOneOption(dhcpv6.OptionRapidCommit) == nil {
+		resp, err = dhcpv6.NewAdvertiseFromSolicit(msg)
+	} else {
+		resp, err = dhcpv6.NewReplyFromMessage(msg)
+	}
+	if err != nil {
+		t.Fatalf("could not build reply: %v", err)
+	}
+
+	reply, _ := p.Handler6(msg, resp)
+	if reply == nil {
+		return nil
+	}
+	return reply.(*dhcpv6.Message)
+}
+
+// answer returns the address and status the reply holds for the IA_NA of
+// iaid
+func answer(t testing.TB, reply *dhcpv6.Message, iaid byte) (net.IP, iana.StatusCode) {
+	t.Helper()
+
+	if reply == nil {
+		t.Fatal("the packet was dropped")
+	}
+	for _, opt := range reply.Options.IANA() {
+		if opt.IaId != [4]byte{0, 0, 0, iaid} {
+			continue
+		}
+		if status := opt.Options.Status(); status != nil {
+			return nil, status.StatusCode
+		}
+		if addr := opt.Options.OneAddress(); addr != nil {
+			return addr.IPv6Addr, iana.StatusSuccess
+		}
+	}
+	t.Fatalf("no IA_NA %d in %v", iaid, reply)
+	return nil, 0
+}
+
+// lease6 has the client of nic solicit an address for the IA_NA of iaid and
+// request it, failing the test unless it's leased
+func lease6(t testing.TB, p *PluginState, nic net.HardwareAddr, iaid byte) net.IP {
+	t.Helper()
+
+	advertised, status := answer(t, exchange6(t, p, message6(t, dhcpv6.MessageTypeSolicit, nic, ia(iaid, nil))), iaid)
+	if status != iana.StatusSuccess {
+		t.Fatalf("%s was advertised no address: %v", nic, status)
+	}
+	leased, status := answer(t, exchange6(t, p, message6(t, dhcpv6.MessageTypeRequest, nic, ia(iaid, advertised))), iaid)
+	if status != iana.StatusSuccess || !leased.Equal(advertised) {
+		t.Fatalf("%s was not leased %s: %s %v", nic, advertised, leased, status)
+	}
+	return leased
+}
+
+func TestLease6RoundTrip(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f)
+
+	// nothing is bootstrapped, the range is far too large
+	if keys := f.keys(p.keys.Root()); len(keys) != 0 {
+		t.Fatalf("want no keys after setup, got %v", keys)
+	}
+
+	nic := testMAC(1)
+	ip := lease6(t, p, nic, 1)
+	if !p.range6.contains(ip) {
+		t.Fatalf("leased %s outside of %s", ip, p.range6)
+	}
+
+	holder, ok := f.get(p.keys.IP6(IPStateLeased, ip))
+	if !ok || !strings.HasSuffix(holder, "/00000001") {
+		t.Errorf("want %s marked leased to IA_NA 1, got %q", ip, holder)
+	}
+
+	// the client is advertised and renews the address it holds
+	for _, typ := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+		if again, _ := answer(t, exchange6(t, p, message6(t, typ, nic, ia(1, nil))), 1); !again.Equal(ip) {
+			t.Errorf("want %v answered with %s, got %s", typ, ip, again)
+		}
+	}
+
+	// another client is leased another address
+	if other := lease6(t, p, testMAC(2), 1); other.Equal(ip) {
+		t.Errorf("want another address for another client, got %s too", other)
+	}
+}
+
+func TestLease6PerIANA(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f)
+
+	reply := exchange6(t, p, message6(t, dhcpv6.MessageTypeRequest, testMAC(1), ia(1, nil), ia(2, nil)))
+	first, _ := answer(t, reply, 1)
+	second, _ := answer(t, reply, 2)
+	if first == nil || second == nil || first.Equal(second) {
+		t.Errorf("want an address for each IA_NA, got %s and %s", first, second)
+	}
+}
+
+func TestLease6RapidCommit(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f)
+
+	solicit := message6(t, dhcpv6.MessageTypeSolicit, testMAC(1), ia(1, nil))
+	solicit.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionRapidCommit})
+	ip, _ := answer(t, exchange6(t, p, solicit), 1)
+
+	if _, ok := f.get(p.keys.IP6(IPStateLeased, ip)); !ok {
+		t.Errorf("want %s leased by a rapid commit SOLICIT", ip)
+	}
+}
+
+func TestLease6HonorsRequestedAddress(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f)
+
+	want := net.ParseIP("2001:db8::42")
+	got, _ := answer(t, exchange6(t, p, message6(t, dhcpv6.MessageTypeRequest, testMAC(1), ia(1, want))), 1)
+	if !got.Equal(want) {
+		t.Errorf("want the requested %s leased, got %s", want, got)
+	}
+
+	// unless it's held by another client
+	other, _ := answer(t, exchange6(t, p, message6(t, dhcpv6.MessageTypeRequest, testMAC(2), ia(1, want))), 1)
+	if other == nil || other.Equal(want) {
+		t.Errorf("want another address than %s, got %s", want, other)
+	}
+}
+
+func TestRelease6(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f)
+
+	nic := testMAC(1)
+	ip := lease6(t, p, nic, 1)
+
+	release := message6(t, dhcpv6.MessageTypeRelease, nic, ia(1, ip))
+	if _, status := answer(t, exchange6(t, p, release), 1); status != iana.StatusSuccess {
+		t.Errorf("want the release to succeed, got %v", status)
+	}
+	if keys := f.keys(p.keys.Root()); len(keys) != 0 {
+		t.Errorf("want no keys left after the release, got %v", keys)
+	}
+
+	if _, status := answer(t, exchange6(t, p, release), 1); status != iana.StatusNoBinding {
+		t.Errorf("want releasing again to have no binding, got %v", status)
+	}
+}
+
+func TestLease6Expires(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f, "LeaseTime = 1m")
+
+	lease6(t, p, testMAC(1), 1)
+
+	f.advance(time.Minute + time.Second)
+	if keys := f.keys(p.keys.Root()); len(keys) != 0 {
+		t.Errorf("want the lease gone once expired, got %v", keys)
+	}
+}
+
+func TestLease6NoAddressesAvailable(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin6(t, f, "End = 2001:db8::2")
+
+	lease6(t, p, testMAC(1), 1)
+	lease6(t, p, testMAC(2), 1)
+
+	reply := exchange6(t, p, message6(t, dhcpv6.MessageTypeRequest, testMAC(3), ia(1, nil)))
+	if _, status := answer(t, reply, 1); status != iana.StatusNoAddrsAvail {
+		t.Errorf("want no addresses available once the range is leased, got %v", status)
+	}
+}
+
+func TestSetup6RejectsIPv4Range(t *testing.T) {
+	config, err := LoadConfig([]string{
+		"Endpoints = 127.0.0.1:2379",
+		"Start = 10.0.0.1",
+		"End = 10.0.0.10",
+		"Prefix = test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPluginState6(config, newFakeEtcd().dial); err == nil {
+		t.Error("want an IPv4 range refused")
+	}
+}
+
+func TestIP6KeysHoldNoSeparator(t *testing.T) {
+	keys := newKeyspace(Config{Prefix: "test", Separator: "::"})
+
+	ip := net.ParseIP("2001:db8::1")
+	key := keys.IP6(IPStateLeased, ip)
+	if strings.Count(key, "::") != 3 {
+		t.Errorf("want the address in %s to hold no separator", key)
+	}
+
+	state, parsed, err := keys.ParseIP6(key)
+	if err != nil || state != IPStateLeased || !parsed.Equal(ip) {
+		t.Errorf("want %s parsed back to %s %s, got %s %s: %v", key, IPStateLeased, ip, state, parsed, err)
+	}
+}
+
+func TestIPAdd6(t *testing.T) {
+	for _, tt := range []struct {
+		start string
+		add   int64
+		want  string
+	}{
+		{"2001:db8::1", 1, "2001:db8::2"},
+		{"2001:db8::ffff", 1, "2001:db8::1:0"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 2, "::1"},
+	} {
+		if got := IPAdd6(net.ParseIP(tt.start), big.NewInt(tt.add)); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("want %s + %d = %s, got %s", tt.start, tt.add, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// IPState is the state etcd holds for an ip of the leasable range
+type IPState string
+
+const (
+	IPStateFree IPState = "free"
+	// offered to a nic that has yet to request it
+	IPStateOffered  IPState = "offered"
+	IPStateLeased   IPState = "leased"
+	IPStateDeclined IPState = "declined"
+	// declined too often, parked out of the pool until an operator
+	// returns it
+	IPStateProblem IPState = "problem"
+	// reserved for a nic that does not hold it
+	IPStateReserved IPState = "reserved"
+	// the allocator considers the ip allocatable but etcd has no key
+	// for it, resurrectLeases will eventually move it back to free
+	IPStateMissing IPState = "missing"
+)
+
+// ipStates are the states etcd holds keys for
+var ipStates = []IPState{IPStateFree, IPStateOffered, IPStateLeased, IPStateDeclined, IPStateProblem, IPStateReserved}
+
+// StateRange is a run of consecutive ips sharing the same state
+type StateRange struct {
+	State IPState
+	First net.IP
+	Last  net.IP
+}
+
+func (r StateRange) String() string {
+	if r.First.Equal(r.Last) {
+		return fmt.Sprintf("%s %s", r.State, r.First)
+	}
+	return fmt.Sprintf("%s %s-%s", r.State, r.First, r.Last)
+}
+
+// RangeReport compares the allocator's view of the leasable range with the
+// state held in etcd
+type RangeReport struct {
+	Ranges []StateRange
+	// ips etcd knows about that the allocator does not
+	Stray map[IPState][]net.IP
+}
+
+func (r RangeReport) String() string {
+	var b strings.Builder
+	for _, rng := range r.Ranges {
+		fmt.Fprintln(&b, rng)
+	}
+	for state, ips := range r.Stray {
+		fmt.Fprintf(&b, "stray %s %v\n", state, ips)
+	}
+	return b.String()
+}
+
+// DiagnoseRange renders the allocator's range alongside the etcd free and
+// leased state, so divergence between the two can be spotted
+func (p *PluginState) DiagnoseRange(ctx context.Context) (RangeReport, error) {
+	kvc := p.kv()
+
+	etcdState := make(map[string]IPState)
+	for _, state := range ipStates {
+		resp, err := kvc.Get(ctx, p.keys.IP(state, ""), etcd.WithPrefix(), etcd.WithKeysOnly())
+		if err != nil {
+			return RangeReport{}, errors.Wrapf(err, "could not list %s ips", state)
+		}
+
+		for _, kv := range resp.Kvs {
+			_, ip, err := p.keys.ParseIP(string(kv.Key))
+			if err != nil {
+				log.Warningf("ignoring key: %v", err)
+				continue
+			}
+
+			etcdState[ip.String()] = state
+		}
+	}
+
+	report := RangeReport{
+		Stray: make(map[IPState][]net.IP),
+	}
+	for _, ipnet := range p.allocator.Range() {
+		ip := ipnet.IP
+
+		state, ok := etcdState[ip.String()]
+		if !ok {
+			state = IPStateMissing
+		}
+		delete(etcdState, ip.String())
+
+		n := len(report.Ranges)
+		if n > 0 && report.Ranges[n-1].State == state &&
+			IPAdd(report.Ranges[n-1].Last, 1).Equal(ip) {
+			report.Ranges[n-1].Last = ip
+			continue
+		}
+		report.Ranges = append(report.Ranges, StateRange{
+			State: state,
+			First: ip,
+			Last:  ip,
+		})
+	}
+
+	for ip, state := range etcdState {
+		report.Stray[state] = append(report.Stray[state], net.ParseIP(ip))
+	}
+
+	return report, nil
+}
+
+// fragmentation reports the size of the largest run of consecutive ips in a
+// set and how fragmented the set is, from zero when it's a single run to
+// almost one when no two ips are consecutive
+func fragmentation(ips []net.IP) (int, float64) {
+	if len(ips) == 0 {
+		return 0, 0
+	}
+
+	sorted := make([]uint32, 0, len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			sorted = append(sorted, binary.BigEndian.Uint32(ip4))
+		}
+	}
+	if len(sorted) == 0 {
+		return 0, 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	largest, run := 1, 1
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] == sorted[i-1]+1 {
+			run++
+		} else {
+			run = 1
+		}
+		if run > largest {
+			largest = run
+		}
+	}
+
+	return largest, 1 - float64(largest)/float64(len(sorted))
+}
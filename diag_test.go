@@ -0,0 +1,48 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDiagnoseRangeReportsDivergence(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	nic := testMAC(1)
+	if resp := request(t, p, nic, net.IPv4(10, 0, 0, 3)); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("want %s acked 10.0.0.3, got %v", nic, resp)
+	}
+	// an ip whose key was lost, and a key of an ip out of the range
+	f.delete(p.keys.FreeIP(net.IPv4(10, 0, 0, 9).To4()))
+	f.put(p.keys.FreeIP(net.IPv4(10, 0, 0, 42).To4()), "10.0.0.42")
+
+	report, err := p.DiagnoseRange(context.Background())
+	if err != nil {
+		t.Fatalf("could not diagnose range: %v", err)
+	}
+
+	var got []string
+	for _, rng := range report.Ranges {
+		got = append(got, rng.String())
+	}
+	want := []string{
+		"free 10.0.0.1-10.0.0.2",
+		"leased 10.0.0.3",
+		"free 10.0.0.4-10.0.0.8",
+		"missing 10.0.0.9",
+		"free 10.0.0.10",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want ranges %v, got %v", want, got)
+	}
+
+	if len(report.Stray) != 1 || len(report.Stray[IPStateFree]) != 1 ||
+		!report.Stray[IPStateFree][0].Equal(net.IPv4(10, 0, 0, 42)) {
+		t.Errorf("want the free 10.0.0.42 reported stray, got %v", report.Stray)
+	}
+}
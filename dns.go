@@ -6,98 +6,657 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	etcd "go.etcd.io/etcd/client/v3"
 )
 
+// hostname collision policies, applied when a hostname is already
+// registered by a different nic
+const (
+	// the last nic to register the hostname wins
+	CollisionPolicyOverwrite = "overwrite"
+	// the hostname is disambiguated with a numeric suffix, name-2
+	CollisionPolicyAppend = "append"
+	// the hostname is not registered
+	CollisionPolicyRefuse = "refuse"
+)
+
+// CNAME conflict policies, applied when an alias already has A records,
+// which must not coexist with a CNAME
+const (
+	// the A records stay, the CNAME is not registered
+	CNAMEConflictPreferA = "prefer-a"
+	// the A records are replaced by the CNAME
+	CNAMEConflictPreferCNAME = "prefer-cname"
+	// registering fails
+	CNAMEConflictError = "error"
+)
+
+// how many suffixes are tried when disambiguating a hostname
+const constMaxHostnameSuffix = 16
+
+// name of the zone's apex records
+const constZoneApex = "@"
+
 type DNS struct {
-	prefix    string
-	zone      string
-	separator string
+	keys zoneKeyspace
+	zone string
+	// file static and aliases are loaded from
+	namesFile string
+	// swapped as a whole when the names file is reloaded
+	namesMu sync.RWMutex
 	// map static MAC to DNS name
 	static map[string]string
 	// map DNS alias
 	aliases map[string]string
+	// the static names of reserved nics only point at their reserved ips,
+	// nil when there are no reservations
+	reservations *reservations
+	// maximum number of A and AAAA records in the zone, zero means
+	// unlimited
+	maxRecords int
+	// what to do when two nics claim the same hostname
+	collisionPolicy string
+	// what to do when an alias already has A or AAAA records
+	cnameConflictPolicy string
+	// only hostnames matching it are registered, nil registers all
+	hostnameFilter *regexp.Regexp
+	// hostnames every nic registering them adds an A or AAAA record to
+	roundRobin map[string]struct{}
+	// shortest etcd lease records are granted
+	minTTL time.Duration
+	// apex records of the zone, registered at startup
+	soa         string
+	nameservers []string
+
+	// number of A and AAAA records in the zone as last seen by the monitor, plus
+	// the ones registered since
+	mu      sync.Mutex
+	records int
+
+	// maximum number of etcd leases held for records, zero means unlimited
+	maxLeases int
+	// the etcd lease last granted for each nic's records
+	leasesMu sync.Mutex
+	leases   map[string]dnsLease
+	// leases replaced by one of another TTL, records may still be
+	// attached to them so they are left to expire, counted until then
+	superseded map[etcd.LeaseID]time.Time
+}
+
+// dnsLease is an etcd lease granted for a nic's records
+type dnsLease struct {
+	id etcd.LeaseID
+	// the TTL it was granted, in seconds
+	ttl     int64
+	expires time.Time
 }
 
-func NewDNS(prefix, zone, separator, namesFile string) (*DNS, error) {
-	static, aliases, err := LoadNames(namesFile)
+func NewDNS(c Config) (*DNS, error) {
+	collisionPolicy := c.HostnameCollisionPolicy
+	switch collisionPolicy {
+	case "":
+		collisionPolicy = CollisionPolicyOverwrite
+	case CollisionPolicyOverwrite, CollisionPolicyAppend, CollisionPolicyRefuse:
+	default:
+		return nil, fmt.Errorf("invalid hostname collision policy: %s", collisionPolicy)
+	}
+
+	cnameConflictPolicy := c.DNSCNAMEConflictPolicy
+	switch cnameConflictPolicy {
+	case "":
+		cnameConflictPolicy = CNAMEConflictPreferA
+	case CNAMEConflictPreferA, CNAMEConflictPreferCNAME, CNAMEConflictError:
+	default:
+		return nil, fmt.Errorf("invalid CNAME conflict policy: %s", cnameConflictPolicy)
+	}
+
+	var hostnameFilter *regexp.Regexp
+	if c.DNSHostnameFilter != "" {
+		var err error
+		hostnameFilter, err = regexp.Compile(c.DNSHostnameFilter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS hostname filter: %w", err)
+		}
+	}
+
+	static, aliases, err := LoadNames(c.DNSNames)
 	if err != nil {
 		return nil, err
 	}
 
+	if c.DNSSOA != "" {
+		if err := validateSOA(c.DNSSOA); err != nil {
+			return nil, err
+		}
+	}
+	for _, ns := range c.DNSNameservers {
+		if err := validateHostname("DNSNameservers", strings.TrimSuffix(ns, ".")); err != nil {
+			return nil, err
+		}
+	}
+
+	roundRobin := make(map[string]struct{}, len(c.DNSRoundRobinNames))
+	for _, name := range c.DNSRoundRobinNames {
+		roundRobin[name] = struct{}{}
+	}
+
 	dns := &DNS{
-		prefix:    prefix,
-		zone:      zone,
-		separator: separator,
-		static:    static,
-		aliases:   aliases,
+		keys:                zoneKeyspace{prefix: c.DNSPrefix, zone: c.DNSZone, sep: c.Separator},
+		zone:                c.DNSZone,
+		namesFile:           c.DNSNames,
+		static:              static,
+		aliases:             aliases,
+		maxRecords:          c.MaxDNSRecords,
+		collisionPolicy:     collisionPolicy,
+		cnameConflictPolicy: cnameConflictPolicy,
+		hostnameFilter:      hostnameFilter,
+		roundRobin:          roundRobin,
+		minTTL:              c.MinEtcdLeaseTTL,
+		soa:                 c.DNSSOA,
+		nameservers:         c.DNSNameservers,
+		maxLeases:           c.MaxDNSLeases,
+		leases:              make(map[string]dnsLease),
+		superseded:          make(map[etcd.LeaseID]time.Time),
 	}
 
 	return dns, nil
 }
 
-func (d DNS) Register(ctx context.Context, client *etcd.Client,
+func (d *DNS) Register(ctx context.Context, client *etcd.Client,
 	hostname string, ip net.IP,
 	mac net.HardwareAddr,
 	ttl time.Duration) error {
-	kvc := etcd.NewKV(client)
+	kvc := client.KV
 
-	lease, err := etcd.NewLease(client).
-		Grant(ctx, int64(ttl.Seconds()))
-	if err != nil {
-		return errors.Wrap(err, "could not create new lease")
-	}
+	d.namesMu.RLock()
+	staticName, static := d.static[mac.String()]
+	alias, aliased := d.aliases[hostname]
+	d.namesMu.RUnlock()
 
 	// is this a static entry?
-	if name, ok := d.static[mac.String()]; ok {
-		nameKey := d.prefix + d.separator +
-			d.zone + d.separator +
-			name + d.separator +
-			"A"
+	if static {
+		// the reservation takes precedence, a reserved nic leasing
+		// another ip, its own being taken, does not move its name there
+		if reserved := d.reservations.ipOf(mac); reserved != nil && !reserved.Equal(ip) {
+			log.Warningf("not registering static name %s of %s for %s, it follows its reservation of %s",
+				staticName, mac, ip, reserved)
+			return nil
+		}
+
+		nameKey := d.keys.AddressRecord(staticName, ip)
+
+		admit, err := d.admit(ctx, kvc, nameKey)
+		if err != nil {
+			return err
+		}
+		if !admit {
+			return nil
+		}
 
 		if _, err := kvc.Put(ctx, nameKey, ip.String()); err != nil {
 			return errors.Wrap(err, "could not register name")
 		}
-	} else if alias, ok := d.aliases[hostname]; ok {
-		nameKey := d.prefix + d.separator +
-			d.zone + d.separator +
-			hostname + d.separator +
-			"A"
+		return nil
+	}
+
+	if d.hostnameFilter != nil && !d.hostnameFilter.MatchString(hostname) {
+		log.Debugf("hostname %s of %s does not match the DNS hostname filter, not registering it",
+			hostname, mac)
+		return nil
+	}
+
+	lease, err := d.lease(ctx, client, mac, ttl)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return nil
+	}
+
+	// round-robin names are shared, each ip is a member with its own A or
+	// AAAA record, which goes away with the ip's lease
+	if _, ok := d.roundRobin[hostname]; ok {
+		memberKey := d.keys.AddressRecordMember(hostname, ip)
+
+		admit, err := d.admit(ctx, kvc, memberKey)
+		if err != nil {
+			return err
+		}
+		if !admit {
+			return nil
+		}
+
+		if _, err := kvc.Put(ctx, memberKey, ip.String(),
+			etcd.WithLease(lease.id)); err != nil {
+			return errors.Wrapf(err, "could not register round-robin %s name", addressType(ip))
+		}
+		return nil
+	}
+
+	name, err := d.claim(ctx, kvc, hostname, mac, lease.id)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+
+	if aliased {
+		nameKey := d.keys.AddressRecord(name, ip)
 		// create a record that allows resolving CNAME - hostname - ip
-		cnameKey := d.prefix + d.separator +
-			d.zone + d.separator +
-			alias + d.separator +
-			"CNAME"
+		cnameKey := d.keys.CNAMERecord(alias)
+
+		admit, err := d.admit(ctx, kvc, nameKey)
+		if err != nil {
+			return err
+		}
+		if !admit {
+			return nil
+		}
 
 		if _, err := kvc.Put(ctx, nameKey, ip.String(),
-			etcd.WithLease(lease.ID)); err != nil {
-			return errors.Wrap(err, "could not register A name")
+			etcd.WithLease(lease.id)); err != nil {
+			return errors.Wrapf(err, "could not register %s name", addressType(ip))
 		}
 
-		if _, err := kvc.Put(ctx, cnameKey, hostname,
-			etcd.WithLease(lease.ID)); err != nil {
-			return errors.Wrap(err, "could not register CNAME name")
+		if err := d.putCNAME(ctx, kvc, alias, cnameKey, name, lease.id); err != nil {
+			return err
 		}
 	} else {
 		// not static, no alias, simply register
-		nameKey := d.prefix + d.separator +
-			d.zone + d.separator +
-			hostname + d.separator +
-			"A"
+		nameKey := d.keys.AddressRecord(name, ip)
+
+		admit, err := d.admit(ctx, kvc, nameKey)
+		if err != nil {
+			return err
+		}
+		if !admit {
+			return nil
+		}
 
 		if _, err := kvc.Put(ctx, nameKey, ip.String(),
-			etcd.WithLease(lease.ID)); err != nil {
-			return errors.Wrap(err, "could not register A name")
+			etcd.WithLease(lease.id)); err != nil {
+			return errors.Wrapf(err, "could not register %s name", addressType(ip))
+		}
+	}
+
+	return nil
+}
+
+// lease returns the etcd lease to register mac's records with, the nic's
+// current one kept alive while its TTL matches. Once the number of leases
+// reaches its limit, registrations are coalesced onto the nic's current
+// lease, or skipped if it has none
+func (d *DNS) lease(ctx context.Context, client *etcd.Client, mac net.HardwareAddr,
+	ttl time.Duration) (*dnsLease, error) {
+	d.leasesMu.Lock()
+	defer d.leasesMu.Unlock()
+
+	now := time.Now()
+	for nic, lease := range d.leases {
+		if !now.Before(lease.expires) {
+			delete(d.leases, nic)
+		}
+	}
+	for id, expires := range d.superseded {
+		if !now.Before(expires) {
+			delete(d.superseded, id)
+		}
+	}
+	defer func() {
+		metricDNSLeases.Set(int64(len(d.leases) + len(d.superseded)))
+	}()
+
+	seconds := LeaseTTL(ttl, d.minTTL)
+	current, ok := d.leases[mac.String()]
+	if ok && current.ttl == seconds {
+		resp, err := client.Lease.KeepAliveOnce(ctx, current.id)
+		switch {
+		case err == nil:
+			current.expires = now.Add(time.Duration(resp.TTL) * time.Second)
+			d.leases[mac.String()] = current
+			return &current, nil
+		case !errors.Is(err, rpctypes.ErrLeaseNotFound):
+			return nil, errors.Wrap(err, "could not keep lease alive")
+		}
+		// gone from etcd already, along with its records
+		delete(d.leases, mac.String())
+		ok = false
+	}
+
+	if d.maxLeases > 0 && len(d.leases)+len(d.superseded) >= d.maxLeases {
+		if ok {
+			log.Debugf("DNS leases at their limit of %d, reusing the lease of %s",
+				d.maxLeases, mac)
+			return &current, nil
+		}
+		log.Warningf("DNS leases at their limit of %d, not registering names of %s",
+			d.maxLeases, mac)
+		return nil, nil
+	}
+
+	granted, err := client.Lease.Grant(ctx, seconds)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new lease")
+	}
+
+	if ok {
+		d.superseded[current.id] = current.expires
+	}
+	lease := dnsLease{
+		id:      granted.ID,
+		ttl:     seconds,
+		expires: now.Add(time.Duration(granted.TTL) * time.Second),
+	}
+	d.leases[mac.String()] = lease
+
+	return &lease, nil
+}
+
+// claim binds a hostname to the nic registering it, returning the name to
+// register under or an empty name if the registration must be skipped
+func (d *DNS) claim(ctx context.Context, kvc etcd.KV, hostname string,
+	mac net.HardwareAddr, leaseID etcd.LeaseID) (string, error) {
+	for i := 1; i <= constMaxHostnameSuffix; i++ {
+		name := hostname
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", hostname, i)
+		}
+
+		ownerKey := d.keys.Owner(name)
+
+		res, err := kvc.Txn(ctx).If(
+			etcd.Compare(etcd.CreateRevision(ownerKey), "=", 0),
+		).Then(
+			etcd.OpPut(ownerKey, mac.String(), etcd.WithLease(leaseID)),
+		).Else(
+			etcd.OpGet(ownerKey),
+		).Commit()
+		if err != nil {
+			return "", errors.Wrap(err, "could not claim hostname")
+		}
+		if res.Succeeded {
+			return name, nil
+		}
+
+		kvs := res.Responses[0].GetResponseRange().Kvs
+		if len(kvs) > 0 && string(kvs[0].Value) != mac.String() {
+			switch d.collisionPolicy {
+			case CollisionPolicyRefuse:
+				log.Warningf("hostname %s already registered by %s, not registering it for %s",
+					name, kvs[0].Value, mac)
+				return "", nil
+			case CollisionPolicyAppend:
+				continue
+			}
+			log.Warningf("hostname %s taken over from %s by %s", name, kvs[0].Value, mac)
+		}
+
+		// refresh the binding's lease
+		if _, err := kvc.Put(ctx, ownerKey, mac.String(), etcd.WithLease(leaseID)); err != nil {
+			return "", errors.Wrap(err, "could not claim hostname")
+		}
+
+		return name, nil
+	}
+
+	log.Warningf("no free variant of hostname %s left for %s", hostname, mac)
+
+	return "", nil
+}
+
+// putCNAME registers alias as a CNAME of name, unless alias has A or AAAA
+// records, its own or round-robin members, in which case the CNAME
+// conflict policy decides
+func (d *DNS) putCNAME(ctx context.Context, kvc etcd.KV,
+	alias, cnameKey, name string, lease etcd.LeaseID) error {
+	aPrefix := d.keys.ARecord(alias)
+	aaaaPrefix := d.keys.AAAARecord(alias)
+
+	put := etcd.OpPut(cnameKey, name, etcd.WithLease(lease))
+	var replace []etcd.Op
+	if d.cnameConflictPolicy == CNAMEConflictPreferCNAME {
+		replace = []etcd.Op{
+			etcd.OpDelete(aPrefix, etcd.WithPrefix()),
+			etcd.OpDelete(aaaaPrefix, etcd.WithPrefix()),
+			put,
+		}
+	}
+
+	resp, err := kvc.Txn(ctx).
+		If(
+			etcd.Compare(etcd.CreateRevision(aPrefix), "=", 0).WithPrefix(),
+			etcd.Compare(etcd.CreateRevision(aaaaPrefix), "=", 0).WithPrefix(),
+		).
+		Then(put).
+		Else(replace...).
+		Commit()
+	if err != nil {
+		return errors.Wrap(err, "could not register CNAME name")
+	}
+	if resp.Succeeded {
+		return nil
+	}
+
+	switch d.cnameConflictPolicy {
+	case CNAMEConflictPreferCNAME:
+		log.Warningf("replaced the address records of %s with a CNAME of %s", alias, name)
+		return nil
+	case CNAMEConflictError:
+		return fmt.Errorf("%s has address records, can not register it as a CNAME of %s", alias, name)
+	default:
+		log.Warningf("%s has address records, not registering it as a CNAME of %s", alias, name)
+		return nil
+	}
+}
+
+// Unregister removes the A or AAAA records resolving to ip, along with the CNAME
+// records pointing to them
+func (d *DNS) Unregister(ctx context.Context, client *etcd.Client, ip net.IP) error {
+	kvc := client.KV
+
+	zonePrefix := d.keys.Zone()
+
+	resp, err := kvc.Get(ctx, zonePrefix, etcd.WithPrefix())
+	if err != nil {
+		return errors.Wrap(err, "could not list zone records")
+	}
+
+	names := make(map[string]struct{})
+	for _, kv := range resp.Kvs {
+		name, rtype, member, err := d.keys.ParseRecord(string(kv.Key))
+		if err != nil || rtype != addressType(ip) || string(kv.Value) != ip.String() {
+			continue
+		}
+
+		// round-robin names live on through their other members
+		if member == "" {
+			names[name] = struct{}{}
+		}
+
+		if _, err := kvc.Delete(ctx, string(kv.Key)); err != nil {
+			return errors.Wrapf(err, "could not unregister %s name", rtype)
+		}
+		log.Infof("unregistered %s from %s", name, ip)
+	}
+
+	for _, kv := range resp.Kvs {
+		_, rtype, _, err := d.keys.ParseRecord(string(kv.Key))
+		if err != nil || rtype != "CNAME" {
+			continue
+		}
+		if _, ok := names[string(kv.Value)]; !ok {
+			continue
+		}
+
+		if _, err := kvc.Delete(ctx, string(kv.Key)); err != nil {
+			return errors.Wrap(err, "could not unregister CNAME name")
+		}
+	}
+
+	return nil
+}
+
+// validateSOA checks an SOA record given as its mname, rname, serial,
+// refresh, retry, expire and minimum fields
+func validateSOA(soa string) error {
+	fields := strings.Fields(soa)
+	if len(fields) != 7 {
+		return fmt.Errorf("invalid DNSSOA, want <mname> <rname> <serial> <refresh> <retry> <expire> <minimum>: %s", soa)
+	}
+	for _, field := range fields[2:] {
+		if _, err := strconv.ParseUint(field, 10, 32); err != nil {
+			return fmt.Errorf("invalid DNSSOA field %s: %s", field, soa)
+		}
+	}
+	return nil
+}
+
+// RegisterApex registers the SOA and NS records of the zone, so that it can
+// be served on its own. They hold no etcd lease, nameservers no longer
+// configured are removed
+func (d *DNS) RegisterApex(ctx context.Context, client *etcd.Client) error {
+	ops := []etcd.Op{
+		etcd.OpDelete(d.keys.ApexNS(""), etcd.WithPrefix()),
+	}
+	if d.soa != "" {
+		ops = append(ops, etcd.OpPut(d.keys.ApexSOA(), d.soa))
+	}
+	for _, ns := range d.nameservers {
+		ops = append(ops, etcd.OpPut(d.keys.ApexNS(ns), ns))
+	}
+
+	if _, err := client.KV.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return errors.Wrap(err, "could not register zone apex")
+	}
+	log.Infof("registered apex of zone %s, SOA %q and nameservers %v", d.zone, d.soa, d.nameservers)
+
+	return nil
+}
+
+// admit checks whether a new record can be added to the zone without
+// exceeding its configured limit, existing records can always be refreshed
+func (d *DNS) admit(ctx context.Context, kvc etcd.KV, nameKey string) (bool, error) {
+	if d.maxRecords <= 0 {
+		return true, nil
+	}
+
+	resp, err := kvc.Get(ctx, nameKey, etcd.WithCountOnly())
+	if err != nil {
+		return false, errors.Wrap(err, "could not get name")
+	}
+	if resp.Count > 0 {
+		return true, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.records >= d.maxRecords {
+		log.Warningf("zone %s has reached its limit of %d records, not registering %s",
+			d.zone, d.maxRecords, nameKey)
+		return false, nil
+	}
+	d.records++
+
+	return true, nil
+}
+
+// CountRecords scans the zone and refreshes the number of A and AAAA
+// records in it, records whose etcd lease expired are no longer accounted
+// for
+func (d *DNS) CountRecords(ctx context.Context, client *etcd.Client) (int, error) {
+	kvc := client.KV
+
+	zonePrefix := d.keys.Zone()
+
+	resp, err := kvc.Get(ctx, zonePrefix, etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return 0, errors.Wrap(err, "could not list zone records")
+	}
+
+	count := 0
+	for _, kv := range resp.Kvs {
+		if d.isAddressRecord(string(kv.Key)) {
+			count++
 		}
 	}
 
+	d.mu.Lock()
+	d.records = count
+	d.mu.Unlock()
+
+	return count, nil
+}
+
+// isAddressRecord reports whether a zone key holds an A or AAAA record,
+// either a name's or a member of a round-robin name
+func (d *DNS) isAddressRecord(key string) bool {
+	_, rtype, _, err := d.keys.ParseRecord(key)
+	return err == nil && (rtype == "A" || rtype == "AAAA")
+}
+
+// ReloadNames loads the names file again and swaps in its static entries
+// and aliases, the current ones are kept if it can not be loaded
+func (d *DNS) ReloadNames() error {
+	static, aliases, err := LoadNames(d.namesFile)
+	if err != nil {
+		return errors.Wrapf(err, "could not reload names from %s", d.namesFile)
+	}
+
+	d.namesMu.Lock()
+	d.static, d.aliases = static, aliases
+	d.namesMu.Unlock()
+
+	log.Infof("reloaded %d static names and %d aliases from %s",
+		len(static), len(aliases), d.namesFile)
+	d.checkStaticNames()
+
 	return nil
 }
 
+// checkStaticNames warns about the static names that disagree with the
+// reservations
+func (d *DNS) checkStaticNames() {
+	d.namesMu.RLock()
+	static := d.static
+	d.namesMu.RUnlock()
+
+	for _, conflict := range staticNameConflicts(static, d.reservations) {
+		log.Warningf("%s", conflict)
+	}
+}
+
+// watchNames reloads the names file whenever the process receives SIGHUP,
+// until ctx is done
+func (d *DNS) watchNames(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-hup:
+			if err := d.ReloadNames(); err != nil {
+				log.Errorf("%v", err)
+			}
+		}
+	}
+}
+
 func LoadNames(filename string) (map[string]string, map[string]string, error) {
 	log.Infof("reading names from %s", filename)
 	data, err := ioutil.ReadFile(filename)
@@ -0,0 +1,237 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestDNSRegisterReusesLease(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	ctx := context.Background()
+
+	nic := testMAC(1)
+	ip := net.IPv4(10, 0, 0, 1).To4()
+	for i := 0; i < 3; i++ {
+		if err := p.dns.Register(ctx, p.etcdClient(), "host", ip, nic, time.Minute); err != nil {
+			t.Fatalf("register %d: %v", i, err)
+		}
+	}
+	if n := f.leaseCount(); n != 1 {
+		t.Errorf("want registrations of a nic on a single lease, got %d leases", n)
+	}
+
+	// a registration with another TTL gets a lease of its own
+	if err := p.dns.Register(ctx, p.etcdClient(), "host", ip, nic, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.leaseCount(); n != 2 {
+		t.Errorf("want a lease for the new TTL, got %d leases", n)
+	}
+}
+
+func TestDNSRegisterLeaseCap(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "MaxDNSLeases = 2")
+	ctx := context.Background()
+
+	register := func(n byte, name string, ttl time.Duration) {
+		t.Helper()
+		ip := net.IPv4(10, 0, 0, n).To4()
+		if err := p.dns.Register(ctx, p.etcdClient(), name, ip, testMAC(n), ttl); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+	}
+	registered := func(n byte, name string) bool {
+		_, ok := f.get(p.dns.keys.AddressRecord(name, net.IPv4(10, 0, 0, n).To4()))
+		return ok
+	}
+
+	register(1, "one", time.Minute)
+	// a flapping nic keeps its lease
+	for i := 0; i < 5; i++ {
+		register(2, "two", time.Minute)
+	}
+	register(3, "three", time.Minute)
+
+	if !registered(1, "one") || !registered(2, "two") {
+		t.Error("want the nics within the cap registered")
+	}
+	if registered(3, "three") {
+		t.Error("want the nic past the cap not registered")
+	}
+	if n := f.leaseCount(); n != 2 {
+		t.Errorf("want 2 DNS leases, got %d", n)
+	}
+
+	// at the cap a nic registering with another TTL stays on its lease
+	register(2, "two", time.Hour)
+	if n := f.leaseCount(); n != 2 {
+		t.Errorf("want the lease of a nic at the cap reused, got %d leases", n)
+	}
+}
+
+func TestDNSRegisterCountsSupersededLeases(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "MaxDNSLeases = 2")
+	ctx := context.Background()
+
+	ip := net.IPv4(10, 0, 0, 1).To4()
+	for _, ttl := range []time.Duration{time.Minute, time.Hour} {
+		if err := p.dns.Register(ctx, p.etcdClient(), "one", ip, testMAC(1), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	other := net.IPv4(10, 0, 0, 2).To4()
+	if err := p.dns.Register(ctx, p.etcdClient(), "two", other, testMAC(2), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.get(p.dns.keys.AddressRecord("two", other)); ok {
+		t.Error("want the superseded lease counted against the cap")
+	}
+}
+
+func TestDNSRegisterRecordCap(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "MaxDNSRecords = 2",
+		"DNSNames = "+writeNames(t, "static printer "+testMAC(5).String()))
+	ctx := context.Background()
+
+	register := func(n byte, name string, ttl time.Duration) {
+		t.Helper()
+		ip := net.IPv4(10, 0, 0, n).To4()
+		if err := p.dns.Register(ctx, p.etcdClient(), name, ip, testMAC(n), ttl); err != nil {
+			t.Fatalf("could not register %s: %v", name, err)
+		}
+	}
+	registered := func(n byte, name string) bool {
+		_, ok := f.get(p.dns.keys.AddressRecord(name, net.IPv4(10, 0, 0, n).To4()))
+		return ok
+	}
+
+	register(1, "one", time.Minute)
+	register(2, "two", time.Minute)
+	register(3, "three", time.Hour)
+	// the static name of the nic is capped along with the others
+	register(5, "ignored", time.Hour)
+	if !registered(1, "one") || !registered(2, "two") {
+		t.Error("want the records within the cap registered")
+	}
+	if registered(3, "three") {
+		t.Error("want the record past the cap skipped")
+	}
+	if registered(5, "printer") {
+		t.Error("want the static record past the cap skipped")
+	}
+
+	// records in the zone can still be refreshed at the cap
+	register(2, "two", time.Minute)
+	if !registered(2, "two") {
+		t.Error("want the record at the cap refreshed")
+	}
+
+	// once records expire and the monitor counts the zone again there's
+	// room for others
+	f.advance(2 * time.Minute)
+	if registered(1, "one") || registered(2, "two") {
+		t.Fatal("want the records of one and two expired")
+	}
+	register(3, "three", time.Hour)
+	if registered(3, "three") {
+		t.Error("want the record skipped until the zone is counted again")
+	}
+	if count, err := p.dns.CountRecords(ctx, p.etcdClient()); err != nil || count != 0 {
+		t.Fatalf("want no records counted, got %d: %v", count, err)
+	}
+	register(3, "three", time.Hour)
+	register(5, "ignored", time.Hour)
+	if !registered(3, "three") || !registered(5, "printer") {
+		t.Error("want registration to resume once records expired, static ones included")
+	}
+
+	register(4, "four", time.Hour)
+	if registered(4, "four") {
+		t.Error("want the record past the cap skipped again")
+	}
+}
+
+func TestDNSHostnameCollisionPolicies(t *testing.T) {
+	first, second := testMAC(1), testMAC(2)
+	firstIP, secondIP := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+
+	for _, tt := range []struct {
+		policy string
+		// the name second is registered under, empty when it's not
+		want string
+	}{
+		{CollisionPolicyAppend, "host-2"},
+		{CollisionPolicyRefuse, ""},
+	} {
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f, "HostnameCollisionPolicy = "+tt.policy)
+		ctx := context.Background()
+
+		for _, nic := range []struct {
+			mac net.HardwareAddr
+			ip  net.IP
+		}{{first, firstIP}, {second, secondIP}, {first, firstIP}} {
+			if err := p.dns.Register(ctx, p.etcdClient(), "host", nic.ip, nic.mac, time.Minute); err != nil {
+				t.Fatalf("%s: could not register host for %s: %v", tt.policy, nic.mac, err)
+			}
+		}
+
+		// the first nic keeps its name, renewals included
+		if value, _ := f.get(p.dns.keys.AddressRecord("host", firstIP)); value != firstIP.String() {
+			t.Errorf("%s: want host kept resolving to %s, got %q", tt.policy, firstIP, value)
+		}
+
+		value, ok := f.get(p.dns.keys.AddressRecord("host-2", secondIP))
+		if tt.want == "" && ok {
+			t.Errorf("%s: want nothing registered for %s, got host-2 resolving to %s", tt.policy, second, value)
+		}
+		if tt.want != "" && value != secondIP.String() {
+			t.Errorf("%s: want %s resolving to %s, got %q", tt.policy, tt.want, secondIP, value)
+		}
+	}
+}
+
+func TestDNSHostnameFilter(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "DNSHostnameFilter = ^host-[0-9]+$")
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		hostname string
+		ip       net.IP
+		want     bool
+	}{
+		{"host-1", net.IPv4(10, 0, 0, 1).To4(), true},
+		{"android-5f2e", net.IPv4(10, 0, 0, 2).To4(), false},
+	} {
+		if err := p.dns.Register(ctx, p.etcdClient(), tt.hostname, tt.ip, testMAC(tt.ip[3]), time.Minute); err != nil {
+			t.Fatalf("could not register %s: %v", tt.hostname, err)
+		}
+		if _, ok := f.get(p.dns.keys.AddressRecord(tt.hostname, tt.ip)); ok != tt.want {
+			t.Errorf("want %s registered %t, got %t", tt.hostname, tt.want, ok)
+		}
+	}
+
+	// the client of a name filtered out still gets its lease
+	nic := testMAC(9)
+	ip := discover(t, p, nic)
+	if resp := request(t, p, nic, ip, dhcpv4.WithOption(dhcpv4.OptHostName("localhost"))); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want %s acked %s, got %v", nic, ip, resp)
+	}
+	if _, ok := f.get(p.dns.keys.AddressRecord("localhost", ip)); ok {
+		t.Error("want localhost not registered")
+	}
+
+	if _, err := newPluginState(testConfig(t, "DNSHostnameFilter = ^host-("), f.dial); err == nil {
+		t.Error("want an invalid DNSHostnameFilter refused")
+	}
+}
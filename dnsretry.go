@@ -0,0 +1,78 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsRegistration is a DNS registration that failed and is to be retried
+type dnsRegistration struct {
+	hostname string
+	ip       net.IP
+	mac      net.HardwareAddr
+	// when the lease the registration belongs to expires
+	expires time.Time
+}
+
+// dnsRetries holds the failed DNS registrations, the monitor retries them
+// until they succeed or their lease expires
+type dnsRetries struct {
+	mu sync.Mutex
+	// by nic, a newer registration replaces an older one
+	pending map[string]dnsRegistration
+}
+
+func newDNSRetries() *dnsRetries {
+	return &dnsRetries{
+		pending: make(map[string]dnsRegistration),
+	}
+}
+
+// add queues a failed registration
+func (q *dnsRetries) add(hostname string, ip net.IP, mac net.HardwareAddr, ttl time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending[mac.String()] = dnsRegistration{
+		hostname: hostname,
+		ip:       ip,
+		mac:      mac,
+		expires:  time.Now().Add(ttl),
+	}
+}
+
+// take removes and returns the queued registrations
+func (q *dnsRetries) take() []dnsRegistration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	registrations := make([]dnsRegistration, 0, len(q.pending))
+	for nic, r := range q.pending {
+		registrations = append(registrations, r)
+		delete(q.pending, nic)
+	}
+
+	return registrations
+}
+
+// retryDNSRegistrations retries the failed DNS registrations for what's
+// left of their lease, the ones failing again are queued back
+func (p *PluginState) retryDNSRegistrations(ctx context.Context) {
+	for _, r := range p.dnsRetries.take() {
+		ttl := time.Until(r.expires)
+		if ttl <= 0 {
+			log.Debugf("lease of %s expired before %s could be registered", r.mac, r.hostname)
+			continue
+		}
+
+		if err := p.dns.Register(ctx, p.etcdClient(), r.hostname, r.ip, r.mac, ttl); err != nil {
+			log.Warningf("could not register %s for %s, will retry: %v", r.hostname, r.mac, err)
+			p.dnsRetries.add(r.hostname, r.ip, r.mac, ttl)
+			continue
+		}
+
+		log.Infof("registered %s for %s on retry", r.hostname, r.mac)
+	}
+}
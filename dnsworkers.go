@@ -0,0 +1,80 @@
+package etcdplugin
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+const (
+	// registrations waiting for each DNS worker before they are left to
+	// the monitor's retries
+	constDNSWorkerQueueSize = 256
+	// how long a background registration may take
+	constDNSWorkerTimeout = 5 * time.Second
+)
+
+// dnsWorkers registers DNS names in the background, off the path of the
+// DHCP reply. A hostname always goes to the same worker, so that its
+// registrations are applied in the order they were made
+type dnsWorkers struct {
+	queues []chan dnsRegistration
+}
+
+func newDNSWorkers(n int) *dnsWorkers {
+	queues := make([]chan dnsRegistration, n)
+	for i := range queues {
+		queues[i] = make(chan dnsRegistration, constDNSWorkerQueueSize)
+	}
+	return &dnsWorkers{
+		queues: queues,
+	}
+}
+
+// add queues a registration, reporting false if its worker's queue is full
+func (w *dnsWorkers) add(hostname string, ip net.IP, mac net.HardwareAddr, ttl time.Duration) bool {
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	queue := w.queues[h.Sum32()%uint32(len(w.queues))]
+
+	select {
+	case queue <- dnsRegistration{
+		hostname: hostname,
+		ip:       ip,
+		mac:      mac,
+		expires:  time.Now().Add(ttl),
+	}:
+		return true
+	default:
+		return false
+	}
+}
+
+// runDNSWorker registers the names of a worker's queue until ctx is done,
+// the ones failing are left to the monitor's retries
+func (p *PluginState) runDNSWorker(ctx context.Context, queue chan dnsRegistration) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r := <-queue:
+			ttl := time.Until(r.expires)
+			if ttl <= 0 {
+				log.Debugf("lease of %s expired before %s could be registered", r.mac, r.hostname)
+				continue
+			}
+
+			rctx, cancel := context.WithTimeout(ctx, constDNSWorkerTimeout)
+			err := p.dns.Register(rctx, p.etcdClient(), r.hostname, r.ip, r.mac, ttl)
+			cancel()
+			if err != nil {
+				log.Warningf("unable to register %s for MAC %s, will retry: %v", r.hostname, r.mac, err)
+				p.dnsRetries.add(r.hostname, r.ip, r.mac, ttl)
+				continue
+			}
+
+			log.Debugf("registered %s for MAC %s", r.hostname, r.mac)
+		}
+	}
+}
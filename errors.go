@@ -2,8 +2,18 @@ package etcdplugin
 
 import "github.com/pkg/errors"
 
-var ErrAlreadyLeased = errors.New("already leased")
+var (
+	ErrAlreadyLeased = errors.New("already leased")
+	ErrNoLease       = errors.New("no lease")
+	// the ip was offered or leased by another instance in the meantime
+	ErrNotFree = errors.New("not free")
+	// the ip is not parked as a problem
+	ErrNotParked = errors.New("not parked")
+	// a key's value could not be decoded
+	ErrMalformedValue = errors.New("malformed value")
+)
 
+// IsAlreadyLeased reports whether err is, or wraps, ErrAlreadyLeased
 func IsAlreadyLeased(err error) bool {
-	return errors.As(err, &ErrAlreadyLeased)
+	return errors.Is(err, ErrAlreadyLeased)
 }
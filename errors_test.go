@@ -0,0 +1,29 @@
+package etcdplugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsAlreadyLeased(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"sentinel", ErrAlreadyLeased, true},
+		{"wrapped with %w", fmt.Errorf("ip 10.0.0.1 is no longer free: %w", ErrAlreadyLeased), true},
+		{"wrapped twice", errors.WithMessage(fmt.Errorf("lease: %w", ErrAlreadyLeased), "request"), true},
+		{"wrapped with pkg/errors", errors.Wrap(ErrAlreadyLeased, "lease"), true},
+		{"other", ErrNoLease, false},
+		{"nil", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAlreadyLeased(tt.err); got != tt.want {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -11,52 +11,107 @@ import (
 	etcd "go.etcd.io/etcd/client/v3"
 )
 
+// NewClient creates an etcd client living until ctx is done, and syncs its
+// endpoint list. Dialing and syncing are bounded by the RequestTimeout
 func NewClient(ctx context.Context, c Config) (*etcd.Client, error) {
 	conf, err := etcdConfig(c)
 	if err != nil {
 		return nil, errors.WithMessage(err, "could not load etcd config")
 	}
 
+	timeout := c.RequestTimeout
+	if timeout == 0 {
+		timeout = constDefaultRequestTimeout
+	}
+	conf.Context = ctx
+	conf.DialTimeout = timeout
+
 	client, err := etcd.New(conf)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create etcd client")
 	}
 
-	err = client.Sync(ctx)
+	syncCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = client.Sync(syncCtx)
 	if err != nil {
+		client.Close()
 		return nil, errors.Wrap(err, "could not perform initial etcd endpoint sync")
 	}
 
-	go func() {
-		for ctx.Err() == nil {
-			func() {
-				ctx, cancel := context.WithTimeout(ctx, time.Second*30)
-				defer cancel()
-
-				err := client.Sync(ctx)
-				if err != nil {
-					log.Error("failed to sync etcd endpoints: %v", err)
-					// crash so systemd can restart it and hopefully recover
-					panic(err)
-				} else {
-					log.Info("synced etcd endpoint list")
-				}
-			}()
+	return client, nil
+}
+
+// syncEndpoints refreshes the endpoint list of the current etcd client every
+// SyncInterval until ctx is done. A failed sync is retried with an
+// exponential backoff, once SyncRetries are exhausted the client is replaced
+// by a new one
+func (p *PluginState) syncEndpoints(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.config.SyncInterval):
+		}
+
+		client := p.etcdClient()
+		err := p.syncOnce(ctx)
+		backoff := constSyncBackoff
+		for attempt := 0; err != nil && attempt < p.config.SyncRetries; attempt++ {
+			log.Warningf("failed to sync etcd endpoints, retrying in %s: %v", backoff, err)
 
 			select {
-			case <-time.After(time.Second * 60):
 			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > p.config.SyncInterval {
+				backoff = p.config.SyncInterval
 			}
+
+			err = p.syncOnce(ctx)
+		}
+		if err == nil {
+			log.Info("synced etcd endpoint list")
+			continue
 		}
-	}()
 
-	return client, nil
+		log.Errorf("failed to sync etcd endpoints %d times, reconnecting: %v", p.config.SyncRetries+1, err)
+		if err := p.reconnect(client); err != nil {
+			log.Errorf("could not reconnect to etcd: %v", err)
+		}
+	}
+}
+
+// syncOnce refreshes the endpoint list of the current etcd client
+func (p *PluginState) syncOnce(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, constSyncTimeout)
+	defer cancel()
+
+	return p.etcdClient().Sync(ctx)
 }
 
+// etcdConfig builds the etcd client config, etcd is reached in plaintext
+// unless a CA or a client key pair is configured
 func etcdConfig(c Config) (etcd.Config, error) {
-	caCertPool := x509.NewCertPool()
+	conf := etcd.Config{
+		Endpoints: c.Endpoints,
+		// optional, the client only authenticates when a username is set
+		Username: c.Username,
+		Password: c.Password,
+	}
 
+	if (c.Cert == "") != (c.Key == "") {
+		return etcd.Config{}, errors.New("etcd client Cert and Key must be set together")
+	}
+	if c.CA == "" && c.Cert == "" {
+		return conf, nil
+	}
+
+	var caCertPool *x509.CertPool
 	if c.CA != "" {
+		caCertPool = x509.NewCertPool()
 		caCert, err := ioutil.ReadFile(c.CA)
 		if err != nil {
 			return etcd.Config{}, errors.Wrap(err, "could not load etcd CA")
@@ -73,11 +128,11 @@ func etcdConfig(c Config) (etcd.Config, error) {
 		certificates = []tls.Certificate{cert}
 	}
 
-	return etcd.Config{
-		Endpoints: c.Endpoints,
-		TLS: &tls.Config{
-			Certificates: certificates,
-			RootCAs:      caCertPool,
-		},
-	}, nil
+	conf.TLS = &tls.Config{
+		Certificates: certificates,
+		// the system's when no CA is configured
+		RootCAs: caCertPool,
+	}
+
+	return conf, nil
 }
@@ -0,0 +1,144 @@
+package etcdplugin
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+func TestEtcdConfigCarriesCredentials(t *testing.T) {
+	for _, tt := range []struct {
+		username, password string
+	}{
+		{"dhcp", "etcd-secret"},
+		// cert only deployments don't authenticate
+		{"", ""},
+	} {
+		conf, err := etcdConfig(Config{
+			Endpoints: []string{"127.0.0.1:2379"},
+			Username:  tt.username,
+			Password:  tt.password,
+		})
+		if err != nil {
+			t.Fatalf("could not build etcd config: %v", err)
+		}
+		if conf.Username != tt.username || conf.Password != tt.password {
+			t.Errorf("want credentials %q/%q, got %q/%q", tt.username, tt.password, conf.Username, conf.Password)
+		}
+	}
+}
+
+func TestNewClientTimesOut(t *testing.T) {
+	// nothing listens on the discard port, dialing is retried until the
+	// timeout
+	c := Config{
+		Endpoints:      []string{"127.0.0.1:9"},
+		RequestTimeout: 200 * time.Millisecond,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		client, err := NewClient(context.Background(), c)
+		if err == nil {
+			client.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("want an error creating a client of an unreachable endpoint")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("creating a client of an unreachable endpoint did not time out")
+	}
+}
+
+func TestReconnectOnExpiredAuth(t *testing.T) {
+	f := newFakeEtcd()
+	var dials int32
+	p, err := newPluginState(testConfig(t, "ReauthOnExpiry = true"), func(ctx context.Context, c Config) (*etcd.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		return f.dial(ctx, c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	old := p.etcdClient()
+	f.failNext(rpctypes.ErrGRPCInvalidAuthToken)
+
+	req, err := dhcpv4.NewDiscovery(testMAC(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := exchange(t, p, req); resp == nil || resp.YourIPAddr.IsUnspecified() {
+		t.Fatalf("want an offer once re-authenticated, got %v", resp)
+	}
+
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("want a second client dialed, got %d dials", n)
+	}
+	if old.Ctx().Err() == nil {
+		t.Error("want the replaced client closed")
+	}
+}
+
+func TestReconnectOnceForConcurrentExpiredAuth(t *testing.T) {
+	f := newFakeEtcd()
+	var dials int32
+	p, err := newPluginState(testConfig(t, "ReauthOnExpiry = true"), func(ctx context.Context, c Config) (*etcd.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		return f.dial(ctx, c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// every operation fails on the first client, once all of them ran on it
+	const ops = 16
+	old := p.etcdClient()
+	var failed sync.WaitGroup
+	failed.Add(ops)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, ops)
+	for i := 0; i < ops; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			first := true
+			errs <- p.retry(context.Background(), func() error {
+				if p.etcdClient() != old {
+					return nil
+				}
+				if first {
+					first = false
+					failed.Done()
+					failed.Wait()
+				}
+				return rpctypes.ErrInvalidAuthToken
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("want every operation to succeed once re-authenticated, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("want a single client dialed to replace the expired one, got %d dials", n)
+	}
+}
@@ -0,0 +1,197 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// lease events published to the events broker
+const (
+	LeaseEventGrant   = "grant"
+	LeaseEventRenew   = "renew"
+	LeaseEventRelease = "release"
+	LeaseEventDecline = "decline"
+)
+
+// events overflow policies, applied when the events buffer is full
+const (
+	// the new event is dropped
+	EventsOverflowDropNewest = "drop-newest"
+	// the oldest event waiting is dropped to make room for the new one
+	EventsOverflowDropOldest = "drop-oldest"
+	// the new event waits for room, for a while, before being dropped
+	EventsOverflowBlock = "block-with-timeout"
+)
+
+const (
+	// events waiting to be published before the overflow policy applies
+	constDefaultEventsBuffer = 1024
+	// how long an event waits for room in the buffer with the
+	// block-with-timeout policy
+	constDefaultEventsBlockTimeout = 100 * time.Millisecond
+	// how long publishing an event may take
+	constPublishTimeout = 5 * time.Second
+)
+
+// LeaseEvent is a change to a lease, as published to the events broker
+type LeaseEvent struct {
+	Type string    `json:"type"`
+	IP   net.IP    `json:"ip"`
+	MAC  string    `json:"mac,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Publisher sends encoded events to a message stream
+type Publisher interface {
+	Publish(ctx context.Context, event []byte) error
+	Close() error
+}
+
+// newPublisher returns the publisher for the configured events broker
+func newPublisher(c Config) (Publisher, error) {
+	broker, err := url.Parse(c.EventsBroker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EventsBroker: %w", err)
+	}
+	if c.EventsTopic == "" {
+		return nil, fmt.Errorf("EventsBroker %s needs an EventsTopic", c.EventsBroker)
+	}
+
+	switch broker.Scheme {
+	case "nats":
+		return newNATSPublisher(broker.Host, c.EventsTopic, c.EventsUser, c.EventsPassword), nil
+	default:
+		return nil, fmt.Errorf("unsupported EventsBroker scheme: %s", broker.Scheme)
+	}
+}
+
+// events publishes lease events in the background, so that a slow broker
+// holds up DHCP handling at most for the block timeout. What is dropped
+// when the buffer is full depends on the overflow policy
+type events struct {
+	publisher Publisher
+	queue     chan LeaseEvent
+	// one of the EventsOverflow policies
+	policy       string
+	blockTimeout time.Duration
+}
+
+func newEvents(publisher Publisher, size int, policy string, blockTimeout time.Duration) *events {
+	return &events{
+		publisher:    publisher,
+		queue:        make(chan LeaseEvent, size),
+		policy:       policy,
+		blockTimeout: blockTimeout,
+	}
+}
+
+// validateEventsOverflowPolicy checks policy is a known overflow policy,
+// an empty one defaults to drop-newest
+func validateEventsOverflowPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return EventsOverflowDropNewest, nil
+	case EventsOverflowDropNewest, EventsOverflowDropOldest, EventsOverflowBlock:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid events overflow policy: %s", policy)
+	}
+}
+
+// emit queues the event of an ip moving between states, if it's one
+func (e *events) emit(from, to IPState, ip net.IP, nic net.HardwareAddr) {
+	event := LeaseEvent{
+		IP:   ip,
+		Time: time.Now(),
+	}
+	if nic != nil {
+		event.MAC = nic.String()
+	}
+
+	switch {
+	case to == IPStateLeased && from == IPStateLeased:
+		event.Type = LeaseEventRenew
+	case to == IPStateLeased:
+		event.Type = LeaseEventGrant
+	case from == IPStateLeased && to == IPStateFree:
+		event.Type = LeaseEventRelease
+	case from == IPStateLeased:
+		event.Type = LeaseEventDecline
+	default:
+		return
+	}
+
+	e.enqueue(event)
+}
+
+// enqueue queues event, applying the overflow policy when the buffer is
+// full
+func (e *events) enqueue(event LeaseEvent) {
+	select {
+	case e.queue <- event:
+		return
+	default:
+	}
+
+	switch e.policy {
+	case EventsOverflowDropOldest:
+		// another emit may take the room made meanwhile
+		for {
+			select {
+			case oldest := <-e.queue:
+				metricEventsDropped.Add(1)
+				log.Warningf("events buffer is full, dropping %s event of %s", oldest.Type, oldest.IP)
+			default:
+				// the publisher made room
+			}
+
+			select {
+			case e.queue <- event:
+				return
+			default:
+			}
+		}
+	case EventsOverflowBlock:
+		timer := time.NewTimer(e.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case e.queue <- event:
+			return
+		case <-timer.C:
+		}
+	}
+
+	metricEventsDropped.Add(1)
+	log.Warningf("events buffer is full, dropping %s event of %s", event.Type, event.IP)
+}
+
+// run publishes the queued events until ctx is done
+func (e *events) run(ctx context.Context) error {
+	defer e.publisher.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event := <-e.queue:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Errorf("could not encode %s event of %s: %v", event.Type, event.IP, err)
+				continue
+			}
+
+			pctx, cancel := context.WithTimeout(ctx, constPublishTimeout)
+			err = e.publisher.Publish(pctx, data)
+			cancel()
+			if err != nil {
+				metricEventsDropped.Add(1)
+				log.Errorf("could not publish %s event of %s: %v", event.Type, event.IP, err)
+			}
+		}
+	}
+}
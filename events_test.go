@@ -0,0 +1,84 @@
+package etcdplugin
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queued drains the events waiting in e and returns their ips
+func queued(e *events) []string {
+	var ips []string
+	for {
+		select {
+		case event := <-e.queue:
+			ips = append(ips, event.IP.String())
+		default:
+			return ips
+		}
+	}
+}
+
+func TestEventsOverflowPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		want    []string
+		blocked bool
+	}{
+		{EventsOverflowDropNewest, []string{"10.0.0.1", "10.0.0.2"}, false},
+		{EventsOverflowDropOldest, []string{"10.0.0.2", "10.0.0.3"}, false},
+		{EventsOverflowBlock, []string{"10.0.0.1", "10.0.0.2"}, true},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			// nothing publishes, the buffer of 2 fills up with the first
+			// events
+			e := newEvents(nil, 2, tt.policy, 50*time.Millisecond)
+			dropped := metricEventsDropped.Value()
+
+			start := time.Now()
+			for i := byte(1); i <= 3; i++ {
+				e.enqueue(LeaseEvent{Type: LeaseEventGrant, IP: net.IPv4(10, 0, 0, i)})
+			}
+			elapsed := time.Since(start)
+
+			if got := queued(e); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want events of %v queued, got %v", tt.want, got)
+			}
+			if got := metricEventsDropped.Value() - dropped; got != 1 {
+				t.Errorf("want 1 event dropped, got %d", got)
+			}
+			if tt.blocked && elapsed < 50*time.Millisecond {
+				t.Errorf("want the overflowing event to wait for room, dropped after %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestEventsBlockWaitsForRoom(t *testing.T) {
+	e := newEvents(nil, 1, EventsOverflowBlock, time.Minute)
+	dropped := metricEventsDropped.Value()
+
+	e.enqueue(LeaseEvent{Type: LeaseEventGrant, IP: net.IPv4(10, 0, 0, 1)})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-e.queue
+	}()
+	e.enqueue(LeaseEvent{Type: LeaseEventGrant, IP: net.IPv4(10, 0, 0, 2)})
+
+	if got := queued(e); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("want the event that waited queued, got %v", got)
+	}
+	if got := metricEventsDropped.Value() - dropped; got != 0 {
+		t.Errorf("want no event dropped, got %d", got)
+	}
+}
+
+func TestValidateEventsOverflowPolicy(t *testing.T) {
+	if policy, err := validateEventsOverflowPolicy(""); err != nil || policy != EventsOverflowDropNewest {
+		t.Errorf("want an empty policy to default to %s, got %q: %v", EventsOverflowDropNewest, policy, err)
+	}
+	if _, err := validateEventsOverflowPolicy("drop-all"); err == nil {
+		t.Error("want an unknown policy rejected")
+	}
+}
@@ -0,0 +1,907 @@
+package etcdplugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeEtcd is an in-memory etcd serving the subset of the KV, Lease and
+// Watch APIs the plugin uses. It sits under the real client's KV and Lease,
+// so requests go through the same encoding as against etcd, and keeps a
+// single revision counter, one per write like etcd does. Leases only expire
+// when the clock is advanced, so tests are deterministic
+type fakeEtcd struct {
+	mu  sync.Mutex
+	rev int64
+	kvs map[string]*mvccpb.KeyValue
+	// the events of every revision, for watches starting in the past
+	history []etcd.WatchResponse
+
+	now       time.Time
+	leases    map[int64]*fakeLease
+	nextLease int64
+
+	watches []*fakeWatch
+
+	// errors the next KV requests fail with, in order
+	failures []error
+	// KV requests served, failed ones included
+	requests int
+	// lease time to live requests served
+	ttlRequests int
+	// how long KV requests and lease grants take, spent outside of mu so
+	// that concurrent requests overlap like they would against a cluster
+	latency time.Duration
+}
+
+// fakeLease is a granted lease and the keys attached to it
+type fakeLease struct {
+	ttl     int64
+	expires time.Time
+	keys    map[string]struct{}
+}
+
+var (
+	_ pb.KVClient    = (*fakeEtcd)(nil)
+	_ pb.LeaseClient = (*fakeEtcd)(nil)
+)
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		rev:    1,
+		kvs:    make(map[string]*mvccpb.KeyValue),
+		now:    time.Unix(1700000000, 0),
+		leases: make(map[int64]*fakeLease),
+	}
+}
+
+// client returns an etcd client backed by the fake, it has no connection
+// so it can't sync its endpoints nor reach the cluster and maintenance APIs
+func (f *fakeEtcd) client() *etcd.Client {
+	c := etcd.NewCtxClient(context.Background())
+	c.KV = etcd.NewKVFromKVClient(f, c)
+	c.Lease = etcd.NewLeaseFromLeaseClient(f, c, time.Second)
+	c.Watcher = &fakeWatcher{f: f}
+	return c
+}
+
+// dial is a dialer handing out clients of the fake
+func (f *fakeEtcd) dial(ctx context.Context, c Config) (*etcd.Client, error) {
+	return f.client(), nil
+}
+
+// failNext has the next KV requests fail with errs, in order
+func (f *fakeEtcd) failNext(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failures = append(f.failures, errs...)
+}
+
+// setLatency has the KV requests and lease grants take d from now on
+func (f *fakeEtcd) setLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latency = d
+}
+
+// delay waits for the configured latency of a request
+func (f *fakeEtcd) delay() {
+	f.mu.Lock()
+	d := f.latency
+	f.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// served returns how many KV requests were served
+func (f *fakeEtcd) served() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests
+}
+
+// ttlServed returns how many lease time to live requests were served
+func (f *fakeEtcd) ttlServed() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ttlRequests
+}
+
+// watching returns how many watches are open
+func (f *fakeEtcd) watching() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.watches)
+}
+
+// leaseCount returns how many leases are granted and not yet expired
+func (f *fakeEtcd) leaseCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.leases)
+}
+
+// advance moves the clock forward, expiring the leases it runs past
+func (f *fakeEtcd) advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+
+	var events []*etcd.Event
+	for id, l := range f.leases {
+		if f.now.Before(l.expires) {
+			continue
+		}
+		events = append(events, f.revokeLocked(id)...)
+	}
+	f.commitLocked(events)
+}
+
+// get returns the value of key, false if it does not exist
+func (f *fakeEtcd) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	kv, ok := f.kvs[key]
+	if !ok {
+		return "", false
+	}
+	return string(kv.Value), true
+}
+
+// keys returns the keys starting with prefix, sorted
+func (f *fakeEtcd) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key := range f.kvs {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// put writes key outside of the client, eg. to seed a test
+func (f *fakeEtcd) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commitLocked([]*etcd.Event{f.putLocked(key, []byte(value), 0, false, false)})
+}
+
+// delete deletes key outside of the client, eg. to simulate another writer
+func (f *fakeEtcd) delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.commitLocked(f.deleteLocked([]byte(key), nil))
+}
+
+// fail pops the next injected failure, if any, and counts the request
+func (f *fakeEtcd) fail() error {
+	f.requests++
+	if len(f.failures) == 0 {
+		return nil
+	}
+	err := f.failures[0]
+	f.failures = f.failures[1:]
+	return err
+}
+
+func (f *fakeEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: f.rev}
+}
+
+// inRange reports whether key is within [begin, end) the way etcd reads a
+// key and range end: a single key without an end, every key from begin on
+// with an end of "\x00"
+func inRange(key, begin, end []byte) bool {
+	switch {
+	case len(end) == 0:
+		return bytes.Equal(key, begin)
+	case len(end) == 1 && end[0] == 0:
+		return bytes.Compare(key, begin) >= 0
+	default:
+		return bytes.Compare(key, begin) >= 0 && bytes.Compare(key, end) < 0
+	}
+}
+
+// rangeLocked returns the kvs within a range, sorted by key
+func (f *fakeEtcd) rangeLocked(begin, end []byte) []*mvccpb.KeyValue {
+	var kvs []*mvccpb.KeyValue
+	for key, kv := range f.kvs {
+		if inRange([]byte(key), begin, end) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+	})
+	return kvs
+}
+
+func (f *fakeEtcd) rangeReq(r *pb.RangeRequest) *pb.RangeResponse {
+	kvs := f.rangeLocked(r.Key, r.RangeEnd)
+
+	var target func(kv *mvccpb.KeyValue) int64
+	switch r.SortTarget {
+	case pb.RangeRequest_VERSION:
+		target = func(kv *mvccpb.KeyValue) int64 { return kv.Version }
+	case pb.RangeRequest_CREATE:
+		target = func(kv *mvccpb.KeyValue) int64 { return kv.CreateRevision }
+	case pb.RangeRequest_MOD:
+		target = func(kv *mvccpb.KeyValue) int64 { return kv.ModRevision }
+	}
+	if target != nil && r.SortOrder != pb.RangeRequest_NONE {
+		sort.SliceStable(kvs, func(i, j int) bool {
+			return target(kvs[i]) < target(kvs[j])
+		})
+	}
+	if r.SortOrder == pb.RangeRequest_DESCEND {
+		for i, j := 0, len(kvs)-1; i < j; i, j = i+1, j-1 {
+			kvs[i], kvs[j] = kvs[j], kvs[i]
+		}
+	}
+
+	resp := &pb.RangeResponse{Header: f.header(), Count: int64(len(kvs))}
+	if r.CountOnly {
+		return resp
+	}
+	if r.Limit > 0 && int64(len(kvs)) > r.Limit {
+		kvs = kvs[:r.Limit]
+		resp.More = true
+	}
+	for _, kv := range kvs {
+		kv := *kv
+		if r.KeysOnly {
+			kv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &kv)
+	}
+	return resp
+}
+
+// putLocked writes a key at the next revision, committed by commitLocked
+func (f *fakeEtcd) putLocked(key string, value []byte, lease int64, ignoreValue, ignoreLease bool) *etcd.Event {
+	rev := f.rev + 1
+	kv := &mvccpb.KeyValue{Key: []byte(key), CreateRevision: rev, ModRevision: rev, Version: 1}
+	if prev, ok := f.kvs[key]; ok {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if ignoreValue {
+			value = prev.Value
+		}
+		if ignoreLease {
+			lease = prev.Lease
+		}
+		if l, ok := f.leases[prev.Lease]; ok {
+			delete(l.keys, key)
+		}
+	}
+	kv.Value = value
+	kv.Lease = lease
+	if l, ok := f.leases[lease]; ok {
+		l.keys[key] = struct{}{}
+	}
+	f.kvs[key] = kv
+
+	event := etcd.Event{Type: mvccpb.PUT, Kv: kv}
+	return &event
+}
+
+// deleteLocked deletes the keys within a range at the next revision
+func (f *fakeEtcd) deleteLocked(begin, end []byte) []*etcd.Event {
+	var events []*etcd.Event
+	for _, kv := range f.rangeLocked(begin, end) {
+		key := string(kv.Key)
+		delete(f.kvs, key)
+		if l, ok := f.leases[kv.Lease]; ok {
+			delete(l.keys, key)
+		}
+		events = append(events, &etcd.Event{
+			Type:   mvccpb.DELETE,
+			Kv:     &mvccpb.KeyValue{Key: kv.Key, ModRevision: f.rev + 1},
+			PrevKv: kv,
+		})
+	}
+	return events
+}
+
+// revokeLocked drops a lease along with its keys
+func (f *fakeEtcd) revokeLocked(id int64) []*etcd.Event {
+	l := f.leases[id]
+	delete(f.leases, id)
+
+	var events []*etcd.Event
+	for key := range l.keys {
+		events = append(events, f.deleteLocked([]byte(key), nil)...)
+	}
+	return events
+}
+
+// commitLocked moves to the next revision if anything was written in it,
+// and hands the events to the watches
+func (f *fakeEtcd) commitLocked(events []*etcd.Event) {
+	if len(events) == 0 {
+		return
+	}
+	f.rev++
+
+	resp := etcd.WatchResponse{
+		Header: pb.ResponseHeader{Revision: f.rev},
+		Events: events,
+	}
+	f.history = append(f.history, resp)
+	for _, w := range f.watches {
+		w.deliver(resp)
+	}
+}
+
+// compare evaluates a txn comparison the way etcd does: against every key
+// in its range, a missing key having zero revisions and version and no value
+func (f *fakeEtcd) compare(c *pb.Compare) bool {
+	kvs := f.rangeLocked(c.Key, c.RangeEnd)
+	if len(kvs) == 0 {
+		if c.Target == pb.Compare_VALUE {
+			return false
+		}
+		kvs = []*mvccpb.KeyValue{{}}
+	}
+
+	for _, kv := range kvs {
+		var r int
+		switch c.Target {
+		case pb.Compare_VERSION:
+			r = compareInt(kv.Version, c.GetVersion())
+		case pb.Compare_CREATE:
+			r = compareInt(kv.CreateRevision, c.GetCreateRevision())
+		case pb.Compare_MOD:
+			r = compareInt(kv.ModRevision, c.GetModRevision())
+		case pb.Compare_LEASE:
+			r = compareInt(kv.Lease, c.GetLease())
+		case pb.Compare_VALUE:
+			r = bytes.Compare(kv.Value, c.GetValue())
+		}
+
+		var ok bool
+		switch c.Result {
+		case pb.Compare_EQUAL:
+			ok = r == 0
+		case pb.Compare_NOT_EQUAL:
+			ok = r != 0
+		case pb.Compare_GREATER:
+			ok = r > 0
+		case pb.Compare_LESS:
+			ok = r < 0
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// txnLocked applies a txn, its writes all land in the same revision
+func (f *fakeEtcd) txnLocked(r *pb.TxnRequest) (*pb.TxnResponse, []*etcd.Event, error) {
+	succeeded := true
+	for _, c := range r.Compare {
+		succeeded = succeeded && f.compare(c)
+	}
+
+	ops := r.Failure
+	if succeeded {
+		ops = r.Success
+	}
+
+	resp := &pb.TxnResponse{Succeeded: succeeded}
+	var events []*etcd.Event
+	for _, op := range ops {
+		switch req := op.Request.(type) {
+		case *pb.RequestOp_RequestRange:
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseRange{ResponseRange: f.rangeReq(req.RequestRange)},
+			})
+		case *pb.RequestOp_RequestPut:
+			put, event, err := f.putReq(req.RequestPut)
+			if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, event)
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponsePut{ResponsePut: put},
+			})
+		case *pb.RequestOp_RequestDeleteRange:
+			deleted := f.deleteLocked(req.RequestDeleteRange.Key, req.RequestDeleteRange.RangeEnd)
+			events = append(events, deleted...)
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseDeleteRange{
+					ResponseDeleteRange: &pb.DeleteRangeResponse{Deleted: int64(len(deleted))},
+				},
+			})
+		case *pb.RequestOp_RequestTxn:
+			nested, nestedEvents, err := f.txnLocked(req.RequestTxn)
+			if err != nil {
+				return nil, nil, err
+			}
+			events = append(events, nestedEvents...)
+			resp.Responses = append(resp.Responses, &pb.ResponseOp{
+				Response: &pb.ResponseOp_ResponseTxn{ResponseTxn: nested},
+			})
+		}
+	}
+
+	return resp, events, nil
+}
+
+func (f *fakeEtcd) putReq(r *pb.PutRequest) (*pb.PutResponse, *etcd.Event, error) {
+	if r.Lease != 0 {
+		if _, ok := f.leases[r.Lease]; !ok {
+			return nil, nil, rpctypes.ErrGRPCLeaseNotFound
+		}
+	}
+
+	resp := &pb.PutResponse{}
+	if prev, ok := f.kvs[string(r.Key)]; ok && r.PrevKv {
+		prev := *prev
+		resp.PrevKv = &prev
+	}
+
+	return resp, f.putLocked(string(r.Key), r.Value, r.Lease, r.IgnoreValue, r.IgnoreLease), nil
+}
+
+func (f *fakeEtcd) Range(ctx context.Context, r *pb.RangeRequest, opts ...grpc.CallOption) (*pb.RangeResponse, error) {
+	f.delay()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.rangeReq(r), nil
+}
+
+func (f *fakeEtcd) Put(ctx context.Context, r *pb.PutRequest, opts ...grpc.CallOption) (*pb.PutResponse, error) {
+	f.delay()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+
+	resp, event, err := f.putReq(r)
+	if err != nil {
+		return nil, err
+	}
+	f.commitLocked([]*etcd.Event{event})
+	resp.Header = f.header()
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) DeleteRange(ctx context.Context, r *pb.DeleteRangeRequest, opts ...grpc.CallOption) (*pb.DeleteRangeResponse, error) {
+	f.delay()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+
+	events := f.deleteLocked(r.Key, r.RangeEnd)
+	resp := &pb.DeleteRangeResponse{Deleted: int64(len(events))}
+	if r.PrevKv {
+		for _, ev := range events {
+			resp.PrevKvs = append(resp.PrevKvs, ev.PrevKv)
+		}
+	}
+	f.commitLocked(events)
+	resp.Header = f.header()
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) Txn(ctx context.Context, r *pb.TxnRequest, opts ...grpc.CallOption) (*pb.TxnResponse, error) {
+	f.delay()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+
+	resp, events, err := f.txnLocked(r)
+	if err != nil {
+		return nil, err
+	}
+	f.commitLocked(events)
+	resp.Header = f.header()
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) Compact(ctx context.Context, r *pb.CompactionRequest, opts ...grpc.CallOption) (*pb.CompactionResponse, error) {
+	return &pb.CompactionResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) LeaseGrant(ctx context.Context, r *pb.LeaseGrantRequest, opts ...grpc.CallOption) (*pb.LeaseGrantResponse, error) {
+	f.delay()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := r.ID
+	if id == 0 {
+		f.nextLease++
+		id = f.nextLease
+	}
+	f.leases[id] = &fakeLease{
+		ttl:     r.TTL,
+		expires: f.now.Add(time.Duration(r.TTL) * time.Second),
+		keys:    make(map[string]struct{}),
+	}
+
+	return &pb.LeaseGrantResponse{Header: f.header(), ID: id, TTL: r.TTL}, nil
+}
+
+func (f *fakeEtcd) LeaseRevoke(ctx context.Context, r *pb.LeaseRevokeRequest, opts ...grpc.CallOption) (*pb.LeaseRevokeResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.leases[r.ID]; !ok {
+		return nil, rpctypes.ErrGRPCLeaseNotFound
+	}
+	f.commitLocked(f.revokeLocked(r.ID))
+
+	return &pb.LeaseRevokeResponse{Header: f.header()}, nil
+}
+
+func (f *fakeEtcd) LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (pb.Lease_LeaseKeepAliveClient, error) {
+	return &fakeKeepAlive{
+		f:         f,
+		ctx:       ctx,
+		responses: make(chan *pb.LeaseKeepAliveResponse, 16),
+	}, nil
+}
+
+func (f *fakeEtcd) LeaseTimeToLive(ctx context.Context, r *pb.LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*pb.LeaseTimeToLiveResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ttlRequests++
+
+	l, ok := f.leases[r.ID]
+	if !ok {
+		return &pb.LeaseTimeToLiveResponse{Header: f.header(), ID: r.ID, TTL: -1}, nil
+	}
+
+	resp := &pb.LeaseTimeToLiveResponse{
+		Header:     f.header(),
+		ID:         r.ID,
+		TTL:        int64((l.expires.Sub(f.now) + time.Second - 1) / time.Second),
+		GrantedTTL: l.ttl,
+	}
+	if r.Keys {
+		for key := range l.keys {
+			resp.Keys = append(resp.Keys, []byte(key))
+		}
+	}
+
+	return resp, nil
+}
+
+func (f *fakeEtcd) LeaseLeases(ctx context.Context, r *pb.LeaseLeasesRequest, opts ...grpc.CallOption) (*pb.LeaseLeasesResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := &pb.LeaseLeasesResponse{Header: f.header()}
+	for id := range f.leases {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: id})
+	}
+
+	return resp, nil
+}
+
+// fakeKeepAlive is a keep alive stream, every request is answered with the
+// lease's refreshed TTL, zero once it's gone
+type fakeKeepAlive struct {
+	f         *fakeEtcd
+	ctx       context.Context
+	responses chan *pb.LeaseKeepAliveResponse
+}
+
+func (k *fakeKeepAlive) Send(r *pb.LeaseKeepAliveRequest) error {
+	k.f.mu.Lock()
+	resp := &pb.LeaseKeepAliveResponse{Header: k.f.header(), ID: r.ID}
+	if l, ok := k.f.leases[r.ID]; ok {
+		l.expires = k.f.now.Add(time.Duration(l.ttl) * time.Second)
+		resp.TTL = l.ttl
+	}
+	k.f.mu.Unlock()
+
+	select {
+	case k.responses <- resp:
+		return nil
+	case <-k.ctx.Done():
+		return k.ctx.Err()
+	}
+}
+
+func (k *fakeKeepAlive) Recv() (*pb.LeaseKeepAliveResponse, error) {
+	select {
+	case resp := <-k.responses:
+		return resp, nil
+	case <-k.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (k *fakeKeepAlive) Header() (metadata.MD, error) { return nil, nil }
+func (k *fakeKeepAlive) Trailer() metadata.MD         { return nil }
+func (k *fakeKeepAlive) CloseSend() error             { return nil }
+func (k *fakeKeepAlive) Context() context.Context     { return k.ctx }
+func (k *fakeKeepAlive) SendMsg(m interface{}) error  { return k.Send(m.(*pb.LeaseKeepAliveRequest)) }
+func (k *fakeKeepAlive) RecvMsg(m interface{}) error  { return nil }
+
+// fakeWatcher serves watches of the fake, starting from a past revision if
+// asked to
+type fakeWatcher struct {
+	f *fakeEtcd
+}
+
+// fakeWatch is a watch on a range, its responses are queued so that writes
+// never block on a slow reader
+type fakeWatch struct {
+	begin, end []byte
+	ch         chan etcd.WatchResponse
+
+	mu      sync.Mutex
+	pending []etcd.WatchResponse
+	notify  chan struct{}
+}
+
+func (w *fakeWatcher) Watch(ctx context.Context, key string, opts ...etcd.OpOption) etcd.WatchChan {
+	op := etcd.OpGet(key, opts...)
+	watch := &fakeWatch{
+		begin:  op.KeyBytes(),
+		end:    op.RangeBytes(),
+		ch:     make(chan etcd.WatchResponse),
+		notify: make(chan struct{}, 1),
+	}
+
+	w.f.mu.Lock()
+	if rev := op.Rev(); rev > 0 {
+		for _, resp := range w.f.history {
+			if resp.Header.Revision >= rev {
+				watch.deliver(resp)
+			}
+		}
+	}
+	w.f.watches = append(w.f.watches, watch)
+	w.f.mu.Unlock()
+
+	go func() {
+		defer close(watch.ch)
+		defer w.remove(watch)
+
+		for {
+			watch.mu.Lock()
+			pending := watch.pending
+			watch.pending = nil
+			watch.mu.Unlock()
+
+			for _, resp := range pending {
+				select {
+				case watch.ch <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-watch.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return watch.ch
+}
+
+func (w *fakeWatcher) remove(watch *fakeWatch) {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+
+	for i, other := range w.f.watches {
+		if other == watch {
+			w.f.watches = append(w.f.watches[:i], w.f.watches[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *fakeWatcher) RequestProgress(ctx context.Context) error { return nil }
+func (w *fakeWatcher) Close() error                              { return nil }
+
+// deliver queues the events of resp within the watch's range
+func (w *fakeWatch) deliver(resp etcd.WatchResponse) {
+	var events []*etcd.Event
+	for _, ev := range resp.Events {
+		if inRange(ev.Kv.Key, w.begin, w.end) {
+			events = append(events, ev)
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, etcd.WatchResponse{Header: resp.Header, Events: events})
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func TestFakeEtcdTxn(t *testing.T) {
+	f := newFakeEtcd()
+	c := f.client()
+	ctx := context.Background()
+
+	// a create only succeeds while the key is missing
+	for i, want := range []bool{true, false} {
+		resp, err := c.Txn(ctx).
+			If(etcd.Compare(etcd.CreateRevision("a"), "=", 0)).
+			Then(etcd.OpPut("a", "1")).
+			Commit()
+		if err != nil {
+			t.Fatalf("txn %d: %v", i, err)
+		}
+		if resp.Succeeded != want {
+			t.Errorf("txn %d: want succeeded %v, got %v", i, want, resp.Succeeded)
+		}
+	}
+
+	// writes of a txn land in a single revision
+	before := f.rev
+	if _, err := c.Txn(ctx).Then(etcd.OpPut("b", "2"), etcd.OpDelete("a")).Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if f.rev != before+1 {
+		t.Errorf("want the txn at revision %d, got %d", before+1, f.rev)
+	}
+
+	// a compare on a range holds for all of its keys
+	f.put("p/1", "x")
+	f.put("p/2", "y")
+	resp, err := c.Txn(ctx).
+		If(etcd.Compare(etcd.Value("p/").WithPrefix(), "=", "x")).
+		Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Succeeded {
+		t.Error("want a value compare over a range with differing values to fail")
+	}
+}
+
+func TestFakeEtcdLeaseExpiry(t *testing.T) {
+	f := newFakeEtcd()
+	c := f.client()
+	ctx := context.Background()
+
+	grant, err := c.Grant(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(ctx, "k", "v", etcd.WithLease(grant.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.advance(5 * time.Second)
+	if _, err := c.KeepAliveOnce(ctx, grant.ID); err != nil {
+		t.Fatal(err)
+	}
+	f.advance(9 * time.Second)
+	if _, ok := f.get("k"); !ok {
+		t.Fatal("want the key kept by the keep alive")
+	}
+
+	f.advance(2 * time.Second)
+	if _, ok := f.get("k"); ok {
+		t.Fatal("want the key gone with its lease")
+	}
+	if _, err := c.Put(ctx, "k", "v", etcd.WithLease(grant.ID)); !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		t.Fatalf("want %v putting with an expired lease, got %v", rpctypes.ErrLeaseNotFound, err)
+	}
+}
+
+func TestFakeEtcdWatch(t *testing.T) {
+	f := newFakeEtcd()
+	c := f.client()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f.put("w/1", "a")
+	rev := f.rev
+	f.put("other", "b")
+	f.put("w/2", "c")
+
+	// replays from a past revision, then follows
+	ch := c.Watch(ctx, "w/", etcd.WithPrefix(), etcd.WithRev(rev))
+	f.put("w/1", "d")
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case resp := <-ch:
+			for _, ev := range resp.Events {
+				got = append(got, string(ev.Kv.Key)+"="+string(ev.Kv.Value))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, got %v", got)
+		}
+	}
+	want := []string{"w/1=a", "w/2=c", "w/1=d"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("want events %v, got %v", want, got)
+	}
+}
+
+func TestFakeEtcdFailures(t *testing.T) {
+	f := newFakeEtcd()
+	c := f.client()
+
+	f.failNext(rpctypes.ErrGRPCNoLeader)
+	if _, err := c.Get(context.Background(), "k"); !errors.Is(err, rpctypes.ErrNoLeader) {
+		t.Fatalf("want %v, got %v", rpctypes.ErrNoLeader, err)
+	}
+	if _, err := c.Get(context.Background(), "k"); err != nil {
+		t.Fatalf("want the failure consumed, got %v", err)
+	}
+}
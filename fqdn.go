@@ -0,0 +1,92 @@
+package etcdplugin
+
+import (
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// client FQDN option flags, RFC 4702 2.1
+const (
+	// the server performs the A record update
+	fqdnFlagS = 1 << 0
+	// the server overrode the client's S bit
+	fqdnFlagO = 1 << 1
+	// the name is in canonical wire format
+	fqdnFlagE = 1 << 2
+	// the server performs no updates
+	fqdnFlagN = 1 << 3
+
+	// the deprecated RCODE fields servers set, RFC 4702 2.2
+	constFQDNRcode = 255
+)
+
+// clientFQDN is the client FQDN option of a request
+type clientFQDN struct {
+	flags uint8
+	// as the client sent it
+	name []byte
+}
+
+// parseClientFQDN returns the client FQDN option of req, nil when absent or
+// malformed
+func parseClientFQDN(req *dhcpv4.DHCPv4) *clientFQDN {
+	data := req.Options.Get(dhcpv4.OptionFQDN)
+	if len(data) < 3 {
+		return nil
+	}
+
+	return &clientFQDN{
+		flags: data[0],
+		name:  data[3:],
+	}
+}
+
+// host returns the first label of the name
+func (f *clientFQDN) host() string {
+	if f.flags&fqdnFlagE == 0 {
+		host, _, _ := strings.Cut(string(f.name), ".")
+		return host
+	}
+
+	if len(f.name) == 0 || int(f.name[0]) >= len(f.name) {
+		return ""
+	}
+	return string(f.name[1 : 1+f.name[0]])
+}
+
+// fqdnUpdate honors the flags of req's client FQDN option, answering with
+// the ones the server settled on. It returns the host name the client
+// sent in it and whether the server registers its A record, which it does
+// when the client asks for it with the S bit, or regardless when
+// OverrideClientFQDN is set, unless the client forbids any update with
+// the N bit, RFC 4702 3.1
+func (p *PluginState) fqdnUpdate(req, resp *dhcpv4.DHCPv4) (string, bool) {
+	f := parseClientFQDN(req)
+	if f == nil {
+		return "", true
+	}
+
+	register := f.flags&fqdnFlagS != 0 || p.config.OverrideClientFQDN
+	if f.flags&fqdnFlagN != 0 {
+		register = false
+	}
+
+	flags := f.flags & fqdnFlagE
+	switch {
+	case register:
+		flags |= fqdnFlagS
+	case f.flags&fqdnFlagN != 0:
+		flags |= fqdnFlagN
+	}
+	if flags&fqdnFlagS != f.flags&fqdnFlagS {
+		flags |= fqdnFlagO
+	}
+
+	value := append([]byte{flags, constFQDNRcode, constFQDNRcode}, f.name...)
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionFQDN, value))
+
+	log.Debugf("client FQDN flags of %s are %#x, answering %#x", req.ClientHWAddr, f.flags, flags)
+
+	return f.host(), register
+}
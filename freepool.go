@@ -0,0 +1,307 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// constRandomPickTries is how many times a random pick draws from the free
+// ip cache before falling back to drawing among the ips not skipped
+const constRandomPickTries = 8
+
+// freePool caches the free ips, kept in sync with etcd by a watch on the
+// free prefix, so that a DISCOVER does not scan the whole prefix. The ips
+// are kept sorted, so that picking one only looks at the part of the cache
+// each range covers
+type freePool struct {
+	mu sync.Mutex
+	// sorted, nil until the first sync and while resyncing
+	ips []uint32
+}
+
+func newFreePool() *freePool {
+	return &freePool{}
+}
+
+// reset replaces the cached ips, nil marks the cache as out of sync
+func (f *freePool) reset(ips []uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+	f.ips = ips
+}
+
+// search returns where n is or would be inserted in the cached ips
+func (f *freePool) search(n uint32) int {
+	return sort.Search(len(f.ips), func(i int) bool { return f.ips[i] >= n })
+}
+
+// update adds ip to the cache, or removes it when it's no longer free
+func (f *freePool) update(ip net.IP, free bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ips == nil {
+		return
+	}
+
+	n := binary.BigEndian.Uint32(ip)
+	i := f.search(n)
+	cached := i < len(f.ips) && f.ips[i] == n
+	switch {
+	case free && !cached:
+		f.ips = append(f.ips, 0)
+		copy(f.ips[i+1:], f.ips[i:])
+		f.ips[i] = n
+	case !free && cached:
+		f.ips = append(f.ips[:i], f.ips[i+1:]...)
+	}
+}
+
+// size returns how many ips are cached, false when the cache is out of sync
+func (f *freePool) size() (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.ips), f.ips != nil
+}
+
+// window returns the bounds of the cached ips from first to last, both
+// included
+func (f *freePool) window(first, last uint32) (int, int) {
+	lo := f.search(first)
+	hi := lo + sort.Search(len(f.ips)-lo, func(i int) bool { return f.ips[lo+i] > last })
+	return lo, hi
+}
+
+// firstIn returns the first cached ip from first to last not in skip
+func (f *freePool) firstIn(first, last uint32, skip map[uint32]struct{}) (uint32, bool) {
+	lo, hi := f.window(first, last)
+	for _, n := range f.ips[lo:hi] {
+		if !isSkipped(skip, n) {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// pick returns the first cached ip through ranges at or after start,
+// wrapping around to the first one, skipping the ones in skip, nil when
+// there's none
+func (f *freePool) pick(ranges ipRanges, start net.IP, skip map[uint32]struct{}) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	at, from := 0, binary.BigEndian.Uint32(ranges[0].start)
+	if ip4 := start.To4(); ip4 != nil {
+		n := binary.BigEndian.Uint32(ip4)
+		for i, rng := range ranges {
+			if n >= binary.BigEndian.Uint32(rng.start) && n <= binary.BigEndian.Uint32(rng.end) {
+				at, from = i, n
+				break
+			}
+		}
+	}
+
+	// the range holding start is looked through from it, then the ranges
+	// after it and those before it, then the part of it before start
+	for i := range ranges {
+		rng := ranges[(at+i)%len(ranges)]
+		first := binary.BigEndian.Uint32(rng.start)
+		if i == 0 {
+			first = from
+		}
+		if n, ok := f.firstIn(first, binary.BigEndian.Uint32(rng.end), skip); ok {
+			return uint32ToIP(n)
+		}
+	}
+	if first := binary.BigEndian.Uint32(ranges[at].start); from > first {
+		if n, ok := f.firstIn(first, from-1, skip); ok {
+			return uint32ToIP(n)
+		}
+	}
+
+	return nil
+}
+
+// pickRandom returns any cached ip of ranges not in skip, nil when there's
+// none
+func (f *freePool) pickRandom(ranges ipRanges, skip map[uint32]struct{}) net.IP {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the parts of the cache each range covers
+	type window struct{ lo, hi int }
+	windows := make([]window, 0, len(ranges))
+	total := 0
+	for _, rng := range ranges {
+		lo, hi := f.window(binary.BigEndian.Uint32(rng.start), binary.BigEndian.Uint32(rng.end))
+		windows = append(windows, window{lo, hi})
+		total += hi - lo
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// the ips skipped are the few offered to other nics, drawing again
+	// when one comes up seldom has to be repeated
+	for try := 0; try < constRandomPickTries; try++ {
+		k := rand.Intn(total)
+		for _, w := range windows {
+			if k >= w.hi-w.lo {
+				k -= w.hi - w.lo
+				continue
+			}
+			if n := f.ips[w.lo+k]; !isSkipped(skip, n) {
+				return uint32ToIP(n)
+			}
+			break
+		}
+	}
+
+	candidates := make([]uint32, 0, total)
+	for _, w := range windows {
+		for _, n := range f.ips[w.lo:w.hi] {
+			if !isSkipped(skip, n) {
+				candidates = append(candidates, n)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return uint32ToIP(candidates[rand.Intn(len(candidates))])
+}
+
+func isSkipped(skip map[uint32]struct{}, n uint32) bool {
+	_, ok := skip[n]
+	return ok
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// cachedFreeIP picks a free ip of ranges from the cache, nil when the cache
+// is out of sync or has none to offer nic
+func (p *PluginState) cachedFreeIP(ctx context.Context, nic net.HardwareAddr, ranges ipRanges) (net.IP, error) {
+	free, ok := p.freePool.size()
+	if !ok || free == 0 {
+		return nil, nil
+	}
+
+	reserved, err := p.reservedForOthers(ctx, nic)
+	if err != nil {
+		return nil, err
+	}
+	if free <= reserved {
+		return nil, nil
+	}
+
+	// look past the ones being offered to other nics
+	skip := make(map[uint32]struct{})
+	for _, ip := range p.claims.all() {
+		if ip4 := ip.To4(); ip4 != nil {
+			skip[binary.BigEndian.Uint32(ip4)] = struct{}{}
+		}
+	}
+
+	if p.allocationStrategy == AllocationRandom {
+		return p.freePool.pickRandom(ranges, skip), nil
+	}
+
+	return p.freePool.pick(ranges, p.instanceStart, skip), nil
+}
+
+// loadFreeIPs fills the cache with the free ips in etcd, returning the
+// revision it was read at
+func (p *PluginState) loadFreeIPs(ctx context.Context) (int64, error) {
+	resp, err := p.kv().Get(ctx, p.keys.IP(IPStateFree, ""), etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return 0, errors.Wrap(err, "could not list free ips")
+	}
+
+	ips := make([]uint32, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err != nil || ip.To4() == nil {
+			log.Warningf("ignoring free key %s not naming an IPv4 address", kv.Key)
+			continue
+		}
+		ips = append(ips, binary.BigEndian.Uint32(ip.To4()))
+	}
+	p.freePool.reset(ips)
+
+	log.Debugf("cached %d free ips at revision %d", len(ips), resp.Header.Revision)
+
+	return resp.Header.Revision, nil
+}
+
+// watchFreeIPs keeps the cache of free ips in sync with etcd, reloading it
+// whenever the watch breaks, the revision it watched from was compacted or
+// the connection to the leader was lost
+func (p *PluginState) watchFreeIPs(ctx context.Context) error {
+	for ctx.Err() == nil {
+		rev, err := p.loadFreeIPs(ctx)
+		if err != nil {
+			log.Errorf("could not cache free ips: %v", err)
+		} else {
+			p.followFreeIPs(ctx, rev)
+		}
+
+		// out of sync until reloaded, freeIP scans etcd meanwhile
+		p.freePool.reset(nil)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	return ctx.Err()
+}
+
+// followFreeIPs applies the changes to the free prefix after rev to the
+// cache, until the watch breaks
+func (p *PluginState) followFreeIPs(ctx context.Context, rev int64) {
+	watchCtx, cancel := context.WithCancel(etcd.WithRequireLeader(ctx))
+	defer cancel()
+
+	wch := p.watcher().Watch(watchCtx, p.keys.IP(IPStateFree, ""), etcd.WithPrefix(), etcd.WithRev(rev+1))
+	for wresp := range wch {
+		if wresp.CompactRevision != 0 {
+			log.Warningf("free ip watch fell behind compaction at revision %d, resyncing",
+				wresp.CompactRevision)
+			return
+		}
+		if err := wresp.Err(); err != nil {
+			log.Errorf("free ip watch failed, resyncing: %v", err)
+			return
+		}
+
+		for _, ev := range wresp.Events {
+			_, ip, err := p.keys.ParseIP(string(ev.Kv.Key))
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+			p.freePool.update(ip.To4(), ev.Type == mvccpb.PUT)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestFreePoolPick(t *testing.T) {
+	// drawn from 10.0.1.x before 10.0.0.x
+	var ranges ipRanges
+	for _, bounds := range [][2]string{{"10.0.1.1", "10.0.1.5"}, {"10.0.0.1", "10.0.0.5"}} {
+		rng, err := parseRange(bounds[0], bounds[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges = append(ranges, rng)
+	}
+	n := func(ip string) uint32 { return binary.BigEndian.Uint32(net.ParseIP(ip).To4()) }
+
+	pool := newFreePool()
+	pool.reset([]uint32{n("10.0.0.2"), n("10.0.1.4"), n("10.0.0.9"), n("10.0.1.2")})
+	pool.update(net.ParseIP("10.0.0.4").To4(), true)
+	pool.update(net.ParseIP("10.0.1.2").To4(), false)
+	pool.update(net.ParseIP("10.0.1.2").To4(), false)
+
+	for _, tt := range []struct {
+		start string
+		skip  []string
+		want  string
+	}{
+		{"", nil, "10.0.1.4"},
+		{"10.0.1.4", nil, "10.0.1.4"},
+		{"10.0.1.5", nil, "10.0.0.2"},
+		{"10.0.0.3", nil, "10.0.0.4"},
+		// wrapping around to the first range
+		{"10.0.0.5", nil, "10.0.1.4"},
+		{"10.0.0.5", []string{"10.0.1.4"}, "10.0.0.2"},
+		// a start outside of the ranges starts from the first one
+		{"192.168.0.1", nil, "10.0.1.4"},
+		{"10.0.0.3", []string{"10.0.0.4", "10.0.1.4", "10.0.0.2"}, ""},
+	} {
+		var start net.IP
+		if tt.start != "" {
+			start = net.ParseIP(tt.start)
+		}
+		skip := make(map[uint32]struct{})
+		for _, ip := range tt.skip {
+			skip[n(ip)] = struct{}{}
+		}
+
+		got := pool.pick(ranges, start, skip)
+		if (tt.want == "" && got != nil) || (tt.want != "" && !got.Equal(net.ParseIP(tt.want))) {
+			t.Errorf("start %s skipping %v: want %q picked, got %s", tt.start, tt.skip, tt.want, got)
+		}
+	}
+
+	// 10.0.0.9 is cached but out of the ranges
+	skip := map[uint32]struct{}{n("10.0.0.2"): {}}
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		picked[pool.pickRandom(ranges, skip).String()]++
+	}
+	if len(picked) != 2 || picked["10.0.1.4"] == 0 || picked["10.0.0.4"] == 0 {
+		t.Errorf("want picks spread over 10.0.1.4 and 10.0.0.4, got %v", picked)
+	}
+}
+
+// BenchmarkFreeIP measures picking the free ip a DISCOVER is offered, by
+// scanning the free prefix in etcd and from the free ip cache, for pools of
+// a few sizes. The fake etcd answers in memory, a real cluster adds the
+// transfer of the whole prefix to every scan
+func BenchmarkFreeIP(b *testing.B) {
+	for _, pool := range []struct {
+		end  string
+		size int
+	}{
+		{"10.0.0.254", 254},
+		{"10.0.3.254", 1022},
+		{"10.0.15.254", 4094},
+	} {
+		for _, cached := range []bool{false, true} {
+			name := fmt.Sprintf("size=%d/scan", pool.size)
+			if cached {
+				name = fmt.Sprintf("size=%d/cache", pool.size)
+			}
+			b.Run(name, func(b *testing.B) {
+				f := newFakeEtcd()
+				lines := []string{"End = " + pool.end}
+				if cached {
+					lines = append(lines, "CacheFreeIPs = true")
+				}
+				p := newTestPlugin(b, f, lines...)
+				if cached {
+					waitFor(b, "the free ip cache", func() bool {
+						n, ok := p.freePool.size()
+						return ok && n == pool.size
+					})
+				}
+
+				ctx := context.Background()
+				nic := testMAC(1)
+				misses := metricFreeCacheMisses.Value()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := p.freeIP(ctx, nic, p.ranges); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				if cached && metricFreeCacheMisses.Value() != misses {
+					b.Error("want every pick served from the cache")
+				}
+			})
+		}
+	}
+}
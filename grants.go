@@ -0,0 +1,115 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// grant is a lease this instance handed out
+type grant struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// grants tracks the leases recently handed out by this instance, so they
+// can be checked against etcd once a partition heals
+type grants struct {
+	mu sync.Mutex
+	// by nic
+	granted map[string]grant
+	// nics whose grant etcd contradicted, until their next contact
+	contradicted map[string]struct{}
+}
+
+func newGrants() *grants {
+	return &grants{
+		granted:      make(map[string]grant),
+		contradicted: make(map[string]struct{}),
+	}
+}
+
+// record remembers a lease handed out to a nic
+func (g *grants) record(nic net.HardwareAddr, ip net.IP, ttl time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.granted[nic.String()] = grant{
+		ip:      ip,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// takeContradicted reports whether the nic's last grant was contradicted by
+// etcd, clearing the mark
+func (g *grants) takeContradicted(nic net.HardwareAddr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.contradicted[nic.String()]
+	delete(g.contradicted, nic.String())
+
+	return ok
+}
+
+// reconcileGrants checks the leases recently handed out by this instance
+// against etcd, which is authoritative, marking the nics whose lease etcd no
+// longer holds so they're given a short lease on their next contact
+func (p *PluginState) reconcileGrants(ctx context.Context) error {
+	kvc := p.kv()
+
+	p.grants.mu.Lock()
+	granted := make(map[string]grant, len(p.grants.granted))
+	now := time.Now()
+	for nic, g := range p.grants.granted {
+		if now.After(g.expires) {
+			delete(p.grants.granted, nic)
+			continue
+		}
+		granted[nic] = g
+	}
+	p.grants.mu.Unlock()
+
+	if len(granted) == 0 {
+		return nil
+	}
+
+	// a single read of all the leases, rather than one per grant
+	resp, err := kvc.Get(ctx, p.keys.LeasedNIC(""), etcd.WithPrefix())
+	if err != nil {
+		return errors.Wrap(err, "could not get current leases")
+	}
+	held := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		nic, err := p.keys.ParseLeasedNIC(string(kv.Key))
+		if err != nil {
+			continue
+		}
+		if ip, err := leasedIPOf(kv.Value); err == nil {
+			held[nic.String()] = ip
+		}
+	}
+
+	for nic, g := range granted {
+		if held[nic] == g.ip.String() {
+			continue
+		}
+
+		log.Warningf("lease of %s for nic %s is not held in etcd, shortening it on next contact",
+			g.ip, nic)
+
+		p.grants.mu.Lock()
+		// the nic may have been granted a new lease meanwhile
+		if current, ok := p.grants.granted[nic]; ok && current.ip.Equal(g.ip) {
+			delete(p.grants.granted, nic)
+			p.grants.contradicted[nic] = struct{}{}
+		}
+		p.grants.mu.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestReconcileGrants(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	nics := []net.HardwareAddr{testMAC(1), testMAC(2), testMAC(3)}
+	for _, nic := range nics {
+		lease(t, p, nic)
+	}
+
+	// etcd lost the lease of the second nic, eg. on the other side of a
+	// partition
+	lost := nics[1]
+	f.delete(p.keys.LeasedNIC(lost.String()))
+
+	before := f.served()
+	if err := p.reconcileGrants(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.served() - before; n != 1 {
+		t.Errorf("want the grants checked in a single request, got %d", n)
+	}
+
+	for _, nic := range nics {
+		want := nic.String() == lost.String()
+		if got := p.grants.takeContradicted(nic); got != want {
+			t.Errorf("want %s contradicted %v, got %v", nic, want, got)
+		}
+	}
+}
+
+func TestContradictedGrantIsShortened(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "ContradictedLeaseTime = 30s")
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+	f.delete(p.keys.LeasedNIC(nic.String()))
+	f.delete(p.keys.LeasedIP(ip))
+	f.put(p.keys.FreeIP(ip), ip.String())
+
+	if err := p.reconcileGrants(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := request(t, p, nic, ip)
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("want %s acked, got %v", ip, resp)
+	}
+	if got := resp.IPAddressLeaseTime(0); got != 30*time.Second {
+		t.Errorf("want a lease of 30s after a contradicted grant, got %s", got)
+	}
+}
@@ -0,0 +1,260 @@
+package etcdplugin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// keyspace builds and parses the plugin's etcd keys, laid out as
+// <prefix><sep><component><sep>..., e.g. prefix::ips::free::10.0.0.1. The
+// prefix is left out when an etcd namespace scopes the keys already
+type keyspace struct {
+	// the prefix followed by the separator, empty when namespaced
+	root string
+	sep  string
+}
+
+func newKeyspace(c Config) keyspace {
+	k := keyspace{sep: c.Separator}
+	if !c.Namespace {
+		k.root = c.Prefix + c.Separator
+	}
+	return k
+}
+
+// key joins parts under the root, a trailing empty part leaves a trailing
+// separator, making the key a prefix of the keys below it
+func (k keyspace) key(parts ...string) string {
+	return k.root + strings.Join(parts, k.sep)
+}
+
+// Root is the prefix of every key of the plugin
+func (k keyspace) Root() string {
+	return k.root
+}
+
+// Component returns the first part of key below the root, e.g. ips
+func (k keyspace) Component(key string) string {
+	component, _, _ := strings.Cut(strings.TrimPrefix(key, k.root), k.sep)
+	return component
+}
+
+// IP marks ip as being in state, with an empty ip it's the prefix of all
+// the ips in that state
+func (k keyspace) IP(state IPState, ip string) string {
+	return k.key("ips", string(state), ip)
+}
+
+// FreeIP marks ip as free
+func (k keyspace) FreeIP(ip net.IP) string {
+	return k.IP(IPStateFree, ip.String())
+}
+
+// LeasedIP marks ip as leased
+func (k keyspace) LeasedIP(ip net.IP) string {
+	return k.IP(IPStateLeased, ip.String())
+}
+
+// ParseIP returns the state and ip an ip key marks
+func (k keyspace) ParseIP(key string) (IPState, net.IP, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, k.root), k.sep, 3)
+	if !strings.HasPrefix(key, k.root) || len(parts) != 3 || parts[0] != "ips" {
+		return "", nil, fmt.Errorf("not an ip key: %s", key)
+	}
+
+	ip := net.ParseIP(parts[2])
+	if ip == nil {
+		return "", nil, fmt.Errorf("ip key %s holds an invalid ip", key)
+	}
+
+	return IPState(parts[1]), ip, nil
+}
+
+// IP6 marks the IPv6 address ip as being in state, with a nil ip it's the
+// prefix of all the IPv6 addresses in that state. Addresses are named by
+// their 32 hex digits, which hold no separator and sort in address order
+func (k keyspace) IP6(state IPState, ip net.IP) string {
+	if ip == nil {
+		return k.key("ips6", string(state), "")
+	}
+	return k.key("ips6", string(state), hex.EncodeToString(ip.To16()))
+}
+
+// ParseIP6 returns the state and IPv6 address an IPv6 key marks
+func (k keyspace) ParseIP6(key string) (IPState, net.IP, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, k.root), k.sep, 3)
+	if !strings.HasPrefix(key, k.root) || len(parts) != 3 || parts[0] != "ips6" {
+		return "", nil, fmt.Errorf("not an IPv6 key: %s", key)
+	}
+
+	ip, err := hex.DecodeString(parts[2])
+	if err != nil || len(ip) != net.IPv6len {
+		return "", nil, fmt.Errorf("IPv6 key %s holds an invalid address", key)
+	}
+
+	return IPState(parts[1]), net.IP(ip), nil
+}
+
+// LeasedDUID holds the IPv6 address leased to the identity association
+// iaid of the client duid, both hex encoded. With an empty iaid it's the
+// prefix of the leases of the client
+func (k keyspace) LeasedDUID(duid, iaid string) string {
+	return k.key("duids", "leased", duid, iaid)
+}
+
+// LeasedNIC holds the lease of nic, with an empty nic it's the prefix of
+// all leased nics
+func (k keyspace) LeasedNIC(nic string) string {
+	return k.key("nics", "leased", nic)
+}
+
+// ParseLeasedNIC returns the nic a leased nic key holds the lease of
+func (k keyspace) ParseLeasedNIC(key string) (net.HardwareAddr, error) {
+	prefix := k.LeasedNIC("")
+	if !strings.HasPrefix(key, prefix) {
+		return nil, fmt.Errorf("not a leased nic key: %s", key)
+	}
+
+	nic, err := net.ParseMAC(strings.TrimPrefix(key, prefix))
+	if err != nil {
+		return nil, errors.Wrapf(err, "leased nic key %s holds an invalid nic", key)
+	}
+
+	return nic, nil
+}
+
+// Hostname holds the hostname nic last sent
+func (k keyspace) Hostname(nic string) string {
+	return k.key("nics", "hostname", nic)
+}
+
+// Declines holds the times ip was declined within ProblemWindow
+func (k keyspace) Declines(ip string) string {
+	return k.key("declines", ip)
+}
+
+// Config holds the override of the setting name, with an empty name it's
+// the prefix of all overrides
+func (k keyspace) Config(name string) string {
+	return k.key("config", name)
+}
+
+// ParseConfig returns the name of the setting a config key overrides
+func (k keyspace) ParseConfig(key string) string {
+	return strings.TrimPrefix(key, k.Config(""))
+}
+
+// Paused holds the pause state, shared by every instance using the prefix
+func (k keyspace) Paused() string {
+	return k.key("admin", "paused")
+}
+
+// Heartbeat holds the instance active for the prefix, for as long as it
+// keeps it alive
+func (k keyspace) Heartbeat() string {
+	return k.key("instances", "active")
+}
+
+// Utilization holds the snapshot taken at t, the zero padded time keeps
+// the snapshots in chronological order, with a zero t it's the prefix of
+// all snapshots
+func (k keyspace) Utilization(t time.Time) string {
+	if t.IsZero() {
+		return k.key("stats", "utilization", "")
+	}
+	return k.key("stats", "utilization", fmt.Sprintf("%020d", t.UnixNano()))
+}
+
+// Malformed is where key is quarantined when its value is malformed
+func (k keyspace) Malformed(key string) string {
+	return k.key("malformed", strings.TrimPrefix(key, k.root))
+}
+
+// zoneKeyspace builds and parses the keys of the DNS records of a zone,
+// laid out as <prefix><sep><zone><sep><name><sep><type>
+type zoneKeyspace struct {
+	prefix string
+	zone   string
+	sep    string
+}
+
+// Zone is the prefix of every record of the zone
+func (z zoneKeyspace) Zone() string {
+	return z.prefix + z.sep + z.zone + z.sep
+}
+
+// addressType is the type of the address records resolving to ip, AAAA
+// for IPv6 and A for IPv4
+func addressType(ip net.IP) string {
+	if ip.To4() == nil {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// ARecord holds the A record of name, or is the prefix of its round-robin
+// members
+func (z zoneKeyspace) ARecord(name string) string {
+	return z.Zone() + name + z.sep + "A"
+}
+
+// AAAARecord holds the AAAA record of name, or is the prefix of its
+// round-robin members
+func (z zoneKeyspace) AAAARecord(name string) string {
+	return z.Zone() + name + z.sep + "AAAA"
+}
+
+// AddressRecord holds the A or AAAA record resolving name to ip, depending
+// on its family
+func (z zoneKeyspace) AddressRecord(name string, ip net.IP) string {
+	return z.Zone() + name + z.sep + addressType(ip)
+}
+
+// AddressRecordMember holds ip as a member of the round-robin name
+func (z zoneKeyspace) AddressRecordMember(name string, ip net.IP) string {
+	return z.AddressRecord(name, ip) + z.sep + ip.String()
+}
+
+// CNAMERecord holds the CNAME record of alias
+func (z zoneKeyspace) CNAMERecord(alias string) string {
+	return z.Zone() + alias + z.sep + "CNAME"
+}
+
+// ApexSOA holds the SOA record of the zone
+func (z zoneKeyspace) ApexSOA() string {
+	return z.Zone() + constZoneApex + z.sep + "SOA"
+}
+
+// ApexNS holds the NS record of nameserver ns, with an empty ns it's the
+// prefix of all of them
+func (z zoneKeyspace) ApexNS(ns string) string {
+	return z.Zone() + constZoneApex + z.sep + "NS" + z.sep + ns
+}
+
+// Owner holds the nic that claimed name
+func (z zoneKeyspace) Owner(name string) string {
+	return z.prefix + z.sep + "owners" + z.sep + z.zone + z.sep + name
+}
+
+// ParseRecord returns the name and type of a record key, along with what
+// follows them in the key of a round-robin member or an apex NS record
+func (z zoneKeyspace) ParseRecord(key string) (name, rtype, member string, err error) {
+	if !strings.HasPrefix(key, z.Zone()) {
+		return "", "", "", fmt.Errorf("not a record of zone %s: %s", z.zone, key)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, z.Zone()), z.sep, 3)
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], "", nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	default:
+		return "", "", "", fmt.Errorf("not a record key: %s", key)
+	}
+}
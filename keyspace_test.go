@@ -0,0 +1,110 @@
+package etcdplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKeyspaceRoundTrip(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 1).To4()
+	ip6 := net.ParseIP("2001:db8::1")
+	nics := []string{"02:00:00:00:00:01", "02:00:5e:10:00:00:00:01"}
+
+	for _, sep := range []string{"::", ":", "/", "."} {
+		for _, namespaced := range []bool{false, true} {
+			k := newKeyspace(Config{Prefix: "test", Separator: sep, Namespace: namespaced})
+			if namespaced != (k.Root() == "") {
+				t.Errorf("sep %q: want the prefix left out of the keys only when namespaced, got %q", sep, k.Root())
+			}
+
+			for _, state := range ipStates {
+				key := k.IP(state, ip.String())
+				gotState, got, err := k.ParseIP(key)
+				if err != nil || gotState != state || !got.Equal(ip) {
+					t.Errorf("sep %q: want %s parsed back to %s %s, got %s %s: %v", sep, key, state, ip, gotState, got, err)
+				}
+				if component := k.Component(key); component != "ips" {
+					t.Errorf("sep %q: want %s under ips, got %q", sep, key, component)
+				}
+
+				key = k.IP6(state, ip6)
+				gotState, got, err = k.ParseIP6(key)
+				if err != nil || gotState != state || !got.Equal(ip6) {
+					t.Errorf("sep %q: want %s parsed back to %s %s, got %s %s: %v", sep, key, state, ip6, gotState, got, err)
+				}
+			}
+			if k.FreeIP(ip) != k.IP(IPStateFree, ip.String()) || k.LeasedIP(ip) != k.IP(IPStateLeased, ip.String()) {
+				t.Errorf("sep %q: want FreeIP and LeasedIP to build the keys of IP", sep)
+			}
+			if !strings.HasPrefix(k.FreeIP(ip), k.IP(IPStateFree, "")) {
+				t.Errorf("sep %q: want %s below the prefix of free ips", sep, k.FreeIP(ip))
+			}
+
+			for _, nic := range nics {
+				key := k.LeasedNIC(nic)
+				got, err := k.ParseLeasedNIC(key)
+				if err != nil || got.String() != nic {
+					t.Errorf("sep %q: want %s parsed back to %s, got %s: %v", sep, key, nic, got, err)
+				}
+			}
+
+			if name := k.ParseConfig(k.Config("LeaseTime")); name != "LeaseTime" {
+				t.Errorf("sep %q: want the config key parsed back to LeaseTime, got %q", sep, name)
+			}
+
+			// keys of one kind don't parse as another
+			if _, _, err := k.ParseIP(k.LeasedNIC(nics[0])); err == nil {
+				t.Errorf("sep %q: want a nic key refused as an ip key", sep)
+			}
+			if _, _, err := k.ParseIP(k.IP(IPStateFree, "not-an-ip")); err == nil {
+				t.Errorf("sep %q: want an ip key of an invalid ip refused", sep)
+			}
+			if _, _, err := k.ParseIP6(k.IP(IPStateFree, ip.String())); err == nil {
+				t.Errorf("sep %q: want an IPv4 key refused as an IPv6 key", sep)
+			}
+			if _, err := k.ParseLeasedNIC(k.FreeIP(ip)); err == nil {
+				t.Errorf("sep %q: want an ip key refused as a nic key", sep)
+			}
+			if _, err := k.ParseLeasedNIC(k.LeasedNIC("not-a-mac")); err == nil {
+				t.Errorf("sep %q: want a nic key of an invalid nic refused", sep)
+			}
+		}
+	}
+}
+
+func TestZoneKeyspaceRoundTrip(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 1).To4()
+	ip6 := net.ParseIP("2001:db8::1")
+
+	for _, sep := range []string{"::", "/", "."} {
+		z := zoneKeyspace{prefix: "dns", zone: "example", sep: sep}
+
+		for _, tt := range []struct {
+			key                 string
+			name, rtype, member string
+		}{
+			{z.ARecord("host"), "host", "A", ""},
+			{z.AAAARecord("host"), "host", "AAAA", ""},
+			{z.AddressRecord("host", ip), "host", "A", ""},
+			{z.AddressRecord("host", ip6), "host", "AAAA", ""},
+			{z.AddressRecordMember("host", ip), "host", "A", ip.String()},
+			{z.CNAMERecord("alias"), "alias", "CNAME", ""},
+			{z.ApexSOA(), constZoneApex, "SOA", ""},
+			{z.ApexNS("ns1"), constZoneApex, "NS", "ns1"},
+		} {
+			name, rtype, member, err := z.ParseRecord(tt.key)
+			if err != nil || name != tt.name || rtype != tt.rtype || member != tt.member {
+				t.Errorf("sep %q: want %s parsed back to %q %q %q, got %q %q %q: %v",
+					sep, tt.key, tt.name, tt.rtype, tt.member, name, rtype, member, err)
+			}
+		}
+
+		if _, _, _, err := z.ParseRecord(z.Owner("host")); err == nil {
+			t.Errorf("sep %q: want an owner key refused as a record key", sep)
+		}
+		if _, _, _, err := z.ParseRecord(z.Zone() + "host"); err == nil {
+			t.Errorf("sep %q: want a key without a type refused as a record key", sep)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// LeaseRecord is a lease currently held by a nic. The hostname and the
+// grant and expiry times are only known for lease values of version 3 on
+type LeaseRecord struct {
+	IP       net.IP    `json:"ip"`
+	MAC      string    `json:"mac"`
+	Hostname string    `json:"hostname,omitempty"`
+	Granted  time.Time `json:"granted"`
+	Expires  time.Time `json:"expires"`
+	// seconds left of the lease, by its expiry when the value records it,
+	// by the etcd lease holding its keys otherwise
+	TTL int64 `json:"ttl"`
+}
+
+// Leases returns the leases currently held, in the order of their ips'
+// keys. The etcd leases are only asked for the time they have left when
+// the values don't record their expiry, once per etcd lease
+func (p *PluginState) Leases(ctx context.Context) ([]LeaseRecord, error) {
+	resp, err := p.kv().Get(ctx, p.keys.IP(IPStateLeased, ""), etcd.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list leased ips")
+	}
+
+	leases := make([]LeaseRecord, 0, len(resp.Kvs))
+	// seconds left of the etcd leases asked for, by id
+	ttls := make(map[int64]int64)
+	for _, kv := range resp.Kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err != nil {
+			log.Warningf("ignoring key: %v", err)
+			continue
+		}
+
+		value, err := decodeLeaseValue(kv.Value, false)
+		if err != nil {
+			p.malformed(ctx, kv, err)
+			continue
+		}
+
+		meta := value.metadata()
+		record := LeaseRecord{
+			IP:       ip,
+			MAC:      value.MAC,
+			Hostname: meta.hostname,
+			Granted:  meta.granted,
+			Expires:  meta.expires,
+		}
+
+		switch {
+		case !meta.expires.IsZero():
+			if left := time.Until(meta.expires); left > 0 {
+				record.TTL = int64((left + time.Second - 1) / time.Second)
+			}
+		case kv.Lease != 0:
+			left, ok := ttls[kv.Lease]
+			if !ok {
+				resp, err := p.lease().TimeToLive(ctx, etcd.LeaseID(kv.Lease))
+				if err != nil {
+					return nil, errors.Wrapf(err, "could not get the time to live of the lease of %s", ip)
+				}
+				// the etcd lease may have expired since the keys were listed
+				if resp.TTL > 0 {
+					left = resp.TTL
+				}
+				ttls[kv.Lease] = left
+			}
+			record.TTL = left
+		}
+
+		leases = append(leases, record)
+	}
+
+	return leases, nil
+}
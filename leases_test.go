@@ -0,0 +1,103 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+func TestLeasesListsFields(t *testing.T) {
+	for _, version := range []string{"1", "3"} {
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f, "LeaseValueVersion = "+version, "LeaseTime = 1h")
+
+		want := make(map[string]LeaseRecord)
+		for n, hostname := range []string{"alpha", "beta"} {
+			nic := testMAC(byte(n + 1))
+			ip := discover(t, p, nic)
+			resp := request(t, p, nic, ip, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+			if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+				t.Fatalf("version %s: %s was not acked %s: %v", version, nic, ip, resp)
+			}
+			want[ip.String()] = LeaseRecord{IP: ip, MAC: nic.String(), Hostname: hostname}
+		}
+
+		queries := f.ttlServed()
+		leases, err := p.Leases(context.Background())
+		if err != nil {
+			t.Fatalf("version %s: could not list leases: %v", version, err)
+		}
+		if len(leases) != len(want) {
+			t.Fatalf("version %s: want %d leases, got %+v", version, len(want), leases)
+		}
+		for _, got := range leases {
+			w, ok := want[got.IP.String()]
+			if !ok || got.MAC != w.MAC {
+				t.Errorf("version %s: want the leases of %v, got %+v", version, want, got)
+				continue
+			}
+			if got.TTL <= 0 || got.TTL > int64(time.Hour/time.Second) {
+				t.Errorf("version %s: want %s to have up to an hour left, got %ds", version, got.IP, got.TTL)
+			}
+			if version == "1" {
+				// v1 values only hold the mac
+				continue
+			}
+			if got.Hostname != w.Hostname {
+				t.Errorf("version %s: want %s named %q, got %q", version, got.IP, w.Hostname, got.Hostname)
+			}
+			if got.Granted.IsZero() || got.Expires.Sub(got.Granted) != time.Hour {
+				t.Errorf("version %s: want %s granted for an hour, got %s to %s", version, got.IP, got.Granted, got.Expires)
+			}
+		}
+
+		// the time left is read from the values that record their expiry,
+		// and asked to etcd once per lease otherwise
+		wantQueries := len(want)
+		if version == "3" {
+			wantQueries = 0
+		}
+		if got := f.ttlServed() - queries; got != wantQueries {
+			t.Errorf("version %s: want %d time to live requests, got %d", version, wantQueries, got)
+		}
+	}
+}
+
+func TestLeasesAsksSharedLeaseOnce(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	ctx := context.Background()
+	grant, err := p.lease().Grant(ctx, 600)
+	if err != nil {
+		t.Fatalf("could not grant lease: %v", err)
+	}
+	for n := byte(1); n <= 3; n++ {
+		ip := net.IPv4(10, 0, 0, n).To4()
+		f.delete(p.keys.FreeIP(ip))
+		if _, err := p.kv().Put(ctx, p.keys.LeasedIP(ip), testMAC(n).String(), etcd.WithLease(grant.ID)); err != nil {
+			t.Fatalf("could not lease %s: %v", ip, err)
+		}
+	}
+
+	queries := f.ttlServed()
+	leases, err := p.Leases(ctx)
+	if err != nil {
+		t.Fatalf("could not list leases: %v", err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("want 3 leases, got %+v", leases)
+	}
+	for _, got := range leases {
+		if got.TTL != 600 {
+			t.Errorf("want %s to have 600s left, got %d", got.IP, got.TTL)
+		}
+	}
+	if got := f.ttlServed() - queries; got != 1 {
+		t.Errorf("want the shared lease asked for once, got %d requests", got)
+	}
+}
@@ -0,0 +1,291 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcd "go.etcd.io/etcd/client/v3"
+	etcdutil "go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+// Lease value schema versions. Version 1 values are plain strings, the nic
+// key holds the ip and the ip key holds the nic. Later versions are JSON
+// objects carrying their version, stored under both keys, so values of any
+// version can be told apart and read during a rolling upgrade. Version 3
+// adds the client's hostname and when the lease was granted and expires
+const (
+	LeaseValueV1 = 1
+	LeaseValueV2 = 2
+	LeaseValueV3 = 3
+
+	constDefaultLeaseValueVersion = LeaseValueV1
+)
+
+// LeaseValue is the decoded value of a leased nic or ip key, the metadata
+// is only known for values of version 3 on
+type LeaseValue struct {
+	Version  int    `json:"v"`
+	IP       string `json:"ip"`
+	MAC      string `json:"mac"`
+	Hostname string `json:"hostname,omitempty"`
+	// unix times the lease was granted at and expires at
+	Granted int64 `json:"granted,omitempty"`
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// leaseMetadata is what a lease value records about a lease beyond the ip
+// and nic it binds
+type leaseMetadata struct {
+	hostname         string
+	granted, expires time.Time
+}
+
+// newLeaseMetadata describes a lease of ttl granted now to a client going
+// by hostname
+func newLeaseMetadata(hostname string, ttl time.Duration) leaseMetadata {
+	now := time.Now()
+	return leaseMetadata{hostname: hostname, granted: now, expires: now.Add(ttl)}
+}
+
+// metadata returns what the value records about its lease
+func (v LeaseValue) metadata() leaseMetadata {
+	var meta leaseMetadata
+	meta.hostname = v.Hostname
+	if v.Granted > 0 {
+		meta.granted = time.Unix(v.Granted, 0)
+	}
+	if v.Expires > 0 {
+		meta.expires = time.Unix(v.Expires, 0)
+	}
+	return meta
+}
+
+// encodeLeaseValues returns the values to store under the leased nic and
+// leased ip keys
+func (p *PluginState) encodeLeaseValues(ip net.IP, nic net.HardwareAddr, meta leaseMetadata) (string, string) {
+	if p.config.LeaseValueVersion < LeaseValueV2 {
+		return ip.String(), nic.String()
+	}
+
+	value := LeaseValue{
+		Version: p.config.LeaseValueVersion,
+		IP:      ip.String(),
+		MAC:     nic.String(),
+	}
+	if p.config.LeaseValueVersion >= LeaseValueV3 {
+		value.Hostname = meta.hostname
+		if !meta.granted.IsZero() {
+			value.Granted = meta.granted.Unix()
+		}
+		if !meta.expires.IsZero() {
+			value.Expires = meta.expires.Unix()
+		}
+	}
+	encoded, _ := json.Marshal(value)
+
+	return string(encoded), string(encoded)
+}
+
+// decodeLeaseValue decodes the value of a leased key in any version, nicKey
+// tells which of the keys a version 1 value was read from
+func decodeLeaseValue(raw []byte, nicKey bool) (LeaseValue, error) {
+	var value LeaseValue
+	switch {
+	case len(raw) > 0 && raw[0] == '{':
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return LeaseValue{}, errors.Wrapf(ErrMalformedValue, "lease value: %v", err)
+		}
+		if value.Version < LeaseValueV2 {
+			return LeaseValue{}, fmt.Errorf("unsupported lease value version %d", value.Version)
+		}
+	case nicKey:
+		value = LeaseValue{Version: LeaseValueV1, IP: string(raw)}
+	default:
+		value = LeaseValue{Version: LeaseValueV1, MAC: string(raw)}
+	}
+
+	// only the half the key is read for matters
+	if nicKey && net.ParseIP(value.IP).To4() == nil {
+		return LeaseValue{}, errors.Wrapf(ErrMalformedValue, "lease value %q holds no ip", raw)
+	}
+	if _, err := net.ParseMAC(value.MAC); !nicKey && err != nil {
+		return LeaseValue{}, errors.Wrapf(ErrMalformedValue, "lease value %q holds no nic", raw)
+	}
+
+	return value, nil
+}
+
+// FreeValue is the decoded value of a free ip key, plain ip values written
+// without metadata decode with only the ip set
+type FreeValue struct {
+	IP string `json:"ip"`
+	// unix time the ip was freed at
+	Freed int64 `json:"freed,omitempty"`
+	// the nic that held the ip before it was freed, if known
+	MAC string `json:"mac,omitempty"`
+}
+
+// encodeFreeValue returns the value to store under a free ip key, carrying
+// when and from which nic it was freed if configured to
+func (p *PluginState) encodeFreeValue(ip net.IP, nic net.HardwareAddr) string {
+	if !p.config.FreeValueMetadata {
+		return ip.String()
+	}
+
+	value := FreeValue{
+		IP:    ip.String(),
+		Freed: time.Now().Unix(),
+	}
+	if nic != nil {
+		value.MAC = nic.String()
+	}
+	encoded, _ := json.Marshal(value)
+
+	return string(encoded)
+}
+
+// decodeFreeValue decodes the value of a free ip key, with or without
+// metadata
+func decodeFreeValue(raw []byte) (FreeValue, error) {
+	value := FreeValue{IP: string(raw)}
+	if len(raw) > 0 && raw[0] == '{' {
+		value = FreeValue{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return FreeValue{}, errors.Wrapf(ErrMalformedValue, "free value: %v", err)
+		}
+	}
+
+	if net.ParseIP(value.IP).To4() == nil {
+		return FreeValue{}, errors.Wrapf(ErrMalformedValue, "free value %q holds no ip", raw)
+	}
+
+	return value, nil
+}
+
+// malformed reports a key whose value failed to decode, and moves it aside
+// under the malformed prefix for an operator to review if configured to.
+// The key is only moved if it did not change since it was read
+func (p *PluginState) malformed(ctx context.Context, kv *mvccpb.KeyValue, err error) {
+	if !errors.Is(err, ErrMalformedValue) {
+		return
+	}
+
+	log.Errorf("key %s holds a malformed value %q: %v", kv.Key, kv.Value, err)
+	if !p.config.QuarantineMalformed {
+		return
+	}
+
+	quarantineKey := p.keys.Malformed(string(kv.Key))
+
+	resp, err := p.kv().Txn(ctx).
+		If(etcd.Compare(etcd.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+		Then(
+			etcd.OpPut(quarantineKey, string(kv.Value)),
+			etcd.OpDelete(string(kv.Key)),
+		).Commit()
+	if err != nil {
+		log.Errorf("could not quarantine malformed key %s: %v", kv.Key, err)
+		return
+	}
+	if resp.Succeeded {
+		log.Warningf("moved malformed key %s to %s", kv.Key, quarantineKey)
+	}
+}
+
+// leasedIPOf decodes the ip held in a leased nic key's value
+func leasedIPOf(raw []byte) (string, error) {
+	value, err := decodeLeaseValue(raw, true)
+	return value.IP, err
+}
+
+// leasedNicOf decodes the nic held in a leased ip key's value
+func leasedNicOf(raw []byte) (string, error) {
+	value, err := decodeLeaseValue(raw, false)
+	return value.MAC, err
+}
+
+// MigrateLeaseValues rewrites the leased keys holding values of another
+// version into the configured one, keeping their etcd leases
+func (p *PluginState) MigrateLeaseValues(ctx context.Context) (int, error) {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.LeasedNIC(""), etcd.WithPrefix())
+	if err != nil {
+		return 0, errors.Wrap(err, "could not list leased nics")
+	}
+
+	migrated := 0
+	for _, kv := range resp.Kvs {
+		value, err := decodeLeaseValue(kv.Value, true)
+		if err != nil {
+			log.Warningf("not migrating %s: %v", kv.Key, err)
+			continue
+		}
+		if value.Version == p.config.LeaseValueVersion {
+			continue
+		}
+
+		nic, err := p.keys.ParseLeasedNIC(string(kv.Key))
+		if err != nil {
+			log.Warningf("not migrating %s: %v", kv.Key, err)
+			continue
+		}
+		ip := net.ParseIP(value.IP)
+
+		leasedIPKey := p.keys.LeasedIP(ip)
+
+		nicValue, ipValue := p.encodeLeaseValues(ip, nic, value.metadata())
+
+		res, err := kvc.Txn(ctx).If(
+			etcd.Compare(etcd.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+			etcdutil.KeyExists(leasedIPKey),
+		).Then(
+			etcd.OpPut(string(kv.Key), nicValue, etcd.WithIgnoreLease()),
+			etcd.OpPut(leasedIPKey, ipValue, etcd.WithIgnoreLease()),
+		).Commit()
+		if err != nil {
+			return migrated, errors.Wrap(err, "could not migrate lease value")
+		}
+		if res.Succeeded {
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// leaseRevisions returns the revisions of a nic's and ip's leased keys if
+// they're bound to each other, whatever the version of their values, or -1
+// so that comparing against them fails
+func leaseRevisions(ctx context.Context, kvc etcd.KV, leasedNicKey, leasedIPKey string,
+	ip net.IP, nic net.HardwareAddr) (int64, int64, error) {
+	res, err := kvc.Txn(ctx).Then(
+		etcd.OpGet(leasedNicKey),
+		etcd.OpGet(leasedIPKey),
+	).Commit()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "could not get current lease")
+	}
+
+	nicKvs := res.Responses[0].GetResponseRange().Kvs
+	ipKvs := res.Responses[1].GetResponseRange().Kvs
+	if len(nicKvs) == 0 || len(ipKvs) == 0 {
+		return -1, -1, nil
+	}
+
+	leasedIP, err := leasedIPOf(nicKvs[0].Value)
+	if err != nil || leasedIP != ip.String() {
+		return -1, -1, nil
+	}
+	leasedNic, err := leasedNicOf(ipKvs[0].Value)
+	if err != nil || leasedNic != nic.String() {
+		return -1, -1, nil
+	}
+
+	return nicKvs[0].ModRevision, ipKvs[0].ModRevision, nil
+}
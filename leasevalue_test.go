@@ -0,0 +1,113 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDecodeLeaseValueVersions(t *testing.T) {
+	for _, tt := range []struct {
+		raw    string
+		nicKey bool
+		want   LeaseValue
+		err    bool
+	}{
+		{raw: "10.0.0.1", nicKey: true, want: LeaseValue{Version: LeaseValueV1, IP: "10.0.0.1"}},
+		{raw: "02:00:00:00:00:01", want: LeaseValue{Version: LeaseValueV1, MAC: "02:00:00:00:00:01"}},
+		{
+			raw:    `{"v":2,"ip":"10.0.0.1","mac":"02:00:00:00:00:01"}`,
+			nicKey: true,
+			want:   LeaseValue{Version: LeaseValueV2, IP: "10.0.0.1", MAC: "02:00:00:00:00:01"},
+		},
+		{
+			raw:  `{"v":2,"ip":"10.0.0.1","mac":"02:00:00:00:00:01"}`,
+			want: LeaseValue{Version: LeaseValueV2, IP: "10.0.0.1", MAC: "02:00:00:00:00:01"},
+		},
+		{raw: `{"v":1,"ip":"10.0.0.1"}`, nicKey: true, err: true},
+		{raw: `{"v":2,"ip":`, nicKey: true, err: true},
+		{raw: "not-an-ip", nicKey: true, err: true},
+		{raw: `{"v":2,"ip":"10.0.0.1"}`, err: true},
+	} {
+		got, err := decodeLeaseValue([]byte(tt.raw), tt.nicKey)
+		if tt.err != (err != nil) {
+			t.Errorf("%s (nic key %t): want error %t, got %v", tt.raw, tt.nicKey, tt.err, err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%s (nic key %t): want %+v, got %+v", tt.raw, tt.nicKey, tt.want, got)
+		}
+	}
+}
+
+func TestLeaseValuesOfMixedVersionsRead(t *testing.T) {
+	f := newFakeEtcd()
+	v1 := newTestPlugin(t, f, "LeaseValueVersion = 1")
+	v2 := newTestPlugin(t, f, "LeaseValueVersion = 2")
+	ctx := context.Background()
+
+	// a fleet half way through an upgrade
+	oldNic, newNic := testMAC(1), testMAC(2)
+	oldIP, newIP := lease(t, v1, oldNic), lease(t, v2, newNic)
+	if value, _ := f.get(v1.keys.LeasedNIC(oldNic.String())); value != oldIP.String() {
+		t.Fatalf("want a v1 value for %s, got %q", oldNic, value)
+	}
+	if value, _ := f.get(v2.keys.LeasedNIC(newNic.String())); value == newIP.String() {
+		t.Fatalf("want a v2 value for %s, got %q", newNic, value)
+	}
+
+	// either instance reads both
+	for _, p := range []*PluginState{v1, v2} {
+		for nic, want := range map[string]net.IP{oldNic.String(): oldIP, newNic.String(): newIP} {
+			mac, _ := net.ParseMAC(nic)
+			got, err := p.nicLeasedIP(ctx, mac)
+			if err != nil || !got.Equal(want) {
+				t.Errorf("version %d: want %s leasing %s, got %s: %v", p.config.LeaseValueVersion, nic, want, got, err)
+			}
+		}
+
+		leases, err := p.Leases(ctx)
+		if err != nil {
+			t.Fatalf("version %d: could not list leases: %v", p.config.LeaseValueVersion, err)
+		}
+		if len(leases) != 2 {
+			t.Errorf("version %d: want both leases listed, got %+v", p.config.LeaseValueVersion, leases)
+		}
+	}
+
+	// and revokes either
+	if err := v2.revokeLease(ctx, oldNic); err != nil {
+		t.Errorf("could not revoke the v1 lease of %s: %v", oldNic, err)
+	}
+	if err := v1.revokeLease(ctx, newNic); err != nil {
+		t.Errorf("could not revoke the v2 lease of %s: %v", newNic, err)
+	}
+	for _, nic := range []net.HardwareAddr{oldNic, newNic} {
+		if err := v1.revokeLease(ctx, nic); !errors.Is(err, ErrNoLease) {
+			t.Errorf("want %s to hold no lease, got %v", nic, err)
+		}
+	}
+}
+
+func TestMigrateLeaseValues(t *testing.T) {
+	f := newFakeEtcd()
+	v1 := newTestPlugin(t, f, "LeaseValueVersion = 1")
+	nic := testMAC(1)
+	ip := lease(t, v1, nic)
+
+	v2 := newTestPlugin(t, f, "LeaseValueVersion = 2")
+	migrated, err := v2.MigrateLeaseValues(context.Background())
+	if err != nil || migrated != 1 {
+		t.Fatalf("want the v1 lease migrated, got %d: %v", migrated, err)
+	}
+
+	for key, nicKey := range map[string]bool{v2.keys.LeasedNIC(nic.String()): true, v2.keys.LeasedIP(ip): false} {
+		value, _ := f.get(key)
+		decoded, err := decodeLeaseValue([]byte(value), nicKey)
+		if err != nil || decoded.Version != LeaseValueV2 || decoded.IP != ip.String() || decoded.MAC != nic.String() {
+			t.Errorf("want %s holding a v2 value, got %q: %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package etcdplugin
+
+import (
+	"net"
+	"sync"
+)
+
+// nicLock serializes the packets of a single nic
+type nicLock struct {
+	sync.Mutex
+	// packets holding or waiting on the lock
+	refs int
+}
+
+// nicLocks hands out a lock per nic, so that the packets of a client are
+// handled one at a time while different clients are handled concurrently,
+// etcd transactions keep them from allocating the same ip
+type nicLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nicLock
+}
+
+func newNicLocks() *nicLocks {
+	return &nicLocks{
+		locks: make(map[string]*nicLock),
+	}
+}
+
+// lock takes the lock of nic, the returned func releases it
+func (l *nicLocks) lock(nic net.HardwareAddr) func() {
+	return l.lockKey(nic.String())
+}
+
+// lockKey takes the lock of the client key identifies, e.g. by its DUID,
+// the returned func releases it
+func (l *nicLocks) lockKey(key string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &nicLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		// forget nics nobody is waiting on
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// claims are the free ips this instance is in the middle of offering, so
+// that concurrent DISCOVERs look past them instead of racing for the same
+// one
+type claims struct {
+	mu  sync.Mutex
+	ips map[string]struct{}
+}
+
+func newClaims() *claims {
+	return &claims{
+		ips: make(map[string]struct{}),
+	}
+}
+
+// claim marks ip as being offered, reporting false if it already was
+func (c *claims) claim(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.ips[ip.String()]; ok {
+		return false
+	}
+	c.ips[ip.String()] = struct{}{}
+
+	return true
+}
+
+// release forgets the claim on ip
+func (c *claims) release(ip net.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.ips, ip.String())
+}
+
+// claimed reports whether ip is being offered
+func (c *claims) claimed(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.ips[ip]
+	return ok
+}
+
+// all returns the ips being offered
+func (c *claims) all() []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ips := make([]net.IP, 0, len(c.ips))
+	for ip := range c.ips {
+		ips = append(ips, net.ParseIP(ip))
+	}
+
+	return ips
+}
@@ -0,0 +1,156 @@
+package etcdplugin
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// benchmarkClients is how many clients renew their leases concurrently in
+// the locking benchmarks
+const benchmarkClients = 64
+
+// benchmarkRenewals has benchmarkClients clients lease an ip of p, then
+// renew them concurrently through handle with every etcd request taking a
+// millisecond, the way a nearby cluster would
+func benchmarkRenewals(b *testing.B, f *fakeEtcd, p *PluginState, handle func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)) {
+	nics := make([]net.HardwareAddr, benchmarkClients)
+	ips := make([]net.IP, benchmarkClients)
+	for i := range nics {
+		nics[i] = testMAC(byte(i))
+		ips[i] = lease(b, p, nics[i])
+	}
+
+	f.setLatency(time.Millisecond)
+	defer f.setLatency(0)
+
+	var next atomic.Int64
+	b.SetParallelism(benchmarkClients)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(next.Add(1) % benchmarkClients)
+			req, err := dhcpv4.New(
+				dhcpv4.WithHwAddr(nics[i]),
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+				dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ips[i])),
+			)
+			if err != nil {
+				b.Errorf("could not build request: %v", err)
+				return
+			}
+			resp, err := dhcpv4.NewReplyFromRequest(req,
+				dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+				dhcpv4.WithMessageType(dhcpv4.MessageTypeAck))
+			if err != nil {
+				b.Errorf("could not build reply: %v", err)
+				return
+			}
+
+			if reply, _ := handle(req, resp); reply == nil || reply.MessageType() != dhcpv4.MessageTypeAck {
+				b.Errorf("want %s acked %s, got %v", nics[i], ips[i], reply)
+				return
+			}
+		}
+	})
+}
+
+func TestConcurrentClientsLeaseDistinctIPs(t *testing.T) {
+	for _, serialize := range []bool{false, true} {
+		f := newFakeEtcd()
+		// two instances sharing the pool, racing each other as well
+		lines := []string{"End = 10.0.0.254", "SerializeLeases = " + strconv.FormatBool(serialize)}
+		instances := []*PluginState{newTestPlugin(t, f, lines...), newTestPlugin(t, f, lines...)}
+		f.setLatency(time.Millisecond)
+
+		var wg sync.WaitGroup
+		for i := 0; i < benchmarkClients; i++ {
+			nic := testMAC(byte(i))
+			// every client is handled by both instances at once, the way a
+			// broadcast reaching both would be, the last ack wins. Losing
+			// the race for an ip drops the packet, the client then retries
+			for _, p := range instances {
+				wg.Add(1)
+				go func(p *PluginState) {
+					defer wg.Done()
+
+					for attempt := 0; attempt < 10; attempt++ {
+						ip := discover(t, p, nic)
+						if ip == nil {
+							continue
+						}
+						if resp := request(t, p, nic, ip); resp != nil && resp.MessageType() == dhcpv4.MessageTypeAck {
+							return
+						}
+					}
+				}(p)
+			}
+		}
+		wg.Wait()
+		f.setLatency(0)
+
+		// every client leases an ip of its own, and every leased ip points
+		// back at the client leasing it
+		leased := make(map[string]string)
+		for i := 0; i < benchmarkClients; i++ {
+			nic := testMAC(byte(i))
+			ip := leasedTo(t, f, instances[0], nic)
+			if ip == "" {
+				t.Errorf("serialize=%t: want %s leasing an ip", serialize, nic)
+				continue
+			}
+			if other, ok := leased[ip]; ok {
+				t.Errorf("serialize=%t: want %s leased once, got it leased to %s and %s", serialize, ip, other, nic)
+			}
+			leased[ip] = nic.String()
+
+			value, _ := f.get(instances[0].keys.LeasedIP(net.ParseIP(ip)))
+			if owner, err := leasedNicOf([]byte(value)); err != nil || owner != nic.String() {
+				t.Errorf("serialize=%t: want %s leased to %s, got %q: %v", serialize, ip, nic, owner, err)
+			}
+			if _, ok := f.get(instances[0].keys.FreeIP(net.ParseIP(ip))); ok {
+				t.Errorf("serialize=%t: want the leased %s not free", serialize, ip)
+			}
+		}
+		if ips := f.keys(instances[0].keys.IP(IPStateLeased, "")); len(ips) != benchmarkClients {
+			t.Errorf("serialize=%t: want an ip leased per client, got %d", serialize, len(ips))
+		}
+	}
+}
+
+// BenchmarkHandler4Locking compares renewing leases serialized by a global
+// mutex, the way the plugin used to, with the per nic locks and with the
+// lease queue of SerializeLeases
+func BenchmarkHandler4Locking(b *testing.B) {
+	b.Run("global-mutex", func(b *testing.B) {
+		f := newFakeEtcd()
+		p := newTestPlugin(b, f, "End = 10.0.0.254")
+
+		var mu sync.Mutex
+		benchmarkRenewals(b, f, p, func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			return p.Handler4(req, resp)
+		})
+	})
+
+	b.Run("nic-locks", func(b *testing.B) {
+		f := newFakeEtcd()
+		p := newTestPlugin(b, f, "End = 10.0.0.254")
+
+		benchmarkRenewals(b, f, p, p.Handler4)
+	})
+
+	b.Run("queue", func(b *testing.B) {
+		f := newFakeEtcd()
+		p := newTestPlugin(b, f, "End = 10.0.0.254", "SerializeLeases = true")
+
+		benchmarkRenewals(b, f, p, p.Handler4)
+	})
+}
@@ -0,0 +1,25 @@
+package etcdplugin
+
+import "expvar"
+
+// metrics exported through expvar, and served by the admin API on /metrics
+var (
+	metricPacketsShed = expvar.NewInt("etcd_dhcp_packets_shed_total")
+	metricPaused      = expvar.NewInt("etcd_dhcp_paused")
+	// whether the instance is standing by for the active one
+	metricStandby = expvar.NewInt("etcd_dhcp_standby")
+	// expired leases moved back to free by the monitor
+	metricLeasesReclaimed = expvar.NewInt("etcd_dhcp_leases_reclaimed_total")
+	// whether etcd is rejecting requests as overloaded
+	metricEtcdOverloaded = expvar.NewInt("etcd_dhcp_etcd_overloaded")
+	// size of the largest run of consecutive free ips, and how fragmented
+	// the free pool is from 0 to 1, as of the monitor's last sweep
+	metricFreeLargestBlock  = expvar.NewInt("etcd_dhcp_free_largest_block")
+	metricFreeFragmentation = expvar.NewFloat("etcd_dhcp_free_fragmentation")
+	// etcd leases held by DNS records
+	metricDNSLeases = expvar.NewInt("etcd_dhcp_dns_leases")
+	// lease events that could not be queued or published
+	metricEventsDropped = expvar.NewInt("etcd_dhcp_events_dropped_total")
+	// DISCOVERs the free ip cache could not serve, scanning etcd instead
+	metricFreeCacheMisses = expvar.NewInt("etcd_dhcp_free_cache_misses_total")
+)
@@ -0,0 +1,146 @@
+package etcdplugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// natsPublisher publishes to a NATS subject, speaking the core NATS text
+// protocol. It's used from a single goroutine and connects on demand
+type natsPublisher struct {
+	addr     string
+	subject  string
+	user     string
+	password string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSPublisher(addr, subject, user, password string) *natsPublisher {
+	return &natsPublisher{
+		addr:     addr,
+		subject:  subject,
+		user:     user,
+		password: password,
+	}
+}
+
+// connect opens a connection and authenticates, a PING confirms the server
+// accepted the CONNECT
+func (n *natsPublisher) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to NATS server %s", n.addr)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "could not read NATS server info")
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS server greeting: %s", strings.TrimSpace(info))
+	}
+
+	connect, err := json.Marshal(struct {
+		Verbose  bool   `json:"verbose"`
+		Pedantic bool   `json:"pedantic"`
+		Name     string `json:"name"`
+		User     string `json:"user,omitempty"`
+		Pass     string `json:"pass,omitempty"`
+	}{
+		Name: "coredhcp-etcd",
+		User: n.user,
+		Pass: n.password,
+	})
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "could not encode NATS connect")
+	}
+
+	n.conn, n.r = conn, r
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		n.Close()
+		return errors.Wrap(err, "could not send NATS connect")
+	}
+	if err := n.pong(); err != nil {
+		n.Close()
+		return errors.WithMessage(err, "NATS server refused connect")
+	}
+
+	log.Infof("connected to NATS server %s", n.addr)
+
+	return nil
+}
+
+// pong waits for the server to answer a PING, answering its own PINGs in
+// the meantime
+func (n *natsPublisher) pong() error {
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return errors.Wrap(err, "could not read from NATS server")
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return errors.Wrap(err, "could not answer NATS server")
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(strings.TrimSpace(line))
+		}
+	}
+}
+
+// Publish sends event to the subject, waiting for the server to have
+// processed it so that errors surface
+func (n *natsPublisher) Publish(ctx context.Context, event []byte) error {
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	// no deadline clears the previous one
+	deadline, _ := ctx.Deadline()
+	n.conn.SetDeadline(deadline)
+
+	_, err := fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\nPING\r\n", n.subject, len(event), event)
+	if err == nil {
+		err = n.pong()
+	}
+	if err != nil {
+		// reconnect on the next event
+		n.Close()
+		return errors.WithMessage(err, "could not publish to NATS")
+	}
+
+	return nil
+}
+
+// Close closes the connection, if any
+func (n *natsPublisher) Close() error {
+	if n.conn == nil {
+		return nil
+	}
+
+	err := n.conn.Close()
+	n.conn, n.r = nil, nil
+	return err
+}
@@ -0,0 +1,234 @@
+package etcdplugin
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// web proxy auto-discovery, a private use option without a name in dhcpv4
+const optionWPAD = dhcpv4.GenericOptionCode(252)
+
+// POSIX TZ string, eg. EST5EDT,M3.2.0,M11.1.0
+var posixTZRegexp = regexp.MustCompile(`^([A-Za-z]{3,}|<[A-Za-z0-9+-]{3,}>)[+-]?\d{1,2}(:\d{2}){0,2}` +
+	`(([A-Za-z]{3,}|<[A-Za-z0-9+-]{3,}>)([+-]?\d{1,2}(:\d{2}){0,2})?(,[^,]+,[^,]+)?)?$`)
+
+// tz database name, eg. Europe/Lisbon
+var tzDatabaseRegexp = regexp.MustCompile(`^[A-Za-z_]+(/[A-Za-z0-9_+-]+)*$`)
+
+var hostnameRegexp = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*\.?$`)
+
+// replyOptions adds the configured options to an OFFER or ACK, including
+// the ACK of an INFORM. Clients behind a relay with a pool get the mask of
+// its subnet and the relay as their router instead. Clients sending a
+// parameter request list only get the options in it, RFC 2131 4.3.1, but
+// for the subnet mask, which is always sent
+func (p *PluginState) replyOptions(req, resp *dhcpv4.DHCPv4) {
+	netmask, routers := p.netmask, p.routers
+	if pool := p.relayPoolOf(req); pool != nil {
+		netmask, routers = pool.subnet.Mask, []net.IP{req.GatewayIPAddr}
+	}
+
+	if netmask != nil {
+		resp.UpdateOption(dhcpv4.OptSubnetMask(netmask))
+	}
+	if len(routers) > 0 && req.IsOptionRequested(dhcpv4.OptionRouter) {
+		resp.UpdateOption(dhcpv4.OptRouter(routers...))
+	}
+	if len(p.dnsServers) > 0 && req.IsOptionRequested(dhcpv4.OptionDomainNameServer) {
+		resp.UpdateOption(dhcpv4.OptDNS(p.dnsServers...))
+	}
+	if len(p.ntpServers) > 0 && req.IsOptionRequested(dhcpv4.OptionNTPServers) {
+		resp.UpdateOption(dhcpv4.OptNTPServers(p.ntpServers...))
+	}
+	if p.config.TFTPServerName != "" && req.IsOptionRequested(dhcpv4.OptionTFTPServerName) {
+		resp.UpdateOption(dhcpv4.OptTFTPServerName(p.config.TFTPServerName))
+	}
+	if p.config.WPADURL != "" && isOptionRequested(req, optionWPAD) {
+		resp.UpdateOption(dhcpv4.OptGeneric(optionWPAD, []byte(p.config.WPADURL)))
+	}
+	if p.config.TZPOSIX != "" && req.IsOptionRequested(dhcpv4.OptionIEEE10031TZString) {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionIEEE10031TZString, []byte(p.config.TZPOSIX)))
+	}
+	if p.config.TZDatabase != "" && req.IsOptionRequested(dhcpv4.OptionReferenceToTZDatabase) {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionReferenceToTZDatabase, []byte(p.config.TZDatabase)))
+	}
+	if p.config.SendBroadcastOption && req.IsOptionRequested(dhcpv4.OptionBroadcastAddress) {
+		if broadcast := p.broadcastAddress(resp); broadcast != nil {
+			resp.UpdateOption(dhcpv4.OptBroadcastAddress(broadcast))
+		}
+	}
+}
+
+// isOptionRequested is req.IsOptionRequested comparing the codes by number,
+// a parsed request list holds codes of a type of its own that only equal the
+// named ones, never a GenericOptionCode like WPAD's
+func isOptionRequested(req *dhcpv4.DHCPv4, code dhcpv4.OptionCode) bool {
+	requested := req.ParameterRequestList()
+	if requested == nil {
+		return true
+	}
+	for _, c := range requested {
+		if c.Code() == code.Code() {
+			return true
+		}
+	}
+	return false
+}
+
+// renewalTimes are the renewal (T1) and rebinding (T2) times of a lease of
+// leaseTime, the configured ones unless the lease is too short for them,
+// the RFC 2131 4.4.5 fractions of it otherwise
+func (p *PluginState) renewalTimes(leaseTime time.Duration) (time.Duration, time.Duration) {
+	t1, t2 := p.config.RenewalTime, p.config.RebindingTime
+	if t1 == 0 {
+		t1 = leaseTime / 2
+	}
+	if t2 == 0 {
+		t2 = leaseTime * 7 / 8
+	}
+	if t1 >= t2 || t2 >= leaseTime {
+		return leaseTime / 2, leaseTime * 7 / 8
+	}
+	return t1, t2
+}
+
+// renewalOptions adds the renewal and rebinding times of a lease of
+// leaseTime to its ACK
+func (p *PluginState) renewalOptions(resp *dhcpv4.DHCPv4, leaseTime time.Duration) {
+	t1, t2 := p.renewalTimes(leaseTime)
+	resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRenewTimeValue, Value: dhcpv4.Duration(t1)})
+	resp.UpdateOption(dhcpv4.Option{Code: dhcpv4.OptionRebindingTimeValue, Value: dhcpv4.Duration(t2)})
+}
+
+// broadcastAddress is the broadcast address of the reply's subnet, derived
+// from the subnet mask in the reply, or the ServeSubnet one, unless
+// overridden
+func (p *PluginState) broadcastAddress(resp *dhcpv4.DHCPv4) net.IP {
+	// informing clients configured their address themselves
+	addr := resp.YourIPAddr
+	if addr == nil || addr.IsUnspecified() {
+		addr = resp.ClientIPAddr
+	}
+
+	mask := resp.SubnetMask()
+	if mask == nil && p.serveSubnet != nil {
+		mask = p.serveSubnet.Mask
+	}
+
+	if p.broadcast != nil {
+		if mask != nil && !p.broadcast.Equal(broadcastOf(addr, mask)) {
+			log.Warningf("BroadcastAddress %s is inconsistent with %s/%s",
+				p.broadcast, addr, net.IP(mask))
+		}
+		return p.broadcast
+	}
+
+	if mask == nil {
+		log.Debugf("no subnet mask to derive the broadcast address of %s from", addr)
+		return nil
+	}
+
+	return broadcastOf(addr, mask)
+}
+
+// broadcastOf returns the broadcast address of ip's subnet
+func broadcastOf(ip net.IP, mask net.IPMask) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil || len(mask) != net.IPv4len {
+		return nil
+	}
+
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip4 {
+		broadcast[i] = ip4[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// echoRelayAgentInfo copies the relay agent information option of a request
+// into its reply byte for byte, as relays rely on it to forward the reply,
+// RFC 3046 2.2
+func echoRelayAgentInfo(req, resp *dhcpv4.DHCPv4) {
+	if opt := req.Options.Get(dhcpv4.OptionRelayAgentInformation); opt != nil {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, opt))
+	}
+}
+
+// stripLeaseTime removes the lease time option, possibly set by an earlier
+// plugin, from replies not assigning an address, as only an OFFER or ACK
+// carrying one may have it, RFC 2131 table 3
+func stripLeaseTime(resp *dhcpv4.DHCPv4) {
+	switch resp.MessageType() {
+	case dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck:
+		if resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified() {
+			return
+		}
+	}
+
+	if resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+		resp.Options.Del(dhcpv4.OptionIPAddressLeaseTime)
+		log.Debugf("removed lease time from DHCPv4 %v not assigning an address", resp.MessageType())
+	}
+}
+
+// parseIPv4List parses a list of IPv4 addresses from the config
+func parseIPv4List(name string, values []string) ([]net.IP, error) {
+	ips := make([]net.IP, 0, len(values))
+	for _, value := range values {
+		ip := net.ParseIP(value)
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address in %s: %v", name, value)
+		}
+		ips = append(ips, ip.To4())
+	}
+
+	return ips, nil
+}
+
+// parseNetmask parses a subnet mask in dotted decimal form, its ones must
+// be contiguous
+func parseNetmask(name, value string) (net.IPMask, error) {
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 mask in %s: %v", name, value)
+	}
+	mask := net.IPMask(ip)
+	if _, bits := mask.Size(); bits == 0 {
+		return nil, fmt.Errorf("non contiguous IPv4 mask in %s: %v", name, value)
+	}
+	return mask, nil
+}
+
+// validateURL checks that a config value is an absolute http(s) URL
+func validateURL(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL in %s: %v", name, value)
+	}
+	return nil
+}
+
+// validateHostname checks that a config value is a hostname or an IPv4
+// address
+func validateHostname(name, value string) error {
+	if net.ParseIP(value).To4() == nil && !hostnameRegexp.MatchString(value) {
+		return fmt.Errorf("invalid hostname in %s: %v", name, value)
+	}
+	return nil
+}
+
+// validateTimezone checks the POSIX TZ string and tz database name
+func validateTimezone(posix, database string) error {
+	if posix != "" && !posixTZRegexp.MatchString(posix) {
+		return fmt.Errorf("invalid POSIX TZ string in TZPOSIX: %v", posix)
+	}
+	if database != "" && !tzDatabaseRegexp.MatchString(database) {
+		return fmt.Errorf("invalid tz database name in TZDatabase: %v", database)
+	}
+	return nil
+}
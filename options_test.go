@@ -0,0 +1,97 @@
+package etcdplugin
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// offerWith has nic discover, requesting the options of codes, and returns
+// the offer
+func offerWith(t testing.TB, p *PluginState, nic net.HardwareAddr, codes ...dhcpv4.OptionCode) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	req, err := dhcpv4.NewDiscovery(nic, dhcpv4.WithRequestedOptions(codes...))
+	if err != nil {
+		t.Fatalf("could not build discover: %v", err)
+	}
+	resp := exchange(t, p, req)
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("want %s offered an ip, got %v", nic, resp)
+	}
+	return resp
+}
+
+func TestNTPServersOption(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "NTPServers = 10.0.0.123,10.0.0.124")
+
+	resp := offerWith(t, p, testMAC(1), dhcpv4.OptionNTPServers)
+	want := []net.IP{net.IPv4(10, 0, 0, 123).To4(), net.IPv4(10, 0, 0, 124).To4()}
+	if got := dhcpv4.GetIPs(dhcpv4.OptionNTPServers, resp.Options); !reflect.DeepEqual(got, want) {
+		t.Errorf("want NTP servers %v, got %v", want, got)
+	}
+
+	// only sent to the clients asking for it
+	if resp := offerWith(t, p, testMAC(2), dhcpv4.OptionRouter); resp.Options.Has(dhcpv4.OptionNTPServers) {
+		t.Error("want no NTP servers sent unrequested")
+	}
+
+	if _, err := newPluginState(testConfig(t, "NTPServers = ntp.example.com"), f.dial); err == nil {
+		t.Error("want NTP servers that are not IPv4 addresses refused")
+	}
+}
+
+func TestTFTPAndWPADOptions(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "TFTPServerName = tftp.example.com", "WPADURL = http://wpad.example.com/wpad.dat")
+
+	resp := offerWith(t, p, testMAC(1), dhcpv4.OptionTFTPServerName, optionWPAD)
+	if got := resp.Options.Get(dhcpv4.OptionTFTPServerName); string(got) != "tftp.example.com" {
+		t.Errorf("want option 66 to carry tftp.example.com, got %q", got)
+	}
+	if got := resp.Options.Get(optionWPAD); string(got) != "http://wpad.example.com/wpad.dat" {
+		t.Errorf("want option 252 to carry the WPAD URL, got %q", got)
+	}
+
+	// only sent to the clients asking for them
+	resp = offerWith(t, p, testMAC(2), dhcpv4.OptionRouter)
+	if resp.Options.Has(dhcpv4.OptionTFTPServerName) || resp.Options.Has(optionWPAD) {
+		t.Error("want options 66 and 252 not sent unrequested")
+	}
+
+	for _, line := range []string{"TFTPServerName = not a host", "WPADURL = not-a-url"} {
+		if _, err := newPluginState(testConfig(t, line), f.dial); err == nil {
+			t.Errorf("want %q refused", line)
+		}
+	}
+}
+
+func TestTimezoneOptions(t *testing.T) {
+	codes := []dhcpv4.OptionCode{dhcpv4.OptionIEEE10031TZString, dhcpv4.OptionReferenceToTZDatabase}
+
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "TZPOSIX = WET0WEST,M3.5.0/1,M10.5.0", "TZDatabase = Europe/Lisbon")
+	resp := offerWith(t, p, testMAC(1), codes...)
+	if got := resp.Options.Get(dhcpv4.OptionIEEE10031TZString); string(got) != "WET0WEST,M3.5.0/1,M10.5.0" {
+		t.Errorf("want option 100 to carry the POSIX TZ string, got %q", got)
+	}
+	if got := resp.Options.Get(dhcpv4.OptionReferenceToTZDatabase); string(got) != "Europe/Lisbon" {
+		t.Errorf("want option 101 to carry the tz database name, got %q", got)
+	}
+
+	// absent when unset
+	unset := newTestPlugin(t, newFakeEtcd())
+	resp = offerWith(t, unset, testMAC(1), codes...)
+	if resp.Options.Has(dhcpv4.OptionIEEE10031TZString) || resp.Options.Has(dhcpv4.OptionReferenceToTZDatabase) {
+		t.Error("want no timezone options sent when unset")
+	}
+
+	for _, line := range []string{"TZPOSIX = 5", "TZDatabase = Europe//Lisbon"} {
+		if _, err := newPluginState(testConfig(t, line), f.dial); err == nil {
+			t.Errorf("want %q refused", line)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package etcdplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// ouiReservation guarantees a number of addresses of the range to the nics
+// whose hardware address starts with an OUI
+type ouiReservation struct {
+	oui   string
+	count int
+}
+
+// parseOUIReservations parses reservations of the form <oui>=<count> or
+// <oui>=<percent>%, eg. 00:1a:2b=10%
+func parseOUIReservations(values []string, rangeSize int) ([]ouiReservation, error) {
+	reservations := make([]ouiReservation, 0, len(values))
+	total := 0
+	for _, value := range values {
+		tokens := strings.SplitN(value, "=", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed OUI reservation, want <oui>=<count>: %s", value)
+		}
+
+		hwaddr, err := net.ParseMAC(strings.TrimSpace(tokens[0]) + ":00:00:00")
+		if err != nil {
+			return nil, fmt.Errorf("malformed OUI in reservation: %s", value)
+		}
+
+		amount := strings.TrimSpace(tokens[1])
+		var count int
+		if pct := strings.TrimSuffix(amount, "%"); pct != amount {
+			n, err := strconv.ParseFloat(pct, 64)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("malformed percentage in OUI reservation: %s", value)
+			}
+			count = int(float64(rangeSize) * n / 100)
+		} else {
+			count, err = strconv.Atoi(amount)
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("malformed count in OUI reservation: %s", value)
+			}
+		}
+
+		total += count
+		reservations = append(reservations, ouiReservation{
+			oui:   hwaddr.String()[:8],
+			count: count,
+		})
+	}
+
+	if total > rangeSize {
+		return nil, fmt.Errorf("OUI reservations hold %d addresses, more than the %d in the range",
+			total, rangeSize)
+	}
+
+	return reservations, nil
+}
+
+// ouiCounts keeps how many nics of each reserved OUI hold a lease, so that
+// a DISCOVER does not list every leased nic. It's counted by the monitor,
+// which also catches up with expired leases and the ones other instances
+// granted, and kept up to date in between with the leases granted and
+// revoked by this instance
+type ouiCounts struct {
+	mu           sync.Mutex
+	reservations []ouiReservation
+	// leased nics by OUI, nil until first counted
+	held map[string]int
+}
+
+func newOUICounts(reservations []ouiReservation) *ouiCounts {
+	return &ouiCounts{reservations: reservations}
+}
+
+// add adds delta to the count of the OUIs nic belongs to, if counted
+func (o *ouiCounts) add(nic net.HardwareAddr, delta int) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.held == nil {
+		return
+	}
+	mac := nic.String()
+	for _, r := range o.reservations {
+		if strings.HasPrefix(mac, r.oui) {
+			o.held[r.oui] += delta
+		}
+	}
+}
+
+// countOUIs counts the leased nics of each reserved OUI afresh
+func (p *PluginState) countOUIs(ctx context.Context) (map[string]int, error) {
+	resp, err := p.kv().Get(ctx, p.keys.LeasedNIC(""), etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list leased nics")
+	}
+
+	held := make(map[string]int)
+	for _, kv := range resp.Kvs {
+		nic, err := p.keys.ParseLeasedNIC(string(kv.Key))
+		if err != nil {
+			log.Warningf("ignoring key: %v", err)
+			continue
+		}
+		mac := nic.String()
+		for _, r := range p.ouiReservations {
+			if strings.HasPrefix(mac, r.oui) {
+				held[r.oui]++
+			}
+		}
+	}
+
+	p.ouiHeld.mu.Lock()
+	defer p.ouiHeld.mu.Unlock()
+
+	p.ouiHeld.held = held
+	return copyCounts(held), nil
+}
+
+// ouiHeldCounts returns how many leased nics each reserved OUI has, counted
+// afresh the first time
+func (p *PluginState) ouiHeldCounts(ctx context.Context) (map[string]int, error) {
+	p.ouiHeld.mu.Lock()
+	held := copyCounts(p.ouiHeld.held)
+	p.ouiHeld.mu.Unlock()
+
+	if held != nil {
+		return held, nil
+	}
+	return p.countOUIs(ctx)
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	copied := make(map[string]int, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
+// reservedForOthers returns how many free addresses must be kept for OUI
+// classes other than the nic's own, zero if the nic's class still has
+// reserved addresses left
+func (p *PluginState) reservedForOthers(ctx context.Context, nic net.HardwareAddr) (int, error) {
+	if len(p.ouiReservations) == 0 {
+		return 0, nil
+	}
+
+	held, err := p.ouiHeldCounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	outstanding := 0
+	for _, r := range p.ouiReservations {
+		if strings.HasPrefix(nic.String(), r.oui) {
+			if held[r.oui] < r.count {
+				// dip into our own reservation
+				return 0, nil
+			}
+			continue
+		}
+		if held[r.oui] < r.count {
+			outstanding += r.count - held[r.oui]
+		}
+	}
+
+	return outstanding, nil
+}
+
+// ouiAllows reports whether nic may be leased ip without dipping into the
+// free addresses reserved for other OUI classes. The ip it holds, or was
+// offered, is its own already
+func (p *PluginState) ouiAllows(ctx context.Context, nic net.HardwareAddr, ip net.IP) (bool, error) {
+	reserved, err := p.reservedForOthers(ctx, nic)
+	if err != nil || reserved == 0 {
+		return err == nil, err
+	}
+
+	held, err := p.nicLeasedIP(ctx, nic)
+	if err != nil {
+		return false, err
+	}
+	if ip.Equal(held) {
+		return true, nil
+	}
+
+	resp, err := p.kv().Txn(ctx).
+		Then(
+			etcd.OpGet(p.keys.IP(IPStateOffered, ip.String())),
+			etcd.OpGet(p.keys.IP(IPStateFree, ""), etcd.WithPrefix(), etcd.WithCountOnly()),
+		).Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "could not count free ips")
+	}
+	if offered := resp.Responses[0].GetResponseRange().Kvs; len(offered) > 0 &&
+		string(offered[0].Value) == nic.String() {
+		return true, nil
+	}
+
+	return resp.Responses[1].GetResponseRange().Count > int64(reserved), nil
+}
@@ -0,0 +1,136 @@
+package etcdplugin
+
+import (
+	"math"
+	"sort"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// the minimum message size every client must accept, RFC 2131 3.1
+	constMinMessageSize = 576
+	// the IP and UDP headers counted in the client's maximum message size
+	constIPUDPHeaderSize = 28
+
+	// usable length of the sname and file fields, dhcpv4 always keeps a
+	// trailing zero
+	constSnameOptionsSize = 63
+	constFileOptionsSize  = 127
+
+	// values of the option overload option, RFC 2132 9.3
+	constOverloadFile  = 1
+	constOverloadSname = 2
+)
+
+// options that stay in the options field, so that clients which do not
+// understand overloading still make sense of the reply
+var unmovableOptions = map[uint8]struct{}{
+	dhcpv4.OptionDHCPMessageType.Code():    {},
+	dhcpv4.OptionServerIdentifier.Code():   {},
+	dhcpv4.OptionIPAddressLeaseTime.Code(): {},
+	dhcpv4.OptionOptionOverload.Code():     {},
+	// relays only look for it in the options field, RFC 3046 2.2
+	dhcpv4.OptionRelayAgentInformation.Code(): {},
+}
+
+// maxMessageSize is the size of the largest DHCP message req's client
+// accepts, excluding the IP and UDP headers
+func maxMessageSize(req *dhcpv4.DHCPv4) int {
+	size := constMinMessageSize
+	if max, err := req.MaxMessageSize(); err == nil && int(max) > size {
+		size = int(max)
+	}
+	return size - constIPUDPHeaderSize
+}
+
+// encodeOption renders an option as it's laid out on the wire, options
+// longer than 255 bytes are split in several instances, RFC 3396
+func encodeOption(code uint8, data []byte) []byte {
+	if len(data) == 0 {
+		return []byte{code, 0}
+	}
+
+	var b []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > math.MaxUint8 {
+			n = math.MaxUint8
+		}
+		b = append(b, code, uint8(n))
+		b = append(b, data[:n]...)
+		data = data[n:]
+	}
+	return b
+}
+
+// overloadOptions moves options of resp into its file and sname fields
+// when it is larger than req's client accepts, RFC 2131 4.1. The fields are
+// only used when empty, and the largest options are moved first. It
+// reports whether resp now fits
+func overloadOptions(req, resp *dhcpv4.DHCPv4) bool {
+	max := maxMessageSize(req)
+	if len(resp.ToBytes()) <= max {
+		return true
+	}
+
+	codes := make([]uint8, 0, len(resp.Options))
+	for code := range resp.Options {
+		if _, ok := unmovableOptions[code]; !ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return len(resp.Options[codes[i]]) > len(resp.Options[codes[j]])
+	})
+
+	fields := []struct {
+		overload uint8
+		size     int
+		empty    bool
+		set      func(string)
+	}{
+		{constOverloadFile, constFileOptionsSize, resp.BootFileName == "",
+			func(s string) { resp.BootFileName = s }},
+		{constOverloadSname, constSnameOptionsSize, resp.ServerHostName == "",
+			func(s string) { resp.ServerHostName = s }},
+	}
+
+	var overload uint8
+	for _, field := range fields {
+		if !field.empty {
+			continue
+		}
+
+		var area []byte
+		for i := 0; i < len(codes); i++ {
+			opt := encodeOption(codes[i], resp.Options[codes[i]])
+			// leave room for the end option
+			if len(area)+len(opt)+1 > field.size {
+				continue
+			}
+
+			area = append(area, opt...)
+			resp.Options.Del(dhcpv4.GenericOptionCode(codes[i]))
+			codes = append(codes[:i], codes[i+1:]...)
+			i--
+		}
+		if len(area) == 0 {
+			continue
+		}
+
+		field.set(string(append(area, dhcpv4.OptionEnd.Code())))
+		overload |= field.overload
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionOptionOverload, []byte{overload}))
+
+		if len(resp.ToBytes()) <= max {
+			break
+		}
+	}
+
+	if overload != 0 {
+		log.Debugf("overloaded options of reply to %s into fields %d", req.ClientHWAddr, overload)
+	}
+
+	return len(resp.ToBytes()) <= max
+}
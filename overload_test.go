@@ -0,0 +1,40 @@
+package etcdplugin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestOverloadFitsTheWholeReply(t *testing.T) {
+	// enough servers to bring the reply close to the minimum message size
+	dnsServers := make([]string, 60)
+	for i := range dnsServers {
+		dnsServers[i] = fmt.Sprintf("192.168.0.%d", i+1)
+	}
+
+	// around the size where the options spill into the file field, the
+	// renewal times must be accounted for at every one of them
+	for n := 10; n < 80; n++ {
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f,
+			"OptionOverload = true",
+			"DNSServers = "+strings.Join(dnsServers, ","),
+			"TZDatabase = Europe/"+strings.Repeat("a", n))
+
+		nic := testMAC(1)
+		ip := discover(t, p, nic)
+		resp := request(t, p, nic, ip,
+			dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(constMinMessageSize)),
+			dhcpv4.WithRequestedOptions(dhcpv4.OptionDomainNameServer, dhcpv4.OptionReferenceToTZDatabase))
+		if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("zone of %d: want %s acked, got %v", n, ip, resp)
+		}
+
+		if size, max := len(resp.ToBytes()), constMinMessageSize-constIPUDPHeaderSize; size > max {
+			t.Errorf("zone of %d: want the reply within %d bytes, got %d", n, max, size)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package etcdplugin
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// isPaused reports whether granting new leases is paused
+func (p *PluginState) isPaused() bool {
+	return p.paused.Load()
+}
+
+// setPaused pauses or resumes granting new leases, persisting the state in
+// etcd so it survives restarts and reaches the other instances
+func (p *PluginState) setPaused(ctx context.Context, paused bool) error {
+	kvc := p.kv()
+
+	var err error
+	if paused {
+		_, err = kvc.Put(ctx, p.keys.Paused(), "true")
+	} else {
+		_, err = kvc.Delete(ctx, p.keys.Paused())
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not store pause state")
+	}
+
+	p.updatePaused(paused)
+
+	return nil
+}
+
+// loadPaused refreshes the pause state from etcd
+func (p *PluginState) loadPaused(ctx context.Context) error {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.Paused(), etcd.WithCountOnly())
+	if err != nil {
+		return errors.Wrap(err, "could not get pause state")
+	}
+
+	p.updatePaused(resp.Count > 0)
+
+	return nil
+}
+
+func (p *PluginState) updatePaused(paused bool) {
+	if p.paused.Swap(paused) != paused {
+		if paused {
+			log.Warning("granting new leases is paused")
+		} else {
+			log.Info("granting new leases resumed")
+		}
+	}
+
+	if paused {
+		metricPaused.Set(1)
+	} else {
+		metricPaused.Set(0)
+	}
+}
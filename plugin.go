@@ -2,7 +2,11 @@ package etcdplugin
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	etcd "go.etcd.io/etcd/client/v3"
@@ -12,28 +16,153 @@ import (
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
 	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
 	Name:   "etcd",
+	Setup6: setup6,
 	Setup4: setup,
 }
 
 const (
-	constDefaultSeparator = "::"
-	constDefaultLeaseTime = 10 * time.Minute
+	constDefaultSeparator       = "::"
+	constDefaultLeaseTime       = 10 * time.Minute
+	constDefaultMonitorInterval = 10 * time.Second
+	// lease time given to a client whose previous grant etcd contradicted
+	constDefaultContradictedLeaseTime = 30 * time.Second
+	// how far back declines of an ip are counted towards parking it
+	constDefaultProblemWindow = 24 * time.Hour
+	// how long a declined ip is kept out of the free pool
+	constDefaultQuarantineTime = time.Hour
+	// how long an ip offered to a client is kept for it
+	constDefaultOfferTimeout = 30 * time.Second
+	// how many free ips are tried when others are offered concurrently
+	constOfferAttempts = 3
+	// shortest etcd lease granted, etcd leases have a one second resolution
+	constDefaultMinEtcdLeaseTTL = time.Second
+	// how often the etcd endpoint list is synced
+	constDefaultSyncInterval = time.Minute
+	// failed endpoint syncs retried before reconnecting
+	constDefaultSyncRetries = 5
+	// first backoff after a failed endpoint sync
+	constSyncBackoff = time.Second
+	// how long an endpoint sync may take
+	constSyncTimeout = 30 * time.Second
+	// first backoff when etcd rejects a request as overloaded
+	constDefaultOverloadBackoff = 250 * time.Millisecond
+	// how long the etcd operations of a packet may take
+	constDefaultRequestTimeout = 5 * time.Second
+	// transient etcd failures retried while handling a packet
+	constDefaultTransientRetries = 2
+	// first backoff after a transient etcd failure
+	constDefaultTransientBackoff = 100 * time.Millisecond
+	// most ips the ranges may hold, a /16, the allocator keeps a bit per
+	// ip and etcd a key
+	constDefaultMaxRangeSize = 1 << 16
 )
 
 // PluginState is the data held by an instance of the range plugin
 type PluginState struct {
-	// Rough lock for the whole plugin, we'll get better performance once we use leasestorage
-	sync.Mutex
-	config    Config
-	client    *etcd.Client
-	allocator allocators.Allocator
-	dns       *DNS
-	grp       *errgroup.Group
+	config Config
+	// builds and parses the plugin's etcd keys
+	keys keyspace
+	// serializes the packets of each nic, the ones of different nics rely
+	// on etcd transactions
+	nics *nicLocks
+	// free ips being offered
+	claims *claims
+	// cache of the free ips, nil when not enabled
+	freePool *freePool
+	// which free ip a DISCOVER is offered
+	allocationStrategy string
+	// creates the etcd clients
+	dial dialer
+	// guards client, which is replaced when re-authenticating
+	clientMu     sync.RWMutex
+	client       *etcd.Client
+	clientCancel context.CancelFunc
+	// serializes re-authenticating, so that the operations failing on an
+	// expired token together replace the client once
+	reconnectMu sync.Mutex
+	allocator   allocators.Allocator
+	dns         *DNS
+	prober      Prober
+	grp         *errgroup.Group
+	// stops the goroutines of grp
+	cancel context.CancelFunc
+	// makes Close idempotent, Shutdown may close an instance again
+	closeOnce sync.Once
+	closeErr  error
+	// serializes the monitor's sweeps with the ones requested on demand
+	sweepMu sync.Mutex
+
+	settingsMu sync.RWMutex
+	current    Settings
+
+	// global packet rate limit, nil when unlimited
+	limiter *tokenBucket
+	// whether etcd is overloaded
+	backpressure *backpressure
+	// validates the authentication of requests, nil when not required
+	auth *delayedAuth
+
+	// the leasable ranges, the relay pools' included
+	ranges ipRanges
+	// the ranges directly connected clients are leased from
+	directRanges ipRanges
+	// the ranges clients behind relays are leased from, by relay subnet
+	relayPools []relayPool
+	// ips within the ranges that are never leased
+	exclude exclusions
+	// the subnet requests must come from, nil to serve all of them
+	serveSubnet *net.IPNet
+
+	ntpServers []net.IP
+	// ips pinned to nics, nil when there are none
+	reservations *reservations
+	// sent in replies, nil when not configured
+	netmask net.IPMask
+	// default gateways sent in replies, in order of preference
+	routers []net.IP
+	// resolvers sent in replies, whether or not names are registered
+	dnsServers []net.IP
+	// overrides the broadcast address derived from the subnet mask
+	broadcast       net.IP
+	ouiReservations []ouiReservation
+	// leased nics of the reserved OUIs, nil without OUIReservations
+	ouiHeld *ouiCounts
+
+	// whether granting new leases is paused
+	paused atomic.Bool
+	// the IPv6 addresses leased by Handler6, nil for DHCPv4 instances
+	range6 *ipRange6
+
+	// whether the instance stands by for the active one
+	standby atomic.Bool
+	// the etcd lease of the heartbeat while active, 0 while standing by
+	heartbeatLease atomic.Int64
+
+	grants *grants
+	// DNS registrations that failed
+	dnsRetries *dnsRetries
+	// registers DNS names in the background, nil when registering them
+	// while handling the request
+	dnsWorkers *dnsWorkers
+	// where in the range the instance starts looking for free ips, nil
+	// when it looks from the lowest
+	instanceStart net.IP
+	// publishes lease events, nil when there's no events broker
+	events *events
+	// the address identifying this server, nil when not configured
+	serverID net.IP
+	// nics toggling between addresses, nil when not detected
+	toggles *toggles
+	// serializes the handling of packets instead of the nic locks, nil when not
+	// enabled
+	queue *leaseQueue
 }
 
 // various global variables
@@ -41,84 +170,439 @@ var (
 	log = logger.GetLogger("plugins/etcd")
 )
 
+// tracePacket dumps the wire bytes of a packet when packet tracing is
+// enabled and the logger is at trace level
+func (p *PluginState) tracePacket(what string, pkt *dhcpv4.DHCPv4) {
+	if !p.config.PacketTrace || !log.Logger.IsLevelEnabled(logrus.TraceLevel) {
+		return
+	}
+
+	log.Tracef("%s packet bytes:\n%s", what, hex.Dump(pkt.ToBytes()))
+}
+
+// requestedIP picks the address a REQUEST is for according to the client's
+// state, RFC 2131 4.3.2. A client SELECTING an offer names the server and
+// the address in option 50, one RENEWING or REBINDING fills in ciaddr
+// instead. When both are present and disagree the one matching the state
+// wins, unless configured to refuse such requests
+func (p *PluginState) requestedIP(req *dhcpv4.DHCPv4) (net.IP, error) {
+	requested := req.RequestedIPAddress()
+	ciaddr := req.ClientIPAddr
+	if ciaddr != nil && ciaddr.IsUnspecified() {
+		ciaddr = nil
+	}
+
+	switch {
+	case requested == nil && ciaddr == nil:
+		return nil, errors.New("no requested address")
+	case requested == nil:
+		return ciaddr, nil
+	case ciaddr == nil, requested.Equal(ciaddr):
+		return requested, nil
+	}
+
+	if p.config.StrictRequestedIP {
+		return nil, fmt.Errorf("requested address %s disagrees with ciaddr %s", requested, ciaddr)
+	}
+
+	ip := ciaddr
+	if req.ServerIdentifier() != nil {
+		// selecting
+		ip = requested
+	}
+	log.Warningf("requested address %s of %s disagrees with ciaddr %s, using %s",
+		requested, req.ClientHWAddr, ciaddr, ip)
+
+	return ip, nil
+}
+
+// serverIdentity is the address this server identifies itself with, the
+// configured ServerID, the server identifier an earlier plugin set on the
+// reply, or the reply's server address, in that order. It's nil when none is
+// known
+func (p *PluginState) serverIdentity(resp *dhcpv4.DHCPv4) net.IP {
+	if p.serverID != nil {
+		return p.serverID
+	}
+	if id := resp.ServerIdentifier(); id != nil && !id.IsUnspecified() {
+		return id
+	}
+	if resp.ServerIPAddr != nil && !resp.ServerIPAddr.IsUnspecified() {
+		return resp.ServerIPAddr
+	}
+	return nil
+}
+
+// holdsLease reports whether nic holds the lease of ip
+func (p *PluginState) holdsLease(ctx context.Context, nic net.HardwareAddr, ip net.IP) (bool, error) {
+	var leased net.IP
+	err := p.retry(ctx, func() (err error) {
+		leased, err = p.nicLeasedIP(ctx, nic)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return leased != nil && leased.Equal(ip), nil
+}
+
 // Handler4 handles DHCPv4 packets for the etcd plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	p.Lock()
-	defer p.Unlock()
+	// the active instance answers
+	if p.isStandby() {
+		log.Debugf("standing by, dropping DHCPv4 packet %v from %s",
+			req.MessageType(), req.ClientHWAddr)
+		return nil, true
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// shed load before queueing up behind the lock
+	if p.limiter != nil && !p.limiter.allow() {
+		metricPacketsShed.Add(1)
+		log.Debugf("rate limit exceeded, dropping DHCPv4 packet %v from %s",
+			req.MessageType(), req.ClientHWAddr)
+		return nil, true
+	}
+
+	// only serve the subnet we're scoped to, if any, dropping the packets
+	// of the others
+	if p.serveSubnet != nil {
+		local := req.GatewayIPAddr
+		if local == nil || local.IsUnspecified() {
+			local = resp.ServerIPAddr
+		}
+		if !p.serveSubnet.Contains(local) {
+			log.Debugf("dropping DHCPv4 packet from %s received for %v, outside of %s",
+				req.ClientHWAddr, local, p.serveSubnet)
+			return nil, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.RequestTimeout)
 	defer cancel()
 
+	if p.queue != nil {
+		return p.queue.do(ctx, req, resp)
+	}
+
+	defer p.nics.lock(req.ClientHWAddr)()
+
+	return p.handle4(ctx, req, resp)
+}
+
+// handle4 handles DHCPv4 packets once they are serialized, by the lock or
+// the lease queue
+func (p *PluginState) handle4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (reply *dhcpv4.DHCPv4, stop bool) {
 	log.Debugf("got DHCPv4 packet %v", req.MessageType())
 	log.Debugf("%v", req.Summary())
 
+	p.tracePacket("request", req)
+
+	echoRelayAgentInfo(req, resp)
+
 	defer func() {
+		stripLeaseTime(resp)
+		// once every option is in, the renewal times and the client FQDN
+		// ones included
+		if p.config.OptionOverload && reply != nil && !overloadOptions(req, reply) {
+			log.Warningf("reply to %s exceeds its maximum message size", req.ClientHWAddr)
+		}
 		log.Debugf("replying with DHCPv4 packet: %v", resp.MessageType())
 		log.Debugf("%v", resp.Summary())
+		p.tracePacket("response", resp)
 	}()
 
 	switch req.MessageType() {
 	case dhcpv4.MessageTypeDiscover:
-		ip, err := p.nicLeasedIP(ctx, req.ClientHWAddr)
+		// renewals go straight to requests, while etcd is overloaded leave
+		// new clients to retry later
+		if p.config.ShedOnOverload && p.backpressure.overloaded() {
+			metricPacketsShed.Add(1)
+			log.Debugf("etcd is overloaded, ignoring DHCP discover from %s", req.ClientHWAddr)
+			return nil, true
+		}
+
+		var ip net.IP
+		err := p.retry(ctx, func() (err error) {
+			ip, err = p.nicLeasedIP(ctx, req.ClientHWAddr)
+			return err
+		})
 		if err != nil {
-			log.Errorf("unable to allocate IP for MAC %s: %w", req.ClientHWAddr.String(), err)
+			log.Errorf("unable to allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
 			return nil, true
 		}
 		if ip != nil {
 			resp.YourIPAddr = ip
+			p.replyOptions(req, resp)
 			log.Infof("found previous lease for %s: %s", req.ClientHWAddr, ip)
 			return resp, false
 		}
 
-		// fetch a free ip
-		ip, err = p.freeIP(ctx)
+		// the client may hold an address handed out by a peer server
+		// in a split scope, let the owning server answer
+		if p.config.RespectPeerScope {
+			hint := req.RequestedIPAddress()
+			if hint == nil && !req.ClientIPAddr.IsUnspecified() {
+				hint = req.ClientIPAddr
+			}
+			if hint != nil && !p.ranges.contains(hint) {
+				log.Debugf("ignoring DHCP discover from %s for %s, outside of our range",
+					req.ClientHWAddr, hint)
+				return nil, true
+			}
+		}
+
+		if p.isPaused() {
+			log.Infof("granting new leases is paused, ignoring DHCP discover from %s",
+				req.ClientHWAddr)
+			return nil, true
+		}
+
+		// a client discovering again is offered the same ip
+		err = p.retry(ctx, func() (err error) {
+			ip, err = p.nicOfferedIP(ctx, req.ClientHWAddr)
+			return err
+		})
 		if err != nil {
-			log.Errorf("unable to fetch free IP: %w", err)
+			log.Errorf("unable to look up offer for MAC %s: %v", req.ClientHWAddr, err)
+			return nil, true
+		}
+
+		// a nic with a reservation is offered its ip, unless another nic
+		// still holds it
+		if reserved := p.reservations.ipOf(req.ClientHWAddr); ip == nil && reserved != nil {
+			err = p.retry(ctx, func() error {
+				return p.offerIP(ctx, req.ClientHWAddr, reserved)
+			})
+			switch {
+			case errors.Is(err, ErrNotFree):
+				log.Warningf("IP %s reserved for MAC %s is taken, offering it another one",
+					reserved, req.ClientHWAddr)
+			case err != nil:
+				log.Errorf("unable to offer IP %s to MAC %s: %v", reserved, req.ClientHWAddr, err)
+				return nil, true
+			default:
+				ip = reserved
+			}
+		}
+
+		// another instance may offer the same free ip in the meantime, in
+		// which case try the next one
+		for attempt := 0; ip == nil && attempt < constOfferAttempts; attempt++ {
+			// fetch a free ip
+			var free net.IP
+			err = p.retry(ctx, func() (err error) {
+				free, err = p.freeIP(ctx, req.ClientHWAddr, p.rangesFor(req))
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to fetch free IP: %v", err)
+				return nil, true
+			}
+
+			if !p.claims.claim(free) {
+				log.Debugf("IP %s is being offered to another MAC, skipping it", free)
+				continue
+			}
+
+			// and keep it for our client until it requests it
+			err = p.retry(ctx, func() error {
+				return p.offerIP(ctx, req.ClientHWAddr, free)
+			})
+			p.claims.release(free)
+			if errors.Is(err, ErrNotFree) {
+				log.Debugf("IP %s was taken while offering it to MAC %s", free, req.ClientHWAddr)
+				continue
+			}
+			if err != nil {
+				log.Errorf("unable to offer IP %s to MAC %s: %v", free, req.ClientHWAddr, err)
+				return nil, true
+			}
+			ip = free
+		}
+		if ip == nil {
+			log.Errorf("unable to offer an IP to MAC %s: %v", req.ClientHWAddr, err)
 			return nil, true
 		}
 
 		// return the free to our client
 		resp.YourIPAddr = ip
+		p.replyOptions(req, resp)
 
 		log.Infof("returning IP %s for MAC %s", resp.YourIPAddr, req.ClientHWAddr.String())
 
 	case dhcpv4.MessageTypeRequest:
-		reqServerIP := req.ServerIdentifier()
+		// only a client SELECTING an offer names the server, one renewing,
+		// rebinding or rebooting goes to any server, RFC 2131 4.3.2. Which
+		// address a request without one is for is left to requestedIP
+		if reqServerIP := req.ServerIdentifier(); reqServerIP != nil &&
+			!reqServerIP.Equal(p.serverIdentity(resp)) {
+			log.Debugf("ignoring DHCP request meant for %s", reqServerIP)
+			return nil, true
+		}
+
+		if p.auth != nil {
+			if err := p.auth.validate(req); err != nil {
+				log.Warningf("unauthenticated DHCP request from %s: %v", req.ClientHWAddr, err)
+				if p.config.DelayedAuthNak {
+					resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+					return resp, false
+				}
+				return nil, true
+			}
+		}
 
-		// deny REQUESTs without a server identifier
-		if reqServerIP == nil {
-			log.Errorf("no server identifier in DHCP request, returning negative reply")
+		ip, err := p.requestedIP(req)
+		if err != nil {
+			log.Warningf("illegal DHCP request from %s, returning negative reply: %v",
+				req.ClientHWAddr, err)
 			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
 			return resp, false
 		}
 
-		// is the message meant for this server?
-		if !reqServerIP.Equal(resp.ServerIPAddr) {
-			// ignore
-			log.Debugf("ignoring DHCP request meant for %s", reqServerIP)
+		// a client that moved to another subnet must get an address on
+		// its new one, RFC 2131 4.3.2
+		if p.ranges.contains(ip) && !p.rangesFor(req).contains(ip) {
+			log.Infof("IP %s requested by MAC %s is not on the subnet it's on, returning negative reply",
+				ip, req.ClientHWAddr)
+			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+			return resp, false
+		}
+
+		// an ip excluded since it was leased is not renewed
+		if p.exclude.contains(ip) {
+			log.Infof("IP %s requested by MAC %s is excluded, returning negative reply",
+				ip, req.ClientHWAddr)
+			resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+			return resp, false
+		}
+
+		// a nic with a reservation is turned away from other ips while
+		// its own waits for it
+		if reserved := p.reservations.ipOf(req.ClientHWAddr); reserved != nil && !reserved.Equal(ip) {
+			var available bool
+			err := p.retry(ctx, func() (err error) {
+				available, err = p.isReserved(ctx, reserved)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to look up reservation of MAC %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if available {
+				log.Infof("MAC %s has %s reserved, returning negative reply to its request for %s",
+					req.ClientHWAddr, reserved, ip)
+				resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+				return resp, false
+			}
+		}
+
+		if p.toggles != nil {
+			if pinned, ok := p.toggles.check(req.ClientHWAddr, ip); !ok {
+				log.Infof("MAC %s is pinned to %s, returning negative reply to its request for %s",
+					req.ClientHWAddr, pinned, ip)
+				resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+				return resp, false
+			}
+		}
+
+		// only renewals are served while paused
+		if p.isPaused() {
+			var current net.IP
+			err := p.retry(ctx, func() (err error) {
+				current, err = p.nicLeasedIP(ctx, req.ClientHWAddr)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to look up lease for nic %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if !ip.Equal(current) {
+				log.Infof("granting new leases is paused, ignoring DHCP request from %s for %s",
+					req.ClientHWAddr, ip)
+				return nil, true
+			}
+		}
+
+		// some clients ask for no lease time at all once they are done
+		// with the address, release it like a DHCP release would
+		if p.config.ZeroLeaseTimeReleases &&
+			req.Options.Has(dhcpv4.OptionIPAddressLeaseTime) && req.IPAddressLeaseTime(0) == 0 {
+			ok, err := p.holdsLease(ctx, req.ClientHWAddr, ip)
+			if err != nil {
+				log.Errorf("unable to look up lease for nic %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if !ok {
+				log.Debugf("ignoring DHCP request of %s for %s with no lease time, it does not hold it",
+					req.ClientHWAddr, ip)
+				return nil, true
+			}
+
+			err = p.retry(ctx, func() error {
+				return p.revokeLease(ctx, req.ClientHWAddr)
+			})
+			if err != nil {
+				log.Errorf("error revoking lease for nic %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+
+			log.Infof("released %s of MAC %s, it requested no lease time", ip, req.ClientHWAddr)
 			return nil, true
 		}
 
-		// prefer renewing leases
-		ip := req.ClientIPAddr
-		if req.RequestedIPAddress() != nil {
-			ip = req.RequestedIPAddress()
+		// the OUI reservations of other classes hold whatever is left
+		if len(p.ouiReservations) > 0 {
+			var allowed bool
+			err := p.retry(ctx, func() (err error) {
+				allowed, err = p.ouiAllows(ctx, req.ClientHWAddr, ip)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to look up OUI reservations for MAC %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if !allowed {
+				log.Infof("the free ips are reserved for other OUIs, returning negative reply to the request of MAC %s for %s",
+					req.ClientHWAddr, ip)
+				resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+				return resp, false
+			}
 		}
 
-		leaseTime := resp.IPAddressLeaseTime(constDefaultLeaseTime)
+		settings := p.settings()
+		leaseTime := resp.IPAddressLeaseTime(settings.LeaseTime)
 		// did the client request a different lease time than what
 		// we're configured with?
-		if req.IPAddressLeaseTime(leaseTime) != leaseTime {
-			log.Debugf("client requested lease time of %v, using that",
-				req.IPAddressLeaseTime(leaseTime))
-			leaseTime = req.IPAddressLeaseTime(leaseTime)
+		if requested := req.IPAddressLeaseTime(leaseTime); requested != leaseTime {
+			leaseTime = requested
+			switch {
+			case settings.MinLeaseTime > 0 && leaseTime < settings.MinLeaseTime:
+				leaseTime = settings.MinLeaseTime
+			case settings.MaxLeaseTime > 0 && leaseTime > settings.MaxLeaseTime:
+				leaseTime = settings.MaxLeaseTime
+			}
+			log.Debugf("client requested lease time of %v, using %v", requested, leaseTime)
+
+			resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(leaseTime))
+		}
+
+		// a previous grant of ours turned out not to be held in etcd,
+		// have the client come back soon
+		if p.grants.takeContradicted(req.ClientHWAddr) && leaseTime > p.config.ContradictedLeaseTime {
+			log.Infof("shortening lease of nic %s to %s after a contradicted grant",
+				req.ClientHWAddr, p.config.ContradictedLeaseTime)
+			leaseTime = p.config.ContradictedLeaseTime
 
 			resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(leaseTime))
 		}
 
 		// lease the IP in etcd
-		if err := p.leaseIP(ctx, req.ClientHWAddr, ip, leaseTime); err != nil {
-			log.Errorf("unable to lease nic %s, ip %s: %w", req.ClientHWAddr, ip, err)
+		err = p.retry(ctx, func() error {
+			return p.leaseIP(ctx, req.ClientHWAddr, ip, leaseTime, req.HostName())
+		})
+		if err != nil {
+			log.Errorf("unable to lease nic %s, ip %s: %v", req.ClientHWAddr, ip, err)
 			if IsAlreadyLeased(err) {
 				log.Debugf("ip %s already leased, returning negative reply to DHCP request", ip)
 				// return a negative reply
@@ -128,34 +612,162 @@ func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 			return nil, true
 		}
 
+		p.grants.record(req.ClientHWAddr, ip, leaseTime)
+
 		// set ip reply
 		resp.YourIPAddr = ip
+		p.replyOptions(req, resp)
+		p.renewalOptions(resp, leaseTime)
+
+		hostname := req.HostName()
+		register := true
+		if p.config.HonorClientFQDN {
+			var host string
+			host, register = p.fqdnUpdate(req, resp)
+			if hostname == "" {
+				hostname = host
+			}
+		}
+
+		if p.config.PersistHostname {
+			err := p.retry(ctx, func() (err error) {
+				hostname, err = p.persistHostname(ctx, req.ClientHWAddr, hostname)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to persist hostname of MAC %s: %v", req.ClientHWAddr, err)
+			}
+		}
 
 		// register DNS if available
-		if hostname := req.HostName(); hostname != "" {
-			if err := p.dns.Register(ctx, p.client, hostname, ip, req.ClientHWAddr,
+		switch {
+		case hostname == "":
+		case !register:
+			log.Debugf("not registering %s for MAC %s, the client FQDN flags leave it to the client",
+				hostname, req.ClientHWAddr)
+		case p.dnsWorkers != nil:
+			if !p.dnsWorkers.add(hostname, ip, req.ClientHWAddr, leaseTime) {
+				log.Warningf("DNS registration queue is full, will retry registering %s for MAC %s",
+					hostname, req.ClientHWAddr)
+				p.dnsRetries.add(hostname, ip, req.ClientHWAddr, leaseTime)
+			}
+		default:
+			if err := p.dns.Register(ctx, p.etcdClient(), hostname, ip, req.ClientHWAddr,
 				leaseTime); err != nil {
-				return nil, true
+				if p.config.DNSRegistrationStrict {
+					log.Errorf("unable to register %s for MAC %s: %v", hostname, req.ClientHWAddr, err)
+					return nil, true
+				}
+				// the lease stands, the monitor will retry registering it
+				log.Warningf("unable to register %s for MAC %s, will retry: %v",
+					hostname, req.ClientHWAddr, err)
+				p.dnsRetries.add(hostname, ip, req.ClientHWAddr, leaseTime)
 			}
 		}
 
 		log.Infof("return requested IP %s for MAC %s", ip, req.ClientHWAddr)
 
-	case dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
-		// is the message meant for this server?
-		if !req.ServerIdentifier().Equal(resp.ServerIPAddr) {
+	case dhcpv4.MessageTypeInform:
+		// the client configured its address by other means and only asks
+		// for options, answer without touching any lease (RFC 2131 4.3.5)
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+		resp.YourIPAddr = net.IPv4zero
+		p.replyOptions(req, resp)
+		log.Infof("answering DHCP inform from MAC %s at %s with options",
+			req.ClientHWAddr, req.ClientIPAddr)
+
+	case dhcpv4.MessageTypeRelease:
+		server := p.serverIdentity(resp)
+		switch {
+		case req.ServerIdentifier() == nil && p.config.RelaxedRelease, server == nil:
+			// some clients release without a server identifier, and ours
+			// may not be known, only honor it if it matches the lease we
+			// hold for them
+			ok, err := p.holdsLease(ctx, req.ClientHWAddr, req.ClientIPAddr)
+			if err != nil {
+				log.Errorf("unable to look up lease for nic %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if !ok {
+				log.Debugf("ignoring DHCP release of %s meant for %v, nic %s does not hold it",
+					req.ClientIPAddr, req.ServerIdentifier(), req.ClientHWAddr)
+				return nil, true
+			}
+		case !req.ServerIdentifier().Equal(server):
+			// is the message meant for this server?
 			// ignore
 			log.Debugf("ignoring DHCP release meant for %s", req.ServerIdentifier())
 			return nil, true
 		}
 
-		if err := p.revokeLease(ctx, req.ClientHWAddr); err != nil {
+		err := p.retry(ctx, func() error {
+			return p.revokeLease(ctx, req.ClientHWAddr)
+		})
+		if errors.Is(err, ErrNoLease) {
+			log.Debugf("ignoring DHCP release from %s, it holds no lease", req.ClientHWAddr)
+			return nil, true
+		}
+		if err != nil {
 			log.Errorf("error revoking lease for nic %s: %v", req.ClientHWAddr, err)
 			return nil, true
 		}
 
+	case dhcpv4.MessageTypeDecline:
+		// is the message meant for this server?
+		if server := p.serverIdentity(resp); server == nil {
+			// only honor it if it matches the lease we hold for the nic
+			ok, err := p.holdsLease(ctx, req.ClientHWAddr, req.RequestedIPAddress())
+			if err != nil {
+				log.Errorf("unable to look up lease for nic %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if !ok {
+				log.Debugf("ignoring DHCP decline of %s meant for %v, nic %s does not hold it",
+					req.RequestedIPAddress(), req.ServerIdentifier(), req.ClientHWAddr)
+				return nil, true
+			}
+		} else if !req.ServerIdentifier().Equal(server) {
+			// ignore
+			log.Debugf("ignoring DHCP decline meant for %s", req.ServerIdentifier())
+			return nil, true
+		}
+
+		// the client found the address in use, keep it out of the
+		// free pool for a while
+		err := p.retry(ctx, func() error {
+			return p.declineLease(ctx, req.ClientHWAddr)
+		})
+		if errors.Is(err, ErrNoLease) {
+			log.Debugf("ignoring DHCP decline from %s, it holds no lease", req.ClientHWAddr)
+			return nil, true
+		}
+		if err != nil {
+			log.Errorf("error declining lease for nic %s: %v", req.ClientHWAddr, err)
+			return nil, true
+		}
+
 	default:
-		log.Errorf("unhandled DHCPv4 packet %v (%s): ", req.MessageType(), req.Summary())
+		// let monitoring tools query the lease of a known nic
+		if p.config.ReplyUnhandledWithLease {
+			var ip net.IP
+			err := p.retry(ctx, func() (err error) {
+				ip, err = p.nicLeasedIP(ctx, req.ClientHWAddr)
+				return err
+			})
+			if err != nil {
+				log.Errorf("unable to look up lease of MAC %s: %v", req.ClientHWAddr, err)
+				return nil, true
+			}
+			if ip != nil {
+				resp.ClientIPAddr = ip
+				p.replyOptions(req, resp)
+				log.Infof("answering DHCPv4 packet %v from %s with its lease of %s",
+					req.MessageType(), req.ClientHWAddr, ip)
+				return resp, false
+			}
+		}
+
+		log.Errorf("unhandled DHCPv4 packet %v (%s)", req.MessageType(), req.Summary())
 	}
 
 	return resp, false
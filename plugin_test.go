@@ -0,0 +1,359 @@
+package etcdplugin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+)
+
+// sendRequest has nic send a REQUEST built by modifiers, with no server
+// identifier nor requested address unless they add them
+func sendRequest(t testing.TB, p *PluginState, nic net.HardwareAddr, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(nic),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+	}, modifiers...)...)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+	return exchange(t, p, req)
+}
+
+func TestRequestClientStates(t *testing.T) {
+	other := net.IPv4(10, 0, 0, 9).To4()
+
+	for _, tt := range []struct {
+		name string
+		// builds the request from the ip the nic holds
+		modifiers func(ip net.IP) []dhcpv4.Modifier
+		config    []string
+		// the ip acked, nil for a NAK, unset with drop
+		acked func(ip net.IP) net.IP
+		drop  bool
+	}{
+		{
+			name: "renewing",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{dhcpv4.WithClientIP(ip)}
+			},
+			acked: func(ip net.IP) net.IP { return ip },
+		},
+		{
+			name: "rebinding",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{dhcpv4.WithClientIP(ip), dhcpv4.WithBroadcast(true)}
+			},
+			acked: func(ip net.IP) net.IP { return ip },
+		},
+		{
+			name: "init-reboot",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip))}
+			},
+			acked: func(ip net.IP) net.IP { return ip },
+		},
+		{
+			name: "no address",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return nil
+			},
+			acked: func(ip net.IP) net.IP { return nil },
+		},
+		{
+			name: "another server",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 253))),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+				}
+			},
+			drop: true,
+		},
+		{
+			name: "renewing disagreeing",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{
+					dhcpv4.WithClientIP(ip),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other)),
+				}
+			},
+			acked: func(ip net.IP) net.IP { return ip },
+		},
+		{
+			name: "selecting disagreeing",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+					dhcpv4.WithClientIP(other),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+				}
+			},
+			acked: func(ip net.IP) net.IP { return ip },
+		},
+		{
+			name: "strict disagreeing",
+			modifiers: func(ip net.IP) []dhcpv4.Modifier {
+				return []dhcpv4.Modifier{
+					dhcpv4.WithClientIP(ip),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(other)),
+				}
+			},
+			config: []string{"StrictRequestedIP = true"},
+			acked:  func(ip net.IP) net.IP { return nil },
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin(t, newFakeEtcd(), tt.config...)
+			nic := testMAC(1)
+			ip := lease(t, p, nic)
+
+			resp := sendRequest(t, p, nic, tt.modifiers(ip)...)
+			if tt.drop {
+				if resp != nil {
+					t.Fatalf("want the request dropped, got %v", resp.MessageType())
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("want a reply, the request was dropped")
+			}
+
+			want := tt.acked(ip)
+			if want == nil {
+				if resp.MessageType() != dhcpv4.MessageTypeNak {
+					t.Fatalf("want a NAK, got %v", resp.MessageType())
+				}
+				return
+			}
+			if resp.MessageType() != dhcpv4.MessageTypeAck || !resp.YourIPAddr.Equal(want) {
+				t.Fatalf("want an ACK of %s, got %v of %s", want, resp.MessageType(), resp.YourIPAddr)
+			}
+		})
+	}
+}
+
+func TestRequestHonorsOUIReservations(t *testing.T) {
+	f := newFakeEtcd()
+	// 9 of the 10 ips are kept for another OUI, the test nics' get one
+	p := newTestPlugin(t, f, "OUIReservations = 02:aa:bb=9")
+
+	ip := lease(t, p, testMAC(1))
+
+	// a nic of the class asking for another ip straight away is refused it
+	if resp := request(t, p, testMAC(2), net.IPv4(10, 0, 0, 5)); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("want a request eating into another OUI's reservation nacked, got %v", resp)
+	}
+	if _, ok := f.get(p.keys.LeasedIP(net.IPv4(10, 0, 0, 5))); ok {
+		t.Error("want 10.0.0.5 left free")
+	}
+
+	// the one it holds is renewed
+	if resp := request(t, p, testMAC(1), ip); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want the renewal of %s acked, got %v", ip, resp)
+	}
+
+	// a nic of the other class is served
+	other := net.HardwareAddr{0x02, 0xaa, 0xbb, 0, 0, 1}
+	if resp := request(t, p, other, net.IPv4(10, 0, 0, 5)); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want the request of %s acked, got %v", other, resp)
+	}
+}
+
+func TestDiscoverKeepsOUIReservations(t *testing.T) {
+	for _, cached := range []bool{false, true} {
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f, "OUIReservations = 02:aa:bb=3", "CacheFreeIPs = "+strconv.FormatBool(cached))
+		if cached {
+			waitFor(t, "the free ip cache", func() bool {
+				n, ok := p.freePool.size()
+				return ok && n == 10
+			})
+		}
+
+		// general clients get the 7 ips not reserved
+		for n := byte(1); n <= 7; n++ {
+			lease(t, p, testMAC(n))
+			if cached {
+				waitFor(t, "the free ip cache", func() bool {
+					free, ok := p.freePool.size()
+					return ok && free == 10-int(n)
+				})
+			}
+		}
+		if ip := discover(t, p, testMAC(8)); ip != nil {
+			t.Errorf("cached=%t: want the reserved ips kept from general clients, got %s offered", cached, ip)
+		}
+
+		reserved := net.HardwareAddr{0x02, 0xaa, 0xbb, 0, 0, 1}
+		if ip := discover(t, p, reserved); ip == nil {
+			t.Errorf("cached=%t: want %s offered one of its reserved ips", cached, reserved)
+		}
+	}
+}
+
+func TestOUICountsFollowLeases(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "OUIReservations = 02:aa:bb=2", "LeaseTime = 1h")
+	ctx := context.Background()
+
+	reserved := func(want int) {
+		t.Helper()
+		got, err := p.reservedForOthers(ctx, testMAC(1))
+		if err != nil {
+			t.Fatalf("could not count reserved ips: %v", err)
+		}
+		if got != want {
+			t.Errorf("want %d ips reserved for the other OUI, got %d", want, got)
+		}
+	}
+
+	first := net.HardwareAddr{0x02, 0xaa, 0xbb, 0, 0, 1}
+	second := net.HardwareAddr{0x02, 0xaa, 0xbb, 0, 0, 2}
+	lease(t, p, first)
+	reserved(1)
+
+	// counted once, then kept up to date without listing the leased nics
+	served := f.served()
+	reserved(1)
+	if f.served() != served {
+		t.Error("want the reserved ips counted without asking etcd")
+	}
+	lease(t, p, second)
+	reserved(0)
+	if err := p.revokeLease(ctx, second); err != nil {
+		t.Fatalf("could not revoke lease of %s: %v", second, err)
+	}
+	reserved(1)
+
+	// the monitor catches up with the expired leases
+	f.advance(2 * time.Hour)
+	if _, err := p.countOUIs(ctx); err != nil {
+		t.Fatalf("could not count leases of reserved OUIs: %v", err)
+	}
+	reserved(2)
+}
+
+func TestServeSubnetDropsOtherSubnets(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "ServeSubnet = 10.0.0.0/24")
+
+	for _, tt := range []struct {
+		giaddr  net.IP
+		dropped bool
+	}{
+		{net.IPv4(10, 0, 0, 254), false},
+		{net.IPv4(192, 168, 1, 1), true},
+	} {
+		req, err := dhcpv4.NewDiscovery(testMAC(1), dhcpv4.WithGatewayIP(tt.giaddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := exchange(t, p, req)
+		if dropped := resp == nil; dropped != tt.dropped {
+			t.Errorf("relayed from %s: want dropped %t, got %v", tt.giaddr, tt.dropped, resp)
+		}
+	}
+}
+
+func TestGlobalRateLimitShedsBurst(t *testing.T) {
+	f := newFakeEtcd()
+	// the bucket barely refills during the test
+	p := newTestPlugin(t, f, "GlobalRateLimit = 0.001", "GlobalRateBurst = 3")
+
+	shed := metricPacketsShed.Value()
+	answered := 0
+	for n := byte(1); n <= 10; n++ {
+		if ip := discover(t, p, testMAC(n)); ip != nil {
+			answered++
+		}
+	}
+
+	if answered != 3 {
+		t.Errorf("want the burst of 3 answered, got %d", answered)
+	}
+	if got := metricPacketsShed.Value() - shed; got != 7 {
+		t.Errorf("want 7 packets shed, got %d", got)
+	}
+}
+
+func TestRespectPeerScopeLeavesDiscoverToPeer(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "RespectPeerScope = true")
+
+	discoverFor := func(nic net.HardwareAddr, requested net.IP) *dhcpv4.DHCPv4 {
+		t.Helper()
+		req, err := dhcpv4.NewDiscovery(nic, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(requested)))
+		if err != nil {
+			t.Fatalf("could not build discover: %v", err)
+		}
+		return exchange(t, p, req)
+	}
+
+	// an address of the peer's range is left to the peer to offer
+	if resp := discoverFor(testMAC(1), net.IPv4(10, 0, 1, 7)); resp != nil {
+		t.Errorf("want a discover for an ip of a peer's range ignored, got %v", resp)
+	}
+	if offered := f.keys(p.keys.IP(IPStateOffered, "")); len(offered) != 0 {
+		t.Errorf("want nothing offered to the peer's client, got %v", offered)
+	}
+
+	// one of ours is offered
+	if resp := discoverFor(testMAC(2), net.IPv4(10, 0, 0, 7)); resp == nil || resp.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Errorf("want a discover for an ip of our range offered, got %v", resp)
+	}
+}
+
+// lockedBuffer collects log output written concurrently
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestPacketTraceDumpsOnlyWhenEnabled(t *testing.T) {
+	level, out := log.Logger.GetLevel(), log.Logger.Out
+	log.Logger.SetLevel(logrus.TraceLevel)
+	defer func() {
+		log.Logger.SetLevel(level)
+		log.Logger.SetOutput(out)
+	}()
+
+	for _, enabled := range []bool{false, true} {
+		var logged lockedBuffer
+		log.Logger.SetOutput(&logged)
+
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f, "PacketTrace = "+strconv.FormatBool(enabled))
+		discover(t, p, testMAC(1))
+
+		for _, what := range []string{"request", "response"} {
+			dumped := strings.Contains(logged.String(), what+" packet bytes")
+			if dumped != enabled {
+				t.Errorf("PacketTrace=%t: want the %s dumped %t, got %t", enabled, what, enabled, dumped)
+			}
+		}
+	}
+}
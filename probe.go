@@ -0,0 +1,83 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const constProbeTimeout = time.Second
+
+// Prober checks whether an address is in use on the network
+type Prober interface {
+	InUse(ctx context.Context, ip net.IP) (bool, error)
+}
+
+// ICMPProber probes addresses with an ICMP echo request, it requires
+// the privileges to open raw sockets
+type ICMPProber struct{}
+
+func (ICMPProber) InUse(ctx context.Context, ip net.IP) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, errors.Wrap(err, "could not open icmp socket")
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(constProbeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return false, errors.Wrap(err, "could not set icmp deadline")
+	}
+
+	id := uint16(os.Getpid())
+	if _, err := conn.WriteTo(icmpEcho(id, 1), &net.IPAddr{IP: ip}); err != nil {
+		return false, errors.Wrap(err, "could not send icmp echo")
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				// nobody answered
+				return false, nil
+			}
+			return false, errors.Wrap(err, "could not read icmp reply")
+		}
+
+		addr, ok := peer.(*net.IPAddr)
+		if !ok || !addr.IP.Equal(ip) {
+			continue
+		}
+		// echo reply with our identifier
+		if n >= 8 && buf[0] == 0 && binary.BigEndian.Uint16(buf[4:6]) == id {
+			return true, nil
+		}
+	}
+}
+
+// icmpEcho builds an ICMP echo request message
+func icmpEcho(id, seq uint16) []byte {
+	msg := make([]byte, 8)
+	msg[0] = 8 // echo request
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+
+	var sum uint32
+	for i := 0; i < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i : i+2]))
+	}
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum += sum >> 16
+	binary.BigEndian.PutUint16(msg[2:4], ^uint16(sum))
+
+	return msg
+}
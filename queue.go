@@ -0,0 +1,88 @@
+package etcdplugin
+
+import (
+	"context"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// packets waiting for the lease queue before senders block
+const constLeaseQueueSize = 64
+
+// leaseJob is a packet waiting to be handled by the lease queue
+type leaseJob struct {
+	ctx    context.Context
+	req    *dhcpv4.DHCPv4
+	resp   *dhcpv4.DHCPv4
+	result chan leaseResult
+}
+
+// leaseResult is what handling a leaseJob returned
+type leaseResult struct {
+	resp *dhcpv4.DHCPv4
+	stop bool
+}
+
+// leaseQueue handles packets one after the other on a single goroutine, so
+// that their lease operations against etcd are applied in the order the
+// packets arrived
+type leaseQueue struct {
+	jobs   chan leaseJob
+	handle func(context.Context, *dhcpv4.DHCPv4, *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
+}
+
+func newLeaseQueue(handle func(context.Context, *dhcpv4.DHCPv4, *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)) *leaseQueue {
+	return &leaseQueue{
+		jobs:   make(chan leaseJob, constLeaseQueueSize),
+		handle: handle,
+	}
+}
+
+// run handles the queued packets until ctx is done
+func (q *leaseQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-q.jobs:
+			// its handler gave up waiting
+			if job.ctx.Err() != nil {
+				log.Debugf("dropping DHCPv4 packet %v from %s, it expired in the lease queue",
+					job.req.MessageType(), job.req.ClientHWAddr)
+				continue
+			}
+
+			resp, stop := q.handle(job.ctx, job.req, job.resp)
+			job.result <- leaseResult{resp: resp, stop: stop}
+		}
+	}
+}
+
+// do queues a packet and waits for it to be handled, the packet is dropped
+// when ctx is done first
+func (q *leaseQueue) do(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	job := leaseJob{
+		ctx:  ctx,
+		req:  req,
+		resp: resp,
+		// never blocks the queue on a handler that gave up
+		result: make(chan leaseResult, 1),
+	}
+
+	select {
+	case q.jobs <- job:
+	case <-ctx.Done():
+		log.Warningf("lease queue is full, dropping DHCPv4 packet %v from %s",
+			req.MessageType(), req.ClientHWAddr)
+		return nil, true
+	}
+
+	select {
+	case result := <-job.result:
+		return result.resp, result.stop
+	case <-ctx.Done():
+		log.Warningf("timed out waiting on the lease queue, dropping DHCPv4 packet %v from %s",
+			req.MessageType(), req.ClientHWAddr)
+		return nil, true
+	}
+}
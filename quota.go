@@ -0,0 +1,75 @@
+package etcdplugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	etcdpb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// etcd's default backend quota
+	constDefaultEtcdQuotaBytes = 2 << 30
+	// rough cost of a key in etcd's backend beyond its key and value,
+	// its revision and index entries
+	constEtcdKeyOverhead = 256
+)
+
+// checkQuota refuses to bootstrap when etcd is out of space, or when the
+// keys of the range would likely not fit in what's left of its quota,
+// rather than failing halfway through
+func (p *PluginState) checkQuota(ctx context.Context) error {
+	client := p.etcdClient()
+
+	alarms, err := client.AlarmList(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not list etcd alarms")
+	}
+	for _, alarm := range alarms.Alarms {
+		if alarm.Alarm == etcdpb.AlarmType_NOSPACE {
+			return fmt.Errorf("etcd member %x raised a NOSPACE alarm, not bootstrapping", alarm.MemberID)
+		}
+	}
+
+	var dbSize int64
+	for _, endpoint := range client.Endpoints() {
+		status, err := client.Status(ctx, endpoint)
+		if err != nil {
+			log.Warningf("could not get status of etcd endpoint %s: %v", endpoint, err)
+			continue
+		}
+		if status.DbSize > dbSize {
+			dbSize = status.DbSize
+		}
+	}
+
+	// ips already bootstrapped by a previous run are accounted for
+	missing := int64(len(p.allocator.Range()))
+	for _, state := range ipStates {
+		resp, err := p.kv().Get(ctx, p.keys.IP(state, ""), etcd.WithPrefix(), etcd.WithCountOnly())
+		if err != nil {
+			return errors.Wrapf(err, "could not count %s ips", state)
+		}
+		missing -= resp.Count
+	}
+	if missing < 0 {
+		missing = 0
+	}
+
+	// a free key per missing ip, in the longest form it can take
+	perKey := len(p.keys.IP(IPStateFree, "255.255.255.255")) +
+		len(p.encodeFreeValue(p.ranges[len(p.ranges)-1].end, make([]byte, 6))) +
+		constEtcdKeyOverhead
+	estimate := int64(perKey) * missing
+
+	if dbSize+estimate > p.config.EtcdQuotaBytes {
+		return fmt.Errorf("bootstrapping needs about %d bytes, etcd holds %d of its %d bytes quota",
+			estimate, dbSize, p.config.EtcdQuotaBytes)
+	}
+	log.Debugf("bootstrapping needs about %d bytes, etcd holds %d of its %d bytes quota",
+		estimate, dbSize, p.config.EtcdQuotaBytes)
+
+	return nil
+}
@@ -0,0 +1,310 @@
+package etcdplugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/pkg/errors"
+)
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	start, end net.IP
+}
+
+func (r ipRange) String() string {
+	return fmt.Sprintf("%s-%s", r.start, r.end)
+}
+
+// ipRanges are the disjoint ranges ips are leased from, in the order they
+// are drawn from
+type ipRanges []ipRange
+
+// parseRange parses the bounds of a range
+func parseRange(start, end string) (ipRange, error) {
+	ipStart := net.ParseIP(start).To4()
+	if ipStart == nil {
+		return ipRange{}, fmt.Errorf("invalid IPv4 address: %v", start)
+	}
+	ipEnd := net.ParseIP(end).To4()
+	if ipEnd == nil {
+		return ipRange{}, fmt.Errorf("invalid IPv4 address: %v", end)
+	}
+	if binary.BigEndian.Uint32(ipStart) >= binary.BigEndian.Uint32(ipEnd) {
+		return ipRange{}, errors.New("start of IP range has to be lower than the end of an IP range")
+	}
+
+	return ipRange{start: ipStart, end: ipEnd}, nil
+}
+
+// ipRange6 is an inclusive range of IPv6 addresses, too large to enumerate
+// in general
+type ipRange6 struct {
+	start, end net.IP
+}
+
+func (r ipRange6) String() string {
+	return fmt.Sprintf("%s-%s", r.start, r.end)
+}
+
+// parseRange6 parses the bounds of an IPv6 range
+func parseRange6(start, end string) (ipRange6, error) {
+	ipStart := net.ParseIP(start)
+	if ipStart == nil || ipStart.To4() != nil {
+		return ipRange6{}, fmt.Errorf("invalid IPv6 address: %v", start)
+	}
+	ipEnd := net.ParseIP(end)
+	if ipEnd == nil || ipEnd.To4() != nil {
+		return ipRange6{}, fmt.Errorf("invalid IPv6 address: %v", end)
+	}
+	if bytes.Compare(ipStart, ipEnd) >= 0 {
+		return ipRange6{}, errors.New("start of IP range has to be lower than the end of an IP range")
+	}
+
+	return ipRange6{start: ipStart, end: ipEnd}, nil
+}
+
+// size is how many addresses the range holds
+func (r ipRange6) size() *big.Int {
+	size := new(big.Int).SetBytes(r.end)
+	size.Sub(size, new(big.Int).SetBytes(r.start))
+	return size.Add(size, big.NewInt(1))
+}
+
+// contains reports whether ip lies within the range
+func (r ipRange6) contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	return ip16 != nil && ip.To4() == nil &&
+		bytes.Compare(ip16, r.start) >= 0 && bytes.Compare(ip16, r.end) <= 0
+}
+
+// nth returns the address n past the start of the range, wrapping around
+// to the start
+func (r ipRange6) nth(n *big.Int) net.IP {
+	return IPAdd6(r.start, new(big.Int).Mod(n, r.size()))
+}
+
+// parseRanges parses the Start-End range followed by the extra Ranges,
+// given as <start>-<end>
+func parseRanges(c Config) (ipRanges, error) {
+	first, err := parseRange(c.Start, c.End)
+	if err != nil {
+		return nil, err
+	}
+	ranges := ipRanges{first}
+
+	for _, value := range c.Ranges {
+		bounds := strings.Split(value, "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid range in Ranges, want <start>-<end>: %v", value)
+		}
+		r, err := parseRange(strings.TrimSpace(bounds[0]), strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range in Ranges: %w", err)
+		}
+		if other, ok := ranges.overlapping(r); ok {
+			return nil, fmt.Errorf("range %s overlaps range %s", r, other)
+		}
+		ranges = append(ranges, r)
+	}
+
+	return ranges, nil
+}
+
+// overlapping returns the first of the ranges r overlaps, if any
+func (r ipRanges) overlapping(rng ipRange) (ipRange, bool) {
+	for _, other := range r {
+		if IPInRange(rng.start, other.start, other.end) || IPInRange(other.start, rng.start, rng.end) {
+			return other, true
+		}
+	}
+	return ipRange{}, false
+}
+
+// contains reports whether ip lies within any of the ranges
+func (r ipRanges) contains(ip net.IP) bool {
+	return r.offset(ip) >= 0
+}
+
+// size is how many ips the ranges hold
+func (r ipRanges) size() int {
+	size := 0
+	for _, rng := range r {
+		size += int(binary.BigEndian.Uint32(rng.end)-binary.BigEndian.Uint32(rng.start)) + 1
+	}
+	return size
+}
+
+// offset is the position of ip counting through the ranges in order, -1
+// when it lies outside of them
+func (r ipRanges) offset(ip net.IP) int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return -1
+	}
+
+	return r.offsetOf(binary.BigEndian.Uint32(ip4))
+}
+
+// offsetOf is offset for an ip as a number
+func (r ipRanges) offsetOf(n uint32) int {
+	offset := 0
+	for _, rng := range r {
+		start, end := binary.BigEndian.Uint32(rng.start), binary.BigEndian.Uint32(rng.end)
+		if n >= start && n <= end {
+			return offset + int(n-start)
+		}
+		offset += int(end-start) + 1
+	}
+
+	return -1
+}
+
+// nth is the ip at offset n counting through the ranges in order, nil when
+// the ranges hold fewer
+func (r ipRanges) nth(n int) net.IP {
+	for _, rng := range r {
+		size := int(binary.BigEndian.Uint32(rng.end)-binary.BigEndian.Uint32(rng.start)) + 1
+		if n < size {
+			return IPAdd(rng.start, n)
+		}
+		n -= size
+	}
+
+	return nil
+}
+
+func (r ipRanges) String() string {
+	s := make([]string, 0, len(r))
+	for _, rng := range r {
+		s = append(s, rng.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// exclusions are addresses within the ranges that are never leased
+type exclusions []*net.IPNet
+
+// parseExclusions parses the Exclude ips and CIDRs, which must lie within
+// the ranges
+func parseExclusions(values []string, ranges ipRanges) (exclusions, error) {
+	exclude := make(exclusions, 0, len(values))
+	for _, value := range values {
+		var ipnet *net.IPNet
+		if ip := net.ParseIP(value).To4(); ip != nil {
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+		} else if _, n, err := net.ParseCIDR(value); err == nil && n.IP.To4() != nil {
+			ipnet = n
+		} else {
+			return nil, fmt.Errorf("invalid IPv4 address or CIDR in Exclude: %v", value)
+		}
+
+		first, last := ipnet.IP.To4(), broadcastOf(ipnet.IP, ipnet.Mask)
+		within := false
+		for _, rng := range ranges {
+			within = within || (IPInRange(first, rng.start, rng.end) && IPInRange(last, rng.start, rng.end))
+		}
+		if !within {
+			return nil, fmt.Errorf("excluded %s is not within the ranges %s", value, ranges)
+		}
+		exclude = append(exclude, ipnet)
+	}
+
+	return exclude, nil
+}
+
+// contains reports whether ip is excluded
+func (e exclusions) contains(ip net.IP) bool {
+	for _, ipnet := range e {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangesAllocator draws from an allocator per range, in order, leaving out
+// the excluded ips
+type rangesAllocator struct {
+	ranges     ipRanges
+	exclude    exclusions
+	allocators []allocators.Allocator
+}
+
+// newRangesAllocator builds a bitmap allocator per range, with the excluded
+// ips already allocated
+func newRangesAllocator(ranges ipRanges, exclude exclusions) (*rangesAllocator, error) {
+	a := &rangesAllocator{ranges: ranges}
+	for _, rng := range ranges {
+		allocator, err := bitmap.NewIPv4Allocator(rng.start, rng.end)
+		if err != nil {
+			return nil, err
+		}
+		a.allocators = append(a.allocators, allocator)
+	}
+
+	for _, ipnet := range a.Range() {
+		if !exclude.contains(ipnet.IP) {
+			continue
+		}
+		if _, err := a.Allocate(ipnet); err != nil {
+			return nil, err
+		}
+	}
+	a.exclude = exclude
+
+	return a, nil
+}
+
+// Allocate allocates from the range of the hint, or else from the first
+// range with an available ip
+func (a *rangesAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	for i, rng := range a.ranges {
+		if hint.IP != nil && IPInRange(hint.IP, rng.start, rng.end) {
+			if n, err := a.allocators[i].Allocate(hint); err == nil {
+				return n, nil
+			}
+		}
+	}
+
+	for _, allocator := range a.allocators {
+		n, err := allocator.Allocate(hint)
+		if errors.Is(err, allocators.ErrNoAddrAvail) {
+			continue
+		}
+		return n, err
+	}
+
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// Free returns n to the range it belongs to
+func (a *rangesAllocator) Free(n net.IPNet) error {
+	for i, rng := range a.ranges {
+		if IPInRange(n.IP, rng.start, rng.end) {
+			return a.allocators[i].Free(n)
+		}
+	}
+
+	return &allocators.ErrDoubleFree{Loc: n}
+}
+
+// Range returns the ips of all the ranges, in order, but the excluded ones
+func (a *rangesAllocator) Range() []net.IPNet {
+	ips := make([]net.IPNet, 0, a.ranges.size())
+	for _, allocator := range a.allocators {
+		for _, ipnet := range allocator.Range() {
+			if !a.exclude.contains(ipnet.IP) {
+				ips = append(ips, ipnet)
+			}
+		}
+	}
+
+	return ips
+}
@@ -0,0 +1,90 @@
+package etcdplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// relayPool are the ranges leased to clients behind the relays of a subnet,
+// their replies carry the subnet's mask and the relay as their router
+type relayPool struct {
+	subnet *net.IPNet
+	ranges ipRanges
+}
+
+// parseRelayPools parses pools of the form <cidr>=<start>-<end>, more ranges
+// of the same subnet separated by commas, eg.
+// 10.1.0.0/24=10.1.0.10-10.1.0.99,10.1.0.150-10.1.0.199. The ranges must
+// lie within their subnet and not overlap each other nor the ones in taken
+func parseRelayPools(values []string, taken ipRanges) ([]relayPool, error) {
+	pools := make([]relayPool, 0, len(values))
+	for _, value := range values {
+		tokens := strings.SplitN(value, "=", 2)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed relay pool, want <cidr>=<start>-<end>: %s", value)
+		}
+
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(tokens[0]))
+		if err != nil || subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 subnet in relay pool: %s", value)
+		}
+		for _, other := range pools {
+			if other.subnet.Contains(subnet.IP) || subnet.Contains(other.subnet.IP) {
+				return nil, fmt.Errorf("relay pool subnet %s overlaps %s", subnet, other.subnet)
+			}
+		}
+
+		pool := relayPool{subnet: subnet}
+		for _, bounds := range strings.Split(tokens[1], ",") {
+			start, end, ok := strings.Cut(bounds, "-")
+			if !ok {
+				return nil, fmt.Errorf("malformed range in relay pool, want <start>-<end>: %s", value)
+			}
+			r, err := parseRange(strings.TrimSpace(start), strings.TrimSpace(end))
+			if err != nil {
+				return nil, fmt.Errorf("invalid range in relay pool %s: %w", value, err)
+			}
+			if !subnet.Contains(r.start) || !subnet.Contains(r.end) {
+				return nil, fmt.Errorf("range %s is not within relay pool subnet %s", r, subnet)
+			}
+			if other, ok := taken.overlapping(r); ok {
+				return nil, fmt.Errorf("range %s overlaps range %s", r, other)
+			}
+
+			pool.ranges = append(pool.ranges, r)
+			taken = append(taken, r)
+		}
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// relayPoolOf returns the pool of the subnet of the relay a request came
+// through, nil when it came directly or through a relay without a pool
+func (p *PluginState) relayPoolOf(req *dhcpv4.DHCPv4) *relayPool {
+	giaddr := req.GatewayIPAddr
+	if giaddr == nil || giaddr.IsUnspecified() {
+		return nil
+	}
+
+	for i := range p.relayPools {
+		if p.relayPools[i].subnet.Contains(giaddr) {
+			return &p.relayPools[i]
+		}
+	}
+
+	return nil
+}
+
+// rangesFor returns the ranges a request's client is leased from, its relay
+// pool's or the Start-End and Ranges ones
+func (p *PluginState) rangesFor(req *dhcpv4.DHCPv4) ipRanges {
+	if pool := p.relayPoolOf(req); pool != nil {
+		return pool.ranges
+	}
+	return p.directRanges
+}
@@ -0,0 +1,164 @@
+package etcdplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// reservations pin ips of the range to nics. A reserved ip is kept in the
+// reserved state instead of free, out of the pool, whenever its nic does
+// not hold it
+type reservations struct {
+	byNic map[string]net.IP
+	byIP  map[string]net.HardwareAddr
+}
+
+// LoadReservations reads a reservations file, one <mac> <ip> pair per line,
+// the ips must lie within the ranges
+func LoadReservations(filename string, ranges ipRanges) (*reservations, error) {
+	log.Infof("reading reservations from %s", filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reservations{
+		byNic: make(map[string]net.IP),
+		byIP:  make(map[string]net.HardwareAddr),
+	}
+
+	for _, lineBytes := range bytes.Split(data, []byte{'\n'}) {
+		line := strings.TrimSpace(string(lineBytes))
+		if len(line) == 0 {
+			continue
+		}
+		// comment
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Fields(line)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed reservation, want 2 fields, got %d: %s", len(tokens), line)
+		}
+
+		nic, err := net.ParseMAC(tokens[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+		}
+		ip := net.ParseIP(tokens[1]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("malformed IPv4 address: %s", tokens[1])
+		}
+		if !ranges.contains(ip) {
+			return nil, fmt.Errorf("reserved ip %s of %s is outside of the ranges %s", ip, nic, ranges)
+		}
+		if other, ok := r.byIP[ip.String()]; ok {
+			return nil, fmt.Errorf("ip %s is reserved for both %s and %s", ip, other, nic)
+		}
+		if other, ok := r.byNic[nic.String()]; ok {
+			return nil, fmt.Errorf("%s has both %s and %s reserved", nic, other, ip)
+		}
+
+		r.byNic[nic.String()] = ip
+		r.byIP[ip.String()] = nic
+	}
+
+	return r, nil
+}
+
+// ipOf returns the ip reserved for nic, nil if none
+func (r *reservations) ipOf(nic net.HardwareAddr) net.IP {
+	if r == nil {
+		return nil
+	}
+	return r.byNic[nic.String()]
+}
+
+// reserved reports whether ip is reserved for some nic
+func (r *reservations) reserved(ip net.IP) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.byIP[ip.String()]
+	return ok
+}
+
+// byIPs returns the reserved ips along with the nics they are reserved for
+func (r *reservations) byIPs() map[string]net.HardwareAddr {
+	if r == nil {
+		return nil
+	}
+	return r.byIP
+}
+
+// staticNameConflicts cross-checks the static names of the names file, by
+// nic, against the reservations. A name shared by several nics, one of them
+// reserved, resolves to the reserved ip as well as to the ips the others
+// lease, DNS and DHCP then disagree on where the name is
+func staticNameConflicts(static map[string]string, r *reservations) []string {
+	if r == nil {
+		return nil
+	}
+
+	nicsOf := make(map[string][]string)
+	for nic, name := range static {
+		nicsOf[name] = append(nicsOf[name], nic)
+	}
+	names := make([]string, 0, len(nicsOf))
+	for name := range nicsOf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []string
+	for _, name := range names {
+		nics := nicsOf[name]
+		if len(nics) < 2 {
+			continue
+		}
+		sort.Strings(nics)
+
+		var reserved []string
+		for _, nic := range nics {
+			if ip := r.byNic[nic]; ip != nil {
+				reserved = append(reserved, fmt.Sprintf("%s reserved %s", nic, ip))
+			}
+		}
+		if len(reserved) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf("static name %s of %s resolves to the ips of all of them, %s",
+				name, strings.Join(nics, ", "), strings.Join(reserved, ", ")))
+		}
+	}
+
+	return conflicts
+}
+
+// unleasedState is the state ip is in, while not offered or leased, for nic
+// to take it from: reserved if it's reserved for nic, free otherwise
+func (p *PluginState) unleasedState(nic net.HardwareAddr, ip net.IP) IPState {
+	if reserved := p.reservations.ipOf(nic); reserved != nil && reserved.Equal(ip) {
+		return IPStateReserved
+	}
+	return IPStateFree
+}
+
+// isReserved reports whether ip is in the reserved state, waiting for its
+// nic
+func (p *PluginState) isReserved(ctx context.Context, ip net.IP) (bool, error) {
+	resp, err := p.kv().
+		Get(ctx, p.keys.IP(IPStateReserved, ip.String()), etcd.WithCountOnly())
+	if err != nil {
+		return false, errors.Wrap(err, "could not get reserved ip")
+	}
+
+	return resp.Count > 0, nil
+}
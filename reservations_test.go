@@ -0,0 +1,153 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// writeReservations writes a reservations file of lines and returns its path
+func writeReservations(t testing.TB, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "reservations")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatalf("could not write reservations: %v", err)
+	}
+	return path
+}
+
+func TestStaticNameConflicts(t *testing.T) {
+	r := &reservations{
+		byNic: map[string]net.IP{testMAC(1).String(): net.IPv4(10, 0, 0, 5).To4()},
+		byIP:  map[string]net.HardwareAddr{"10.0.0.5": testMAC(1)},
+	}
+
+	conflicts := staticNameConflicts(map[string]string{
+		testMAC(1).String(): "printer",
+		testMAC(2).String(): "printer",
+		// shared, but neither is reserved
+		testMAC(3).String(): "kiosk",
+		testMAC(4).String(): "kiosk",
+		// reserved, with a name of its own
+		testMAC(5).String(): "nas",
+	}, r)
+
+	if len(conflicts) != 1 || !strings.Contains(conflicts[0], "printer") ||
+		!strings.Contains(conflicts[0], "10.0.0.5") {
+		t.Fatalf("want the shared name of the reserved nic reported, got %q", conflicts)
+	}
+}
+
+func TestStaticNameFollowsReservation(t *testing.T) {
+	f := newFakeEtcd()
+	nic := testMAC(1)
+	p := newTestPlugin(t, f,
+		"Reservations = "+writeReservations(t, nic.String()+" 10.0.0.5"),
+		"DNSNames = "+writeNames(t, "static printer "+nic.String()))
+	ctx := context.Background()
+
+	reserved := net.IPv4(10, 0, 0, 5).To4()
+	other := net.IPv4(10, 0, 0, 6).To4()
+	for _, ip := range []net.IP{reserved, other} {
+		if err := p.dns.Register(ctx, p.etcdClient(), "", ip, nic, time.Minute); err != nil {
+			t.Fatalf("could not register %s: %v", ip, err)
+		}
+	}
+
+	if value, _ := f.get(p.dns.keys.AddressRecord("printer", reserved)); value != reserved.String() {
+		t.Errorf("want the static name pointing at the reserved %s, got %q", reserved, value)
+	}
+}
+
+func TestReservationOffered(t *testing.T) {
+	f := newFakeEtcd()
+	nic := testMAC(1)
+	p := newTestPlugin(t, f, "Reservations = "+writeReservations(t,
+		"# the printer",
+		nic.String()+" 10.0.0.5"))
+
+	reserved := net.IPv4(10, 0, 0, 5).To4()
+	if _, ok := f.get(p.keys.IP(IPStateReserved, reserved.String())); !ok {
+		t.Fatalf("want %s out of the pool, reserved", reserved)
+	}
+	if _, ok := f.get(p.keys.FreeIP(reserved)); ok {
+		t.Fatalf("want %s not free", reserved)
+	}
+
+	if ip := lease(t, p, nic); !ip.Equal(reserved) {
+		t.Errorf("want %s leased its reserved %s, got %s", nic, reserved, ip)
+	}
+
+	// other nics are never offered it
+	for n := byte(2); n <= 10; n++ {
+		if ip := lease(t, p, testMAC(n)); ip.Equal(reserved) {
+			t.Errorf("want %s not leased the reserved %s", testMAC(n), reserved)
+		}
+	}
+}
+
+func TestReservationOutsideRange(t *testing.T) {
+	f := newFakeEtcd()
+	for _, line := range []string{
+		testMAC(1).String() + " 10.0.0.50",
+		testMAC(1).String() + " 10.0.0.5 extra",
+		"not-a-mac 10.0.0.5",
+		testMAC(1).String() + " 10.0.0.5\n" + testMAC(2).String() + " 10.0.0.5",
+	} {
+		_, err := newPluginState(testConfig(t, "Reservations = "+writeReservations(t, line)), f.dial)
+		if err == nil {
+			t.Errorf("want the reservation %q refused", line)
+		}
+	}
+}
+
+func TestReservationOfLeasedIP(t *testing.T) {
+	f := newFakeEtcd()
+	reserved := net.IPv4(10, 0, 0, 5).To4()
+
+	// another nic leases the ip before it's reserved
+	holder := testMAC(2)
+	before := newTestPlugin(t, f)
+	if resp := request(t, before, holder, reserved); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("want %s acked %s, got %v", holder, reserved, resp)
+	}
+
+	nic := testMAC(1)
+	p := newTestPlugin(t, f, "Reservations = "+writeReservations(t, nic.String()+" "+reserved.String()))
+
+	// the holder keeps renewing it while the reserved nic is given another
+	if resp := request(t, p, holder, reserved); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want the renewal of %s by %s acked, got %v", reserved, holder, resp)
+	}
+	other := discover(t, p, nic)
+	if other == nil || other.Equal(reserved) {
+		t.Fatalf("want %s offered an ip other than the taken %s, got %s", nic, reserved, other)
+	}
+
+	// once let go the ip is reserved instead of freed
+	if err := p.revokeLease(context.Background(), holder); err != nil {
+		t.Fatalf("could not revoke lease of %s: %v", holder, err)
+	}
+	if _, ok := f.get(p.keys.IP(IPStateReserved, reserved.String())); !ok {
+		t.Errorf("want the released %s reserved", reserved)
+	}
+	if _, ok := f.get(p.keys.FreeIP(reserved)); ok {
+		t.Errorf("want the released %s not free", reserved)
+	}
+
+	// and the reserved nic is turned away from the ip it was offered, to
+	// its own
+	if resp := request(t, p, nic, other); resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("want the request of %s for %s refused, got %v", nic, other, resp)
+	}
+	if resp := request(t, p, nic, reserved); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("want %s acked its reserved %s, got %v", nic, reserved, resp)
+	}
+}
@@ -0,0 +1,169 @@
+package etcdplugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
+)
+
+// etcdClient returns the current etcd client
+func (p *PluginState) etcdClient() *etcd.Client {
+	p.clientMu.RLock()
+	defer p.clientMu.RUnlock()
+
+	return p.client
+}
+
+// namespace is the etcd namespace the plugin's operations are scoped to
+// when Namespace is set
+func (p *PluginState) namespace() string {
+	return p.config.Prefix + p.config.Separator
+}
+
+// kv returns the KV of the current etcd client
+func (p *PluginState) kv() etcd.KV {
+	kv := p.etcdClient().KV
+	if p.config.Namespace {
+		return namespace.NewKV(kv, p.namespace())
+	}
+	return kv
+}
+
+// watcher returns the Watcher of the current etcd client
+func (p *PluginState) watcher() etcd.Watcher {
+	watcher := p.etcdClient().Watcher
+	if p.config.Namespace {
+		return namespace.NewWatcher(watcher, p.namespace())
+	}
+	return watcher
+}
+
+// lease returns the Lease of the current etcd client
+func (p *PluginState) lease() etcd.Lease {
+	lease := p.etcdClient().Lease
+	if p.config.Namespace {
+		return namespace.NewLease(lease, p.namespace())
+	}
+	return lease
+}
+
+// retry runs an etcd operation, backing off and running it again while etcd
+// rejects it as overloaded or fails it transiently, and re-authenticating
+// and running it again if it failed because the client's auth token expired
+func (p *PluginState) retry(ctx context.Context, op func() error) error {
+	// the client the operation last ran on, the one to replace if its
+	// token expired
+	var client *etcd.Client
+	run := op
+	op = func() error {
+		client = p.etcdClient()
+		return run()
+	}
+
+	err := op()
+	for attempt := 0; attempt < constOverloadRetries && isOverloaded(err); attempt++ {
+		backoff := p.backpressure.reject()
+		log.Warningf("etcd is overloaded, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		err = op()
+	}
+
+	backoff := p.config.TransientBackoff
+	for attempt := 0; attempt < p.config.TransientRetries && isTransient(err); attempt++ {
+		log.Warningf("transient etcd failure, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = op()
+	}
+	if err == nil {
+		p.backpressure.accept()
+	}
+
+	if err == nil || !p.config.ReauthOnExpiry || !isAuthExpired(err) {
+		return err
+	}
+
+	log.Warningf("etcd auth token expired, re-authenticating: %v", err)
+	if err := p.reconnect(client); err != nil {
+		return errors.WithMessage(err, "could not re-authenticate")
+	}
+
+	return op()
+}
+
+// reconnect replaces the etcd client failed with a new one, freshly
+// authenticated and synced. Nothing is done when failed was replaced
+// already, by another operation that failed along with it
+func (p *PluginState) reconnect(failed *etcd.Client) error {
+	p.reconnectMu.Lock()
+	defer p.reconnectMu.Unlock()
+
+	if p.etcdClient() != failed {
+		return nil
+	}
+
+	// the new client outlives the operation that triggered it, dial
+	// bounds how long creating it takes
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+	client, err := p.dial(clientCtx, p.config)
+	if err != nil {
+		clientCancel()
+		return err
+	}
+
+	p.clientMu.Lock()
+	old, oldCancel := p.client, p.clientCancel
+	p.client, p.clientCancel = client, clientCancel
+	p.clientMu.Unlock()
+
+	oldCancel()
+	if err := old.Close(); err != nil {
+		log.Warningf("could not close replaced etcd client: %v", err)
+	}
+
+	return nil
+}
+
+// isTransient reports whether an etcd error is likely to go away on its
+// own shortly, such as during a leader election, as opposed to the ones
+// about the operation itself
+func isTransient(err error) bool {
+	for err != nil {
+		switch rpctypes.Error(err) {
+		case rpctypes.ErrNoLeader, rpctypes.ErrLeaderChanged, rpctypes.ErrTimeout,
+			rpctypes.ErrTimeoutDueToLeaderFail, rpctypes.ErrTimeoutDueToConnectionLost:
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+
+	return false
+}
+
+// isAuthExpired reports whether an etcd error means the client's auth token
+// is no longer valid
+func isAuthExpired(err error) bool {
+	for err != nil {
+		switch rpctypes.Error(err) {
+		case rpctypes.ErrInvalidAuthToken, rpctypes.ErrAuthOldRevision, rpctypes.ErrUserEmpty:
+			return true
+		}
+		err = errors.Unwrap(err)
+	}
+
+	return false
+}
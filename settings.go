@@ -0,0 +1,129 @@
+package etcdplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// Settings are the config values that can be overridden centrally through
+// etcd, under <prefix>::config::<name>, values found in etcd take
+// precedence over the ones in the config file
+type Settings struct {
+	LeaseTime time.Duration
+	// MinLeaseTime and MaxLeaseTime bound the lease times clients
+	// request, zero leaves them unbounded
+	MinLeaseTime    time.Duration
+	MaxLeaseTime    time.Duration
+	MonitorInterval time.Duration
+}
+
+// fileSettings are the settings of the config file
+func fileSettings(c Config) Settings {
+	return Settings{
+		LeaseTime:       c.LeaseTime,
+		MinLeaseTime:    c.MinLeaseTime,
+		MaxLeaseTime:    c.MaxLeaseTime,
+		MonitorInterval: c.MonitorInterval,
+	}
+}
+
+// validate checks the lease time lies within its bounds
+func (s Settings) validate() error {
+	if s.MaxLeaseTime > 0 && s.MinLeaseTime > s.MaxLeaseTime {
+		return fmt.Errorf("MinLeaseTime %s is above MaxLeaseTime %s", s.MinLeaseTime, s.MaxLeaseTime)
+	}
+	if s.LeaseTime < s.MinLeaseTime || (s.MaxLeaseTime > 0 && s.LeaseTime > s.MaxLeaseTime) {
+		return fmt.Errorf("LeaseTime %s is outside of MinLeaseTime %s and MaxLeaseTime %s",
+			s.LeaseTime, s.MinLeaseTime, s.MaxLeaseTime)
+	}
+	return nil
+}
+
+// settings returns the settings currently in effect
+func (p *PluginState) settings() Settings {
+	p.settingsMu.RLock()
+	defer p.settingsMu.RUnlock()
+
+	return p.current
+}
+
+// loadSettings reads the overrides stored in etcd and applies them on top
+// of the config file values. Overrides that together fail validation are
+// ignored, keeping the settings in effect
+func (p *PluginState) loadSettings(ctx context.Context) error {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.Config(""), etcd.WithPrefix())
+	if err != nil {
+		return errors.Wrap(err, "could not list config overrides")
+	}
+
+	settings := fileSettings(p.config)
+
+	for _, kv := range resp.Kvs {
+		name := p.keys.ParseConfig(string(kv.Key))
+
+		var setting *time.Duration
+		switch strings.ToLower(name) {
+		case "leasetime":
+			setting = &settings.LeaseTime
+		case "minleasetime":
+			setting = &settings.MinLeaseTime
+		case "maxleasetime":
+			setting = &settings.MaxLeaseTime
+		case "monitorinterval":
+			setting = &settings.MonitorInterval
+		default:
+			log.Warningf("ignoring unknown config override %s", kv.Key)
+			continue
+		}
+
+		d, err := time.ParseDuration(string(kv.Value))
+		if err != nil || d <= 0 {
+			log.Warningf("ignoring invalid config override %s=%s", kv.Key, kv.Value)
+			continue
+		}
+		*setting = d
+	}
+
+	if err := settings.validate(); err != nil {
+		log.Errorf("ignoring config overrides, keeping settings %+v: %v", p.settings(), err)
+		return nil
+	}
+
+	p.settingsMu.Lock()
+	p.current = settings
+	p.settingsMu.Unlock()
+
+	log.Infof("effective settings: %+v", settings)
+
+	return nil
+}
+
+// watchSettings reloads the overrides every time they change in etcd
+func (p *PluginState) watchSettings(ctx context.Context) error {
+	for ctx.Err() == nil {
+		wch := p.watcher().Watch(ctx, p.keys.Config(""), etcd.WithPrefix())
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				log.Errorf("config override watch failed: %v", err)
+				break
+			}
+			if err := p.loadSettings(ctx); err != nil {
+				log.Errorf("could not reload config overrides: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	return ctx.Err()
+}
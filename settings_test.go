@@ -0,0 +1,108 @@
+package etcdplugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestSettingsOverrideConfig(t *testing.T) {
+	f := newFakeEtcd()
+	f.put("test::config::LeaseTime", "2h")
+	f.put("test::config::MinLeaseTime", "1h")
+	f.put("test::config::MaxLeaseTime", "3h")
+	f.put("test::config::MonitorInterval", "1m")
+	p := newTestPlugin(t, f, "LeaseTime = 10m", "MaxLeaseTime = 20m")
+
+	want := Settings{
+		LeaseTime:       2 * time.Hour,
+		MinLeaseTime:    time.Hour,
+		MaxLeaseTime:    3 * time.Hour,
+		MonitorInterval: time.Minute,
+	}
+	if got := p.settings(); got != want {
+		t.Errorf("want settings %+v, got %+v", want, got)
+	}
+}
+
+func TestSettingsRejectInvalidOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		overrides map[string]string
+	}{
+		{"min above max", map[string]string{"MinLeaseTime": "2h", "MaxLeaseTime": "1h"}},
+		{"lease below min", map[string]string{"MinLeaseTime": "30m"}},
+		{"lease above max", map[string]string{"LeaseTime": "1h"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeEtcd()
+			for name, value := range tt.overrides {
+				f.put("test::config::"+name, value)
+			}
+			p := newTestPlugin(t, f, "LeaseTime = 10m", "MinLeaseTime = 1m", "MaxLeaseTime = 20m")
+
+			want := Settings{
+				LeaseTime:       10 * time.Minute,
+				MinLeaseTime:    time.Minute,
+				MaxLeaseTime:    20 * time.Minute,
+				MonitorInterval: time.Hour,
+			}
+			if got := p.settings(); got != want {
+				t.Errorf("want the file settings %+v kept, got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestSettingsKeptOnInvalidReload(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "LeaseTime = 10m")
+	ctx := context.Background()
+
+	f.put("test::config::MaxLeaseTime", "1h")
+	if err := p.loadSettings(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// rejected along with the valid max, the lease would be above it
+	f.put("test::config::LeaseTime", "2h")
+	if err := p.loadSettings(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := p.settings(); got.LeaseTime != 10*time.Minute || got.MaxLeaseTime != time.Hour {
+		t.Errorf("want the settings before the invalid override kept, got %+v", got)
+	}
+}
+
+func TestSettingsBoundRequestedLeaseTime(t *testing.T) {
+	f := newFakeEtcd()
+	f.put("test::config::MinLeaseTime", "5m")
+	f.put("test::config::MaxLeaseTime", "15m")
+	p := newTestPlugin(t, f, "LeaseTime = 10m")
+
+	for requested, want := range map[time.Duration]time.Duration{
+		time.Minute:      5 * time.Minute,
+		time.Hour:        15 * time.Minute,
+		12 * time.Minute: 12 * time.Minute,
+	} {
+		nic := testMAC(1)
+		ip := discover(t, p, nic)
+		resp := request(t, p, nic, ip,
+			dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(requested)))
+		if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("want %s acked, got %v", ip, resp)
+		}
+		if got := resp.IPAddressLeaseTime(0); got != want {
+			t.Errorf("want a request for %s leased for %s, got %s", requested, want, got)
+		}
+	}
+}
+
+func TestSetupRejectsLeaseTimeOutOfBounds(t *testing.T) {
+	_, err := newPluginState(testConfig(t, "LeaseTime = 1h", "MaxLeaseTime = 30m"), newFakeEtcd().dial)
+	if err == nil {
+		t.Fatal("want a lease time above MaxLeaseTime rejected")
+	}
+}
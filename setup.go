@@ -1,86 +1,591 @@
 package etcdplugin
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
-	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	etcd "go.etcd.io/etcd/client/v3"
 	"golang.org/x/sync/errgroup"
 )
 
 func setup(args0 ...string) (handler.Handler4, error) {
-	args := strings.Join(args0, "\n")
+	config, err := LoadConfig(args0)
+	if err != nil {
+		return nil, err
+	}
 
-	viper.SetConfigType("properties")
-	viper.ReadConfig(bytes.NewBuffer([]byte(args)))
+	log.Infof("%s", config)
 
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal config: %w", err)
+	p, err := newPluginState(config, NewClient)
+	if err != nil {
+		return nil, err
 	}
+	register(p)
 
-	log.Infof("%s", config)
+	return p.Handler4, nil
+}
 
-	if config.Separator == "" {
-		config.Separator = constDefaultSeparator
+// dialer creates the etcd clients of a plugin instance, the initial one
+// and the ones replacing it. A client lives until ctx is done, creating it
+// must not take longer than the RequestTimeout of c
+type dialer func(ctx context.Context, c Config) (*etcd.Client, error)
+
+// newPluginState validates config, fills in its defaults and brings up an
+// instance of the plugin on a client created by dial, bootstrapping the
+// range and starting its background goroutines
+func newPluginState(config Config, dial dialer) (_ *PluginState, err error) {
+	config, err = withDefaults(config)
+	if err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
+	// cancelled by Close, or when setup fails
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// closed after the background goroutines are done with it
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+
+	// a failed setup stops the goroutines it started and closes the client
+	var client *etcd.Client
+	var p *PluginState
+	defer func() {
+		if err == nil {
+			return
+		}
+		if p != nil {
+			if cerr := p.close(); cerr != nil {
+				log.Warningf("could not close the instance that failed to set up: %v", cerr)
+			}
+			return
+		}
+		cancel()
+		clientCancel()
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	client, err = dial(clientCtx, config)
+	if err != nil {
+		return nil, err
+	}
 
-	client, err := NewClient(ctx, config)
+	ranges, err := parseRanges(config)
 	if err != nil {
 		return nil, err
 	}
+	// relayed clients are leased from their pool's ranges, which share the
+	// allocator and the etcd keys with the direct ones
+	relayPools, err := parseRelayPools(config.RelayPools, ranges)
+	if err != nil {
+		return nil, err
+	}
+	directRanges := ranges
+	ranges = append(ipRanges{}, directRanges...)
+	for _, pool := range relayPools {
+		ranges = append(ranges, pool.ranges...)
+	}
+	if size := ranges.size(); size > config.MaxRangeSize {
+		return nil, fmt.Errorf("ranges %s hold %d ips, more than MaxRangeSize %d",
+			ranges, size, config.MaxRangeSize)
+	}
+	ipStart := ranges[0].start
 
-	ipStart := net.ParseIP(config.Start)
-	if ipStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", config.Start)
+	ntpServers, err := parseIPv4List("NTPServers", config.NTPServers)
+	if err != nil {
+		return nil, err
 	}
-	ipEnd := net.ParseIP(config.End)
-	if ipEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", config.End)
+
+	var netmask net.IPMask
+	if config.SubnetMask != "" {
+		netmask, err = parseNetmask("SubnetMask", config.SubnetMask)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range directRanges {
+			if !r.start.Mask(netmask).Equal(ipStart.Mask(netmask)) ||
+				!r.end.Mask(netmask).Equal(ipStart.Mask(netmask)) {
+				return nil, fmt.Errorf("ranges %s span more than one subnet of mask %s",
+					directRanges, config.SubnetMask)
+			}
+		}
 	}
-	if binary.BigEndian.Uint32(ipStart.To4()) >= binary.BigEndian.Uint32(ipEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+
+	dnsServers, err := parseIPv4List("DNSServers", config.DNSServers)
+	if err != nil {
+		return nil, err
 	}
 
-	allocator, err := bitmap.NewIPv4Allocator(ipStart, ipEnd)
+	routers, err := parseIPv4List("Routers", config.Routers)
+	if err != nil {
+		return nil, err
+	}
+	for _, router := range routers {
+		if netmask != nil && !router.Mask(netmask).Equal(ipStart.Mask(netmask)) {
+			return nil, fmt.Errorf("router %s is not on the subnet of ranges %s",
+				router, directRanges)
+		}
+	}
+
+	if config.TFTPServerName != "" {
+		if err := validateHostname("TFTPServerName", config.TFTPServerName); err != nil {
+			return nil, err
+		}
+	}
+	if config.WPADURL != "" {
+		if err := validateURL("WPADURL", config.WPADURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateTimezone(config.TZPOSIX, config.TZDatabase); err != nil {
+		return nil, err
+	}
+
+	var serveSubnet *net.IPNet
+	if config.ServeSubnet != "" {
+		_, serveSubnet, err = net.ParseCIDR(config.ServeSubnet)
+		if err != nil || serveSubnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 subnet in ServeSubnet: %v", config.ServeSubnet)
+		}
+		for _, r := range directRanges {
+			if !serveSubnet.Contains(r.start) || !serveSubnet.Contains(r.end) {
+				return nil, fmt.Errorf("range %s is not within ServeSubnet %s", r, serveSubnet)
+			}
+		}
+	}
+
+	var serverID net.IP
+	if config.ServerID != "" {
+		serverID = net.ParseIP(config.ServerID).To4()
+		if serverID == nil {
+			return nil, fmt.Errorf("invalid IPv4 address in ServerID: %v", config.ServerID)
+		}
+	}
+
+	var broadcast net.IP
+	if config.BroadcastAddress != "" {
+		broadcast = net.ParseIP(config.BroadcastAddress).To4()
+		if broadcast == nil {
+			return nil, fmt.Errorf("invalid IPv4 address in BroadcastAddress: %v", config.BroadcastAddress)
+		}
+		if serveSubnet != nil && !broadcast.Equal(broadcastOf(serveSubnet.IP, serveSubnet.Mask)) {
+			return nil, fmt.Errorf("BroadcastAddress %s is not the broadcast address of ServeSubnet %s",
+				broadcast, serveSubnet)
+		}
+		if netmask != nil && !broadcast.Equal(broadcastOf(ipStart, netmask)) {
+			return nil, fmt.Errorf("BroadcastAddress %s is not the broadcast address of ranges %s with mask %s",
+				broadcast, directRanges, config.SubnetMask)
+		}
+	}
+
+	ouiReservations, err := parseOUIReservations(config.OUIReservations, ranges.size())
+	if err != nil {
+		return nil, err
+	}
+	var ouiHeld *ouiCounts
+	if len(ouiReservations) > 0 {
+		ouiHeld = newOUICounts(ouiReservations)
+	}
+
+	allocationStrategy, err := validateAllocationStrategy(config.AllocationStrategy)
+	if err != nil {
+		return nil, err
+	}
+	if allocationStrategy == AllocationLRU && !config.FreeValueMetadata {
+		log.Warning("the lru allocation strategy needs FreeValueMetadata to know when ips were freed")
+	}
+	if allocationStrategy == AllocationLRU && config.CacheFreeIPs {
+		log.Warning("the lru allocation strategy scans etcd, bypassing the free ip cache")
+	}
+
+	var reservations *reservations
+	if config.Reservations != "" {
+		reservations, err = LoadReservations(config.Reservations, ranges)
+		if err != nil {
+			return nil, fmt.Errorf("could not load reservations: %w", err)
+		}
+	}
+
+	exclude, err := parseExclusions(config.Exclude, ranges)
+	if err != nil {
+		return nil, err
+	}
+
+	allocator, err := newRangesAllocator(ranges, exclude)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an allocator: %w", err)
 	}
 
-	dns, err := NewDNS(config.DNSPrefix, config.DNSZone, config.Separator, config.DNSNames)
+	dns, err := NewDNS(config)
 	if err != nil {
 		return nil, fmt.Errorf("could not initialize DNS: %w", err)
 	}
+	dns.reservations = reservations
+	dns.checkStaticNames()
 
 	grp, ctx := errgroup.WithContext(ctx)
 
-	p := PluginState{
-		config:    config,
-		client:    client,
-		allocator: allocator,
-		dns:       dns,
-		grp:       grp,
+	p = &PluginState{
+		config:             config,
+		keys:               newKeyspace(config),
+		dial:               dial,
+		client:             client,
+		clientCancel:       clientCancel,
+		cancel:             cancel,
+		allocator:          allocator,
+		dns:                dns,
+		grp:                grp,
+		ranges:             ranges,
+		directRanges:       directRanges,
+		relayPools:         relayPools,
+		exclude:            exclude,
+		serveSubnet:        serveSubnet,
+		ntpServers:         ntpServers,
+		netmask:            netmask,
+		routers:            routers,
+		reservations:       reservations,
+		allocationStrategy: allocationStrategy,
+		dnsServers:         dnsServers,
+		broadcast:          broadcast,
+		serverID:           serverID,
+		ouiReservations:    ouiReservations,
+		ouiHeld:            ouiHeld,
+		grants:             newGrants(),
+		nics:               newNicLocks(),
+		claims:             newClaims(),
+		dnsRetries:         newDNSRetries(),
+		backpressure:       newBackpressure(config.OverloadBackoff),
+		current:            fileSettings(config),
+	}
+	p.updateStandby(config.Standby)
+	if config.DeclineProbe {
+		p.prober = ICMPProber{}
+	}
+	if config.GlobalRateLimit > 0 {
+		p.limiter = newTokenBucket(config.GlobalRateLimit, config.GlobalRateBurst)
+	}
+	if config.InstanceID != "" {
+		h := fnv.New32a()
+		h.Write([]byte(config.InstanceID))
+		p.instanceStart = ranges.nth(int(h.Sum32() % uint32(ranges.size())))
+		log.Infof("instance %s prefers free ips from %s", config.InstanceID, p.instanceStart)
+	}
+	if config.EventsBroker != "" {
+		publisher, err := newPublisher(config)
+		if err != nil {
+			return nil, err
+		}
+		p.events = newEvents(publisher, config.EventsBuffer,
+			config.EventsOverflowPolicy, config.EventsBlockTimeout)
+		p.goOptional("could not publish lease events", func() error {
+			log.Infof("publishing lease events to %s", config.EventsBroker)
+			return p.events.run(ctx)
+		})
+	}
+	if config.DNSWorkers > 0 {
+		if config.DNSRegistrationStrict {
+			return nil, errors.New("DNSRegistrationStrict needs DNS names registered while handling requests, unset DNSWorkers")
+		}
+		p.dnsWorkers = newDNSWorkers(config.DNSWorkers)
+		for _, queue := range p.dnsWorkers.queues {
+			queue := queue
+			grp.Go(func() error {
+				err := p.runDNSWorker(ctx, queue)
+				return errors.Wrap(err, "could not register DNS names")
+			})
+		}
+		log.Infof("registering DNS names on %d workers", config.DNSWorkers)
+	}
+	if config.SerializeLeases {
+		p.queue = newLeaseQueue(p.handle4)
+		grp.Go(func() error {
+			log.Info("starting lease queue")
+			p.queue.run(ctx)
+			return nil
+		})
+	}
+	if config.ToggleWindow > 0 {
+		p.toggles = newToggles(config.ToggleWindow, config.ToggleCooloff)
+	}
+	if len(config.DelayedAuthKeys) > 0 {
+		p.auth, err = newDelayedAuth(config.DelayedAuthKeys)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err := p.bootstrapLeasableRange(ctx); err != nil {
-		return nil, fmt.Errorf("unable to bootstrap leasable range: ", err)
+	if err := p.loadSettings(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load config overrides: %w", err)
+	}
+	if err := p.loadPaused(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load pause state: %w", err)
+	}
+	if config.CacheFreeIPs {
+		p.freePool = newFreePool()
+		p.goOptional("could not cache free ips", func() error {
+			log.Info("caching free ips")
+			return p.watchFreeIPs(ctx)
+		})
 	}
+	if config.ReloadDNSNames {
+		p.goOptional("could not reload DNS names", func() error {
+			log.Infof("reloading DNS names from %s on SIGHUP", config.DNSNames)
+			return p.dns.watchNames(ctx)
+		})
+	}
+	if config.WatchSettings {
+		p.goOptional("could not watch config overrides", func() error {
+			log.Info("watching config overrides")
+			return p.watchSettings(ctx)
+		})
+	}
+
+	if config.StartupJitter > 0 {
+		// spread the bootstrap load of a fleet starting at once
+		delay := Jitter(config.StartupJitter)
+		log.Infof("delaying bootstrap by %s", delay)
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "setup stopped while delaying bootstrap")
+		case <-time.After(delay):
+		}
+	}
+
+	if err := p.checkPrefix(ctx); err != nil {
+		return nil, err
+	}
+
+	if config.CheckEtcdQuota {
+		if err := p.checkQuota(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// a standby takes over the keys as the active instance left them
+	if !config.Standby {
+		if err := p.pruneOutOfRange(ctx); err != nil {
+			return nil, fmt.Errorf("unable to prune keys outside of the range: %w", err)
+		}
+
+		if config.MigrateLeaseValues {
+			migrated, err := p.MigrateLeaseValues(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to migrate lease values: %w", err)
+			}
+			log.Infof("migrated %d lease values to version %d", migrated, config.LeaseValueVersion)
+		}
+
+		if err := p.bootstrapLeasableRange(ctx); err != nil {
+			return nil, fmt.Errorf("unable to bootstrap leasable range: %w", err)
+		}
+
+		if config.DNSSOA != "" || len(config.DNSNameservers) > 0 {
+			if err := p.dns.RegisterApex(ctx, p.etcdClient()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if config.HeartbeatTTL > 0 {
+		grp.Go(func() error {
+			log.Infof("keeping a heartbeat of %s", config.HeartbeatTTL)
+			err := p.runHeartbeat(ctx)
+			return errors.Wrap(err, "could not keep heartbeat")
+		})
+	}
+
+	grp.Go(func() error {
+		err := p.syncEndpoints(ctx)
+		return errors.Wrap(err, "could not sync etcd endpoints")
+	})
 
 	grp.Go(func() error {
 		log.Info("starting lease monitor")
-		err := p.monitorLeases(ctx, 10*time.Second)
+		err := p.monitorLeases(ctx)
 		return errors.Wrap(err, "could not monitor leases")
 	})
 
-	return p.Handler4, nil
+	if config.AdminListen != "" {
+		p.goOptional("could not serve admin API", func() error {
+			return p.serveAdmin(ctx)
+		})
+	}
+
+	return p, nil
+}
+
+// withDefaults validates the settings of config shared by both families
+// and fills in their defaults
+func withDefaults(config Config) (Config, error) {
+	if config.Separator == "" {
+		config.Separator = constDefaultSeparator
+	}
+	config.Prefix = strings.TrimSpace(config.Prefix)
+	if err := validatePrefix("Prefix", config.Prefix, config.Separator); err != nil {
+		return Config{}, err
+	}
+	if config.DNSPrefix != "" {
+		config.DNSPrefix = strings.TrimSpace(config.DNSPrefix)
+		if err := validatePrefix("DNSPrefix", config.DNSPrefix, config.Separator); err != nil {
+			return Config{}, err
+		}
+	}
+	if config.LeaseTime == 0 {
+		config.LeaseTime = constDefaultLeaseTime
+	}
+	if config.RenewalTime > 0 || config.RebindingTime > 0 {
+		t1, t2 := config.RenewalTime, config.RebindingTime
+		if t1 == 0 {
+			t1 = config.LeaseTime / 2
+		}
+		if t2 == 0 {
+			t2 = config.LeaseTime * 7 / 8
+		}
+		if t1 >= t2 || t2 >= config.LeaseTime {
+			return Config{}, fmt.Errorf("want RenewalTime %s < RebindingTime %s < LeaseTime %s",
+				t1, t2, config.LeaseTime)
+		}
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = constDefaultRequestTimeout
+	}
+	if config.TransientRetries == 0 {
+		config.TransientRetries = constDefaultTransientRetries
+	}
+	if config.TransientBackoff == 0 {
+		config.TransientBackoff = constDefaultTransientBackoff
+	}
+	if config.MonitorInterval == 0 {
+		config.MonitorInterval = constDefaultMonitorInterval
+	}
+	if err := fileSettings(config).validate(); err != nil {
+		return Config{}, err
+	}
+	if config.LeaseValueVersion == 0 {
+		config.LeaseValueVersion = constDefaultLeaseValueVersion
+	}
+	if config.LeaseValueVersion < LeaseValueV1 || config.LeaseValueVersion > LeaseValueV3 {
+		return Config{}, fmt.Errorf("unsupported lease value version: %d", config.LeaseValueVersion)
+	}
+	if config.ContradictedLeaseTime == 0 {
+		config.ContradictedLeaseTime = constDefaultContradictedLeaseTime
+	}
+	if config.OfferTimeout == 0 {
+		config.OfferTimeout = constDefaultOfferTimeout
+	}
+	if config.MinEtcdLeaseTTL == 0 {
+		config.MinEtcdLeaseTTL = constDefaultMinEtcdLeaseTTL
+	}
+	if config.MinEtcdLeaseTTL < time.Second {
+		return Config{}, fmt.Errorf("MinEtcdLeaseTTL must be at least 1s: %s", config.MinEtcdLeaseTTL)
+	}
+	if config.ToggleCooloff == 0 {
+		config.ToggleCooloff = constDefaultToggleCooloff
+	}
+	if config.QuarantineTime < 0 {
+		return Config{}, fmt.Errorf("QuarantineTime must not be negative: %s", config.QuarantineTime)
+	}
+	if config.QuarantineTime == 0 {
+		config.QuarantineTime = constDefaultQuarantineTime
+	}
+	if config.ProblemWindow == 0 {
+		config.ProblemWindow = constDefaultProblemWindow
+	}
+	if config.SyncInterval == 0 {
+		config.SyncInterval = constDefaultSyncInterval
+	}
+	if config.SyncRetries == 0 {
+		config.SyncRetries = constDefaultSyncRetries
+	}
+	if config.EventsBuffer == 0 {
+		config.EventsBuffer = constDefaultEventsBuffer
+	}
+	if config.EventsBlockTimeout == 0 {
+		config.EventsBlockTimeout = constDefaultEventsBlockTimeout
+	}
+	policy, err := validateEventsOverflowPolicy(config.EventsOverflowPolicy)
+	if err != nil {
+		return Config{}, err
+	}
+	config.EventsOverflowPolicy = policy
+	if config.EtcdQuotaBytes == 0 {
+		config.EtcdQuotaBytes = constDefaultEtcdQuotaBytes
+	}
+	if config.OverloadBackoff == 0 {
+		config.OverloadBackoff = constDefaultOverloadBackoff
+	}
+	if config.MaxRangeSize == 0 {
+		config.MaxRangeSize = constDefaultMaxRangeSize
+	}
+	if config.Standby {
+		if !config.CacheFreeIPs {
+			return Config{}, errors.New("Standby keeps the free ip cache warm to take over, set CacheFreeIPs")
+		}
+		if config.HeartbeatTTL == 0 {
+			config.HeartbeatTTL = constDefaultHeartbeatTTL
+		}
+	}
+	if config.AdminListen != "" && config.AdminToken == "" {
+		return Config{}, errors.New("the admin API can revoke leases, set AdminToken along with AdminListen")
+	}
+	if config.HeartbeatTTL != 0 && config.HeartbeatTTL < time.Second {
+		return Config{}, fmt.Errorf("HeartbeatTTL must be at least 1s: %s", config.HeartbeatTTL)
+	}
+
+	return config, nil
+}
+
+// goOptional runs a background loop of a non-essential feature in the
+// group. Its failure is logged instead of returned, which would cancel the
+// group's context and with it the lease monitor
+func (p *PluginState) goOptional(what string, loop func() error) {
+	p.grp.Go(func() error {
+		if err := loop(); err != nil && !errors.Is(err, context.Canceled) {
+			log.Errorf("%s: %v", what, err)
+		}
+		return nil
+	})
+}
+
+// Close stops the plugin's background goroutines, the lease monitor among
+// them, waits for them to return, releases the heartbeat of an active
+// instance and closes the etcd client. Closing it
+// again returns the same error
+func (p *PluginState) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = p.close()
+	})
+	return p.closeErr
+}
+
+func (p *PluginState) close() error {
+	p.cancel()
+	err := p.grp.Wait()
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.RequestTimeout)
+	defer cancel()
+	if herr := p.releaseHeartbeat(ctx); herr != nil && err == nil {
+		err = herr
+	}
+
+	p.clientMu.Lock()
+	client, clientCancel := p.client, p.clientCancel
+	p.clientMu.Unlock()
+
+	clientCancel()
+	if cerr := client.Close(); cerr != nil && !errors.Is(cerr, context.Canceled) && err == nil {
+		err = errors.Wrap(cerr, "could not close etcd client")
+	}
+
+	return err
 }
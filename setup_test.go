@@ -0,0 +1,304 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// the server identifier of the replies of the test plugins
+var testServerID = net.IPv4(10, 0, 0, 254).To4()
+
+// newTestPlugin brings up a plugin instance for the range 10.0.0.1-10.0.0.10
+// on f, lines are further config lines. The background loops that sync the
+// endpoints and sweep the leases are left idle, the fake has no cluster to
+// sync with and tests sweep when they need to
+func newTestPlugin(t testing.TB, f *fakeEtcd, lines ...string) *PluginState {
+	t.Helper()
+
+	p, err := newPluginState(testConfig(t, lines...), f.dial)
+	if err != nil {
+		t.Fatalf("could not set up plugin: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("could not close plugin: %v", err)
+		}
+	})
+
+	return p
+}
+
+// testConfig loads the config of the test plugins, lines are further
+// config lines
+func testConfig(t testing.TB, lines ...string) Config {
+	t.Helper()
+
+	config, err := LoadConfig(append([]string{
+		"Endpoints = 127.0.0.1:2379",
+		"Start = 10.0.0.1",
+		"End = 10.0.0.10",
+		"Prefix = test",
+		"DNSZone = example.com",
+		"DNSPrefix = dns",
+		"DNSNames = " + writeNames(t),
+		"SyncInterval = 1h",
+		"MonitorInterval = 1h",
+	}, lines...))
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+
+	return config
+}
+
+// writeNames writes a DNS names file of lines and returns its path
+func writeNames(t testing.TB, lines ...string) string {
+	t.Helper()
+
+	var data []byte
+	for _, line := range lines {
+		data = append(data, line+"\n"...)
+	}
+	path := filepath.Join(t.TempDir(), "names")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("could not write names: %v", err)
+	}
+	return path
+}
+
+// exchange hands req to the plugin along with the reply the server plugin
+// would have started, and returns what the plugin answered, nil if dropped
+func exchange(t testing.TB, p *PluginState, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)))
+	if err != nil {
+		t.Fatalf("could not build reply: %v", err)
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+
+	resp, _ = p.Handler4(req, resp)
+	return resp
+}
+
+// testMAC returns a locally administered MAC address ending in n
+func testMAC(n byte) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0, 0, 0, 0, n}
+}
+
+// discover has nic discover and returns the ip it was offered, nil if none
+func discover(t testing.TB, p *PluginState, nic net.HardwareAddr) net.IP {
+	t.Helper()
+
+	req, err := dhcpv4.NewDiscovery(nic)
+	if err != nil {
+		t.Fatalf("could not build discover: %v", err)
+	}
+	resp := exchange(t, p, req)
+	if resp == nil {
+		return nil
+	}
+	return resp.YourIPAddr
+}
+
+// request has nic request ip from the test server in the SELECTING state
+// and returns the reply
+func request(t testing.TB, p *PluginState, nic net.HardwareAddr, ip net.IP, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	req, err := dhcpv4.New(append([]dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(nic),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+	}, modifiers...)...)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+	return exchange(t, p, req)
+}
+
+// lease has nic discover and request the ip it's offered, failing the test
+// unless it's acked
+func lease(t testing.TB, p *PluginState, nic net.HardwareAddr) net.IP {
+	t.Helper()
+
+	ip := discover(t, p, nic)
+	if ip == nil {
+		t.Fatalf("%s was offered no ip", nic)
+	}
+	resp := request(t, p, nic, ip)
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("%s was not acked %s: %v", nic, ip, resp)
+	}
+	return resp.YourIPAddr
+}
+
+func TestSetupBootstrapsRange(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	if free := f.keys(p.keys.IP(IPStateFree, "")); len(free) != 10 {
+		t.Fatalf("want 10 free ips after bootstrap, got %d: %v", len(free), free)
+	}
+}
+
+func TestLeaseRoundTrip(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	nic := testMAC(1)
+	ip := lease(t, p, nic)
+
+	if _, ok := f.get(p.keys.LeasedIP(ip)); !ok {
+		t.Errorf("%s is not marked leased", ip)
+	}
+	if _, ok := f.get(p.keys.FreeIP(ip)); ok {
+		t.Errorf("%s is still marked free", ip)
+	}
+
+	// a nic discovering again is offered its lease
+	if again := discover(t, p, nic); !again.Equal(ip) {
+		t.Errorf("want %s offered its lease %s again, got %s", nic, ip, again)
+	}
+}
+
+func TestLeaseExpiryFreesIP(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "LeaseTime = 1m")
+
+	ip := lease(t, p, testMAC(1))
+
+	f.advance(time.Minute + time.Second)
+	if _, ok := f.get(p.keys.LeasedIP(ip)); ok {
+		t.Fatalf("%s is still leased after its lease expired", ip)
+	}
+}
+
+func TestSetupChecksBroadcastAddress(t *testing.T) {
+	for _, tt := range []struct {
+		broadcast string
+		ok        bool
+	}{
+		{"10.0.0.255", true},
+		{"10.0.0.127", false},
+		{"10.0.1.255", false},
+	} {
+		p, err := newPluginState(testConfig(t,
+			"SubnetMask = 255.255.255.0",
+			"BroadcastAddress = "+tt.broadcast,
+		), newFakeEtcd().dial)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("BroadcastAddress %s with mask 255.255.255.0: want ok %t, got %v", tt.broadcast, tt.ok, err)
+		}
+		if err == nil {
+			p.Close()
+		}
+	}
+}
+
+func TestSetupFailureClosesClient(t *testing.T) {
+	f := newFakeEtcd()
+	config := testConfig(t, "CacheFreeIPs = true", "WatchSettings = true", "SerializeLeases = true")
+	// a foreign key fails the prefix check, after the watches started
+	defaulted, err := withDefaults(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.put(newKeyspace(defaulted).Root()+"foreign", "x")
+
+	var client *etcd.Client
+	_, err = newPluginState(config, func(ctx context.Context, c Config) (*etcd.Client, error) {
+		client, _ = f.dial(ctx, c)
+		return client, nil
+	})
+	if err == nil {
+		t.Fatal("want a prefix holding a foreign key refused")
+	}
+
+	if client.Ctx().Err() == nil {
+		t.Error("want the client of the failed setup closed")
+	}
+	waitFor(t, "the watches to stop", func() bool { return f.watching() == 0 })
+}
+
+func TestSetupPrunesKeysOutOfRange(t *testing.T) {
+	for _, prune := range []bool{false, true} {
+		f := newFakeEtcd()
+		old, err := newPluginState(testConfig(t), f.dial)
+		if err != nil {
+			t.Fatalf("could not set up plugin: %v", err)
+		}
+		nic := testMAC(1)
+		leased := net.IPv4(10, 0, 0, 9).To4()
+		if resp := request(t, old, nic, leased); resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+			t.Fatalf("want %s acked %s, got %v", nic, leased, resp)
+		}
+		if err := old.Close(); err != nil {
+			t.Fatalf("could not close plugin: %v", err)
+		}
+
+		// the range shrinks across the restart
+		p := newTestPlugin(t, f, "End = 10.0.0.5", "PruneOutOfRangeLeases = "+strconv.FormatBool(prune))
+
+		for n := byte(6); n <= 10; n++ {
+			if ip := net.IPv4(10, 0, 0, n).To4(); !ip.Equal(leased) {
+				if _, ok := f.get(p.keys.FreeIP(ip)); ok {
+					t.Errorf("prune=%t: want the free key of %s out of the range deleted", prune, ip)
+				}
+			}
+		}
+		if got := len(f.keys(p.keys.IP(IPStateFree, ""))); got != 5 {
+			t.Errorf("prune=%t: want the 5 ips of the range free, got %d", prune, got)
+		}
+
+		_, ipKept := f.get(p.keys.LeasedIP(leased))
+		_, nicKept := f.get(p.keys.LeasedNIC(nic.String()))
+		if ipKept == prune || nicKept == prune {
+			t.Errorf("prune=%t: want the lease of %s out of the range kept %t, got ip key %t and nic key %t",
+				prune, leased, !prune, ipKept, nicKept)
+		}
+	}
+}
+
+func TestStartupJitterWithinBound(t *testing.T) {
+	for _, max := range []time.Duration{0, -time.Second} {
+		if d := Jitter(max); d != 0 {
+			t.Errorf("want no jitter for a bound of %s, got %s", max, d)
+		}
+	}
+
+	const max = 50 * time.Millisecond
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 1000; i++ {
+		d := Jitter(max)
+		if d < 0 || d >= max {
+			t.Fatalf("want a jitter within [0, %s), got %s", max, d)
+		}
+		seen[d] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Error("want the jitter randomized")
+	}
+
+	// the bootstrap is delayed by at most the bound
+	began := time.Now()
+	newTestPlugin(t, newFakeEtcd(), "StartupJitter = 50ms")
+	if took := time.Since(began); took >= max+time.Second {
+		t.Errorf("want setup delayed by at most %s, took %s", max, took)
+	}
+}
@@ -0,0 +1,83 @@
+package etcdplugin
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how long closing the plugin instances may hold up the exit of the process
+const constShutdownTimeout = 10 * time.Second
+
+// coredhcp has no hook stopping plugins, the instances set up in the process
+// are kept here and closed when it's told to terminate
+var instances struct {
+	sync.Mutex
+	all []*PluginState
+}
+
+// closes the instances on the first termination signal
+var shutdownOnSignal sync.Once
+
+// register keeps p to be closed by Shutdown, and has the termination
+// signals shut the instances down from then on
+func register(p *PluginState) {
+	instances.Lock()
+	instances.all = append(instances.all, p)
+	instances.Unlock()
+
+	shutdownOnSignal.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		go awaitTermination(sigs)
+	})
+}
+
+// Shutdown closes the plugin instances set up in the process, stopping
+// their lease monitors and closing their etcd clients
+func Shutdown() error {
+	instances.Lock()
+	all := instances.all
+	instances.all = nil
+	instances.Unlock()
+
+	var err error
+	for _, p := range all {
+		if cerr := p.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// awaitTermination shuts the instances down on the first signal of sigs,
+// then has the process terminate by the signal as it would have without it
+func awaitTermination(sigs chan os.Signal) {
+	sig := <-sigs
+	signal.Stop(sigs)
+	log.Infof("got %s, shutting down", sig)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := Shutdown(); err != nil {
+			log.Errorf("could not shut down: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(constShutdownTimeout):
+		log.Warningf("shutdown is taking longer than %s, exiting anyway", constShutdownTimeout)
+	}
+
+	proc, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = proc.Signal(sig)
+	}
+	if err != nil {
+		log.Errorf("could not re-raise %s: %v", sig, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,52 @@
+package etcdplugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesInstances(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "CacheFreeIPs = true")
+	register(p)
+
+	waitFor(t, "the free ip watch", func() bool { return f.watching() == 1 })
+
+	if err := Shutdown(); err != nil {
+		t.Fatalf("could not shut down: %v", err)
+	}
+
+	if err := p.etcdClient().Ctx().Err(); err == nil {
+		t.Error("want the etcd client closed")
+	}
+	waitFor(t, "the free ip watch to stop", func() bool { return f.watching() == 0 })
+
+	instances.Lock()
+	defer instances.Unlock()
+	if len(instances.all) != 0 {
+		t.Errorf("want no instances left, got %d", len(instances.all))
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	p := newTestPlugin(t, newFakeEtcd())
+
+	for i := 0; i < 2; i++ {
+		if err := p.Close(); err != nil {
+			t.Fatalf("close %d: %v", i, err)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+package etcdplugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// how long a standby takes over the heartbeat of an active instance that
+// stopped keeping it, unless configured
+const constDefaultHeartbeatTTL = 10 * time.Second
+
+// isStandby reports whether the instance stands by for the active one
+func (p *PluginState) isStandby() bool {
+	return p.standby.Load()
+}
+
+func (p *PluginState) updateStandby(standby bool) {
+	if p.standby.Swap(standby) != standby {
+		if standby {
+			log.Warning("another instance is active, standing by")
+		} else {
+			log.Info("active, serving DHCP")
+		}
+	}
+
+	if standby {
+		metricStandby.Set(1)
+	} else {
+		metricStandby.Set(0)
+	}
+}
+
+// runHeartbeat keeps the heartbeat of the instance while it's active.
+// While it stands by it watches the heartbeat of the active instance
+// instead, and takes it over once it's gone, serving from the free ip
+// cache it kept in sync meanwhile. An active instance whose heartbeat was
+// taken over stands by
+func (p *PluginState) runHeartbeat(ctx context.Context) error {
+	// an active instance takes the heartbeat over from its previous run
+	force := !p.isStandby()
+
+	for ctx.Err() == nil {
+		if p.isStandby() {
+			if err := p.awaitHeartbeatLoss(ctx); err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("could not watch the heartbeat of the active instance: %v", err)
+					p.pauseHeartbeat(ctx)
+				}
+				continue
+			}
+		}
+
+		id, claimed, err := p.claimHeartbeat(ctx, force)
+		switch {
+		case err != nil:
+			log.Errorf("could not claim the heartbeat: %v", err)
+			p.pauseHeartbeat(ctx)
+		case !claimed:
+			p.updateStandby(true)
+		default:
+			force = false
+			p.updateStandby(false)
+			p.keepHeartbeat(ctx, id)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// pauseHeartbeat waits a bit before trying again
+func (p *PluginState) pauseHeartbeat(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// awaitHeartbeatLoss returns once there's no heartbeat of an active
+// instance, or the watch on it broke
+func (p *PluginState) awaitHeartbeatLoss(ctx context.Context) error {
+	resp, err := p.kv().Get(ctx, p.keys.Heartbeat())
+	if err != nil {
+		return errors.Wrap(err, "could not get heartbeat")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	log.Debugf("standing by for instance %q", resp.Kvs[0].Value)
+
+	watchCtx, cancel := context.WithCancel(etcd.WithRequireLeader(ctx))
+	defer cancel()
+
+	wch := p.watcher().Watch(watchCtx, p.keys.Heartbeat(), etcd.WithRev(resp.Header.Revision+1))
+	for wresp := range wch {
+		if wresp.CompactRevision != 0 {
+			return errors.Errorf("heartbeat watch fell behind compaction at revision %d",
+				wresp.CompactRevision)
+		}
+		if err := wresp.Err(); err != nil {
+			return errors.Wrap(err, "heartbeat watch failed")
+		}
+
+		for _, ev := range wresp.Events {
+			if ev.Type == mvccpb.DELETE {
+				log.Warningf("the heartbeat of the active instance is gone")
+				return nil
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// claimHeartbeat puts the heartbeat of the instance on a new etcd lease,
+// reporting false when another instance holds it already, unless force
+// has it taken over
+func (p *PluginState) claimHeartbeat(ctx context.Context, force bool) (etcd.LeaseID, bool, error) {
+	lease, err := p.lease().Grant(ctx, int64(p.config.HeartbeatTTL.Seconds()))
+	if err != nil {
+		return 0, false, errors.Wrap(err, "could not grant heartbeat lease")
+	}
+
+	put := etcd.OpPut(p.keys.Heartbeat(), p.config.InstanceID, etcd.WithLease(lease.ID))
+	txn := p.kv().Txn(ctx)
+	if !force {
+		txn = txn.If(etcd.Compare(etcd.CreateRevision(p.keys.Heartbeat()), "=", 0))
+	}
+	resp, err := txn.Then(put).Commit()
+	if err == nil && resp.Succeeded {
+		return lease.ID, true, nil
+	}
+
+	if _, rerr := p.lease().Revoke(ctx, lease.ID); rerr != nil {
+		log.Warningf("could not revoke unused heartbeat lease %x: %v", lease.ID, rerr)
+	}
+	if err != nil {
+		return 0, false, errors.Wrap(err, "could not put heartbeat")
+	}
+
+	return 0, false, nil
+}
+
+// keepHeartbeat keeps the heartbeat lease id alive until ctx is done, the
+// lease is lost, e.g. when etcd was out of reach for longer than its TTL, or
+// another instance took the heartbeat over
+func (p *PluginState) keepHeartbeat(ctx context.Context, id etcd.LeaseID) {
+	// left for Close to release when ctx is done
+	p.heartbeatLease.Store(int64(id))
+
+	ticker := time.NewTicker(p.config.HeartbeatTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := p.lease().KeepAliveOnce(ctx, id); err != nil {
+			if errors.Is(err, rpctypes.ErrLeaseNotFound) {
+				p.heartbeatLease.CompareAndSwap(int64(id), 0)
+				log.Warningf("lost the heartbeat lease %x", id)
+				return
+			}
+			log.Errorf("could not keep the heartbeat alive: %v", err)
+			continue
+		}
+
+		// another instance may have been forced to take it over
+		resp, err := p.kv().Get(ctx, p.keys.Heartbeat())
+		if err != nil {
+			log.Errorf("could not get heartbeat: %v", err)
+			continue
+		}
+		if len(resp.Kvs) == 0 || resp.Kvs[0].Lease != int64(id) {
+			p.heartbeatLease.CompareAndSwap(int64(id), 0)
+			if _, err := p.lease().Revoke(ctx, id); err != nil {
+				log.Warningf("could not revoke heartbeat lease %x: %v", id, err)
+			}
+			log.Warning("the heartbeat was taken over")
+			return
+		}
+	}
+}
+
+// releaseHeartbeat revokes the heartbeat of an active instance, having a
+// standby take over without waiting for it to expire
+func (p *PluginState) releaseHeartbeat(ctx context.Context) error {
+	id := etcd.LeaseID(p.heartbeatLease.Swap(0))
+	if id == 0 {
+		return nil
+	}
+
+	if _, err := p.lease().Revoke(ctx, id); err != nil && !errors.Is(err, rpctypes.ErrLeaseNotFound) {
+		return errors.Wrap(err, "could not revoke heartbeat lease")
+	}
+	log.Info("released the heartbeat")
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package etcdplugin
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// cachedFreeIPs returns the ips in the free ip cache of p, sorted, false
+// while it's out of sync
+func cachedFreeIPs(p *PluginState) ([]uint32, bool) {
+	p.freePool.mu.Lock()
+	defer p.freePool.mu.Unlock()
+
+	if p.freePool.ips == nil {
+		return nil, false
+	}
+	return append([]uint32{}, p.freePool.ips...), true
+}
+
+// freeIPsIn returns the ips f has marked free for p, sorted
+func freeIPsIn(f *fakeEtcd, p *PluginState) []uint32 {
+	var ips []uint32
+	for _, key := range f.keys(p.keys.IP(IPStateFree, "")) {
+		_, ip, err := p.keys.ParseIP(key)
+		if err != nil {
+			continue
+		}
+		ips = append(ips, binary.BigEndian.Uint32(ip.To4()))
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+	return ips
+}
+
+func TestStandbyMirrorsAndTakesOver(t *testing.T) {
+	f := newFakeEtcd()
+	active := newTestPlugin(t, f, "HeartbeatTTL = 1h", "InstanceID = active")
+	waitFor(t, "the heartbeat of the active instance", func() bool {
+		id, ok := f.get(active.keys.Heartbeat())
+		return ok && id == "active"
+	})
+
+	standby := newTestPlugin(t, f, "CacheFreeIPs = true", "Standby = true", "InstanceID = standby")
+	if !standby.isStandby() {
+		t.Fatal("want the instance standing by")
+	}
+
+	leased := lease(t, active, testMAC(1))
+	lease(t, active, testMAC(2))
+	lease(t, active, testMAC(3))
+	release, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(testMAC(1)),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+		dhcpv4.WithClientIP(leased),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, active, release)
+	free := freeIPsIn(f, active)
+	if len(free) != 8 {
+		t.Fatalf("want 8 free ips left by the active instance, got %d", len(free))
+	}
+	waitFor(t, "the standby's free ip cache to match the active's leases", func() bool {
+		ips, ok := cachedFreeIPs(standby)
+		return ok && reflect.DeepEqual(ips, free)
+	})
+
+	if ip := discover(t, standby, testMAC(4)); ip != nil {
+		t.Fatalf("want the standby to drop packets, it offered %s", ip)
+	}
+
+	// closing the active instance releases its heartbeat
+	if err := active.Close(); err != nil {
+		t.Fatalf("could not close the active instance: %v", err)
+	}
+	waitFor(t, "the standby to take over", func() bool {
+		return !standby.isStandby()
+	})
+	if id, _ := f.get(standby.keys.Heartbeat()); id != "standby" {
+		t.Errorf("want the heartbeat held by the standby, got %q", id)
+	}
+
+	// it serves from the cache it kept warm, without bootstrapping again
+	if _, ok := standby.freePool.size(); !ok {
+		t.Fatal("want the free ip cache in sync on takeover")
+	}
+	ip := lease(t, standby, testMAC(4))
+	if _, ok := f.get(standby.keys.LeasedIP(ip)); !ok {
+		t.Errorf("%s is not marked leased", ip)
+	}
+}
+
+func TestStandbyTakesOverLostHeartbeat(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	f.put(p.keys.Heartbeat(), "crashed")
+
+	standby := newTestPlugin(t, f, "CacheFreeIPs = true", "Standby = true")
+	if ip := discover(t, standby, testMAC(1)); ip != nil {
+		t.Fatalf("want the standby to drop packets, it offered %s", ip)
+	}
+
+	// as when the lease of the heartbeat expired
+	f.delete(p.keys.Heartbeat())
+	waitFor(t, "the standby to take over", func() bool {
+		return !standby.isStandby()
+	})
+	lease(t, standby, testMAC(1))
+}
+
+func TestActiveStandsByWhenTakenOver(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "HeartbeatTTL = 1s")
+	waitFor(t, "the heartbeat", func() bool {
+		_, ok := f.get(p.keys.Heartbeat())
+		return ok
+	})
+
+	f.put(p.keys.Heartbeat(), "other")
+	waitFor(t, "the instance to stand by", p.isStandby)
+}
+
+func TestStandbyNeedsFreeIPCache(t *testing.T) {
+	if _, err := newPluginState(testConfig(t, "Standby = true"), newFakeEtcd().dial); err == nil {
+		t.Error("want a standby without CacheFreeIPs refused")
+	}
+}
@@ -0,0 +1,193 @@
+package etcdplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+	etcdutil "go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+// ErrInvalidTransition is returned when moving an ip between two states
+// the lease lifecycle does not connect
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// transitions are the state moves allowed in an ip's lease lifecycle
+var transitions = map[IPState][]IPState{
+	// bootstrapping and resurrecting expired leases, or healing a lease
+	// whose ip key went missing
+	IPStateMissing: {IPStateFree, IPStateLeased, IPStateReserved},
+	// offering and leasing, or reserving an ip reserved since it was freed
+	IPStateFree: {IPStateOffered, IPStateLeased, IPStateReserved},
+	// leasing what was offered
+	IPStateOffered: {IPStateLeased},
+	// renewing, releasing, declining and parking
+	IPStateLeased: {IPStateLeased, IPStateFree, IPStateDeclined, IPStateProblem, IPStateReserved},
+	// promoting at the end of the quarantine, or extending it
+	IPStateDeclined: {IPStateFree, IPStateDeclined, IPStateReserved},
+	// returned by an operator
+	IPStateProblem: {IPStateFree, IPStateReserved},
+	// offering and leasing to the nic it's reserved for
+	IPStateReserved: {IPStateOffered, IPStateLeased},
+}
+
+// transitionOptions carry what a transition needs beyond the states
+type transitionOptions struct {
+	// the nic the lease is bound to, when moving from or to leased
+	nic net.HardwareAddr
+	// the etcd lease of the leased keys
+	lease etcd.LeaseID
+	// recorded in the leased keys' values
+	meta leaseMetadata
+	// value of the destination state key, by default the ip, or the free
+	// value when moving to free
+	value string
+	// additional conditions for the transition to happen
+	cmps []etcd.Cmp
+	// the ip the nic leases and gives up moving to leased, nil if none
+	release net.IP
+}
+
+type transitionOption func(*transitionOptions)
+
+// withNic binds the transition to a nic, the destination keys are written
+// with lease and when moving out of leased the nic key is deleted
+func withNic(nic net.HardwareAddr, lease etcd.LeaseID) transitionOption {
+	return func(o *transitionOptions) {
+		o.nic = nic
+		o.lease = lease
+	}
+}
+
+// withMetadata records meta in the values of the leased keys
+func withMetadata(meta leaseMetadata) transitionOption {
+	return func(o *transitionOptions) {
+		o.meta = meta
+	}
+}
+
+// withValue sets the value of the destination state key
+func withValue(value string) transitionOption {
+	return func(o *transitionOptions) {
+		o.value = value
+	}
+}
+
+// withConditions adds conditions the transition depends on
+func withConditions(cmps ...etcd.Cmp) transitionOption {
+	return func(o *transitionOptions) {
+		o.cmps = append(o.cmps, cmps...)
+	}
+}
+
+// withRelease has the nic give up the ip it leases in the transaction
+// leasing it another one, released goes back to free
+func withRelease(released net.IP) transitionOption {
+	return func(o *transitionOptions) {
+		o.release = released
+	}
+}
+
+// transition atomically moves ip from one state to another, reporting
+// whether ip was found in the from state and every condition held
+func (p *PluginState) transition(ctx context.Context, ip net.IP, from, to IPState,
+	opts ...transitionOption) (bool, error) {
+	// reserved ips never return to the pool
+	if to == IPStateFree && p.reservations.reserved(ip) {
+		to = IPStateReserved
+	}
+
+	allowed := false
+	for _, state := range transitions[from] {
+		allowed = allowed || state == to
+	}
+	if !allowed {
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	var o transitionOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.value == "" {
+		o.value = ip.String()
+		if to == IPStateFree {
+			o.value = p.encodeFreeValue(ip, o.nic)
+		}
+	}
+	if to == IPStateLeased && o.nic == nil {
+		return false, fmt.Errorf("%w: %s to %s requires a nic", ErrInvalidTransition, from, to)
+	}
+	if o.release != nil && to != IPStateLeased {
+		return false, fmt.Errorf("%w: %s to %s releases no lease", ErrInvalidTransition, from, to)
+	}
+
+	var cmps []etcd.Cmp
+	var ops []etcd.Op
+
+	switch from {
+	case IPStateMissing:
+		for _, state := range ipStates {
+			cmps = append(cmps, etcdutil.KeyMissing(p.keys.IP(state, ip.String())))
+		}
+	default:
+		cmps = append(cmps, etcdutil.KeyExists(p.keys.IP(from, ip.String())))
+		if from != to {
+			ops = append(ops, etcd.OpDelete(p.keys.IP(from, ip.String())))
+			if from == IPStateLeased && o.nic != nil {
+				ops = append(ops, etcd.OpDelete(p.keys.LeasedNIC(o.nic.String())))
+			}
+		}
+	}
+	cmps = append(cmps, o.cmps...)
+
+	switch to {
+	case IPStateLeased:
+		nicValue, ipValue := p.encodeLeaseValues(ip, o.nic, o.meta)
+		ops = append(ops,
+			etcd.OpPut(p.keys.LeasedNIC(o.nic.String()), nicValue, etcd.WithLease(o.lease)),
+			etcd.OpPut(p.keys.LeasedIP(ip), ipValue, etcd.WithLease(o.lease)),
+		)
+	default:
+		ops = append(ops, etcd.OpPut(p.keys.IP(to, ip.String()), o.value, etcd.WithLease(o.lease)))
+	}
+
+	// the nic's key is overwritten by the new lease
+	releasedTo := IPStateFree
+	if o.release != nil {
+		value := p.encodeFreeValue(o.release, o.nic)
+		if p.reservations.reserved(o.release) {
+			releasedTo, value = IPStateReserved, o.release.String()
+		}
+		cmps = append(cmps, etcdutil.KeyExists(p.keys.LeasedIP(o.release)))
+		ops = append(ops,
+			etcd.OpDelete(p.keys.LeasedIP(o.release)),
+			etcd.OpPut(p.keys.IP(releasedTo, o.release.String()), value),
+		)
+	}
+
+	res, err := p.kv().Txn(ctx).
+		If(cmps...).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return false, errors.Wrapf(err, "could not move ip %s from %s to %s", ip, from, to)
+	}
+
+	if res.Succeeded {
+		log.Debugf("moved ip %s from %s to %s", ip, from, to)
+		if p.events != nil {
+			p.events.emit(from, to, ip, o.nic)
+		}
+		if o.release != nil {
+			log.Debugf("moved ip %s from %s to %s", o.release, IPStateLeased, releasedTo)
+			if p.events != nil {
+				p.events.emit(IPStateLeased, releasedTo, o.release, o.nic)
+			}
+		}
+	}
+
+	return res.Succeeded, nil
+}
@@ -0,0 +1,130 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	etcdutil "go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+func TestTransitionMovesKeys(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	ctx := context.Background()
+
+	nic := testMAC(1)
+	ip := net.IPv4(10, 0, 0, 1).To4()
+
+	for _, tt := range []struct {
+		from, to IPState
+		opts     []transitionOption
+		want     bool
+	}{
+		// bootstrapped already
+		{IPStateMissing, IPStateFree, nil, false},
+		{IPStateFree, IPStateLeased, []transitionOption{withNic(nic, 0)}, true},
+		// not free anymore
+		{IPStateFree, IPStateOffered, nil, false},
+		{IPStateLeased, IPStateLeased, []transitionOption{withNic(nic, 0)}, true},
+		{IPStateLeased, IPStateFree, []transitionOption{withNic(nic, 0)}, true},
+	} {
+		ok, err := p.transition(ctx, ip, tt.from, tt.to, tt.opts...)
+		if err != nil {
+			t.Fatalf("could not move %s from %s to %s: %v", ip, tt.from, tt.to, err)
+		}
+		if ok != tt.want {
+			t.Errorf("want the move of %s from %s to %s to succeed %t, got %t", ip, tt.from, tt.to, tt.want, ok)
+		}
+
+		switch tt.to {
+		case IPStateLeased:
+			if leasedTo(t, f, p, nic) != ip.String() {
+				t.Errorf("want %s leased to %s after moving it from %s", ip, nic, tt.from)
+			}
+			if _, ok := f.get(p.keys.FreeIP(ip)); ok {
+				t.Errorf("want %s not free while leased", ip)
+			}
+		case IPStateFree:
+			if _, ok := f.get(p.keys.FreeIP(ip)); !ok {
+				t.Errorf("want %s free after moving it from %s", ip, tt.from)
+			}
+		}
+	}
+
+	if got := leasedTo(t, f, p, nic); got != "" {
+		t.Errorf("want the nic key of %s deleted along with the lease, got %s", nic, got)
+	}
+	if _, ok := f.get(p.keys.LeasedIP(ip)); ok {
+		t.Errorf("want %s not leased once freed", ip)
+	}
+}
+
+func TestTransitionRefusesInvalidMoves(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	ctx := context.Background()
+
+	ip := net.IPv4(10, 0, 0, 1).To4()
+
+	for _, tt := range []struct {
+		from, to IPState
+		opts     []transitionOption
+	}{
+		{IPStateFree, IPStateProblem, nil},
+		{IPStateFree, IPStateDeclined, nil},
+		{IPStateOffered, IPStateFree, nil},
+		{IPStateReserved, IPStateFree, nil},
+		{IPStateProblem, IPStateLeased, []transitionOption{withNic(testMAC(1), 0)}},
+		// leasing needs a nic to lease to
+		{IPStateFree, IPStateLeased, nil},
+		// only a lease is released
+		{IPStateFree, IPStateOffered, []transitionOption{withRelease(net.IPv4(10, 0, 0, 2).To4())}},
+	} {
+		ok, err := p.transition(ctx, ip, tt.from, tt.to, tt.opts...)
+		if !errors.Is(err, ErrInvalidTransition) || ok {
+			t.Errorf("want the move of %s from %s to %s refused, got %t, %v", ip, tt.from, tt.to, ok, err)
+		}
+	}
+
+	if _, ok := f.get(p.keys.FreeIP(ip)); !ok {
+		t.Errorf("want %s left free", ip)
+	}
+}
+
+func TestTransitionHonorsConditions(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	ctx := context.Background()
+
+	ip := net.IPv4(10, 0, 0, 1).To4()
+
+	ok, err := p.transition(ctx, ip, IPStateFree, IPStateOffered,
+		withConditions(etcdutil.KeyExists(p.keys.Paused())))
+	if err != nil {
+		t.Fatalf("could not move %s from free to offered: %v", ip, err)
+	}
+	if ok {
+		t.Error("want the move not made while its condition fails")
+	}
+	if _, found := f.get(p.keys.FreeIP(ip)); !found {
+		t.Errorf("want %s left free", ip)
+	}
+	if _, found := f.get(p.keys.IP(IPStateOffered, ip.String())); found {
+		t.Errorf("want %s not offered", ip)
+	}
+
+	f.put(p.keys.Paused(), "true")
+	ok, err = p.transition(ctx, ip, IPStateFree, IPStateOffered,
+		withConditions(etcdutil.KeyExists(p.keys.Paused())))
+	if err != nil || !ok {
+		t.Fatalf("want the move made once its condition holds, got %t, %v", ok, err)
+	}
+	if _, found := f.get(p.keys.FreeIP(ip)); found {
+		t.Errorf("want %s not free once offered", ip)
+	}
+	if value, _ := f.get(p.keys.IP(IPStateOffered, ip.String())); value != ip.String() {
+		t.Errorf("want %s offered, got %q", ip, value)
+	}
+}
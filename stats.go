@@ -0,0 +1,85 @@
+package etcdplugin
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+)
+
+// UtilizationSnapshot is how many ips of the range were in each state at a
+// point in time
+type UtilizationSnapshot struct {
+	Time     time.Time `json:"time"`
+	Free     int64     `json:"free"`
+	Offered  int64     `json:"offered"`
+	Leased   int64     `json:"leased"`
+	Declined int64     `json:"declined"`
+	Problem  int64     `json:"problem"`
+	Reserved int64     `json:"reserved"`
+}
+
+// snapshotUtilization stores the current utilization of the range and
+// deletes the snapshots older than UtilizationHistory
+func (p *PluginState) snapshotUtilization(ctx context.Context) error {
+	kvc := p.kv()
+
+	snapshot := UtilizationSnapshot{Time: time.Now()}
+	counts := map[IPState]*int64{
+		IPStateFree:     &snapshot.Free,
+		IPStateOffered:  &snapshot.Offered,
+		IPStateLeased:   &snapshot.Leased,
+		IPStateDeclined: &snapshot.Declined,
+		IPStateProblem:  &snapshot.Problem,
+		IPStateReserved: &snapshot.Reserved,
+	}
+	for _, state := range ipStates {
+		resp, err := kvc.Get(ctx, p.keys.IP(state, ""), etcd.WithPrefix(), etcd.WithCountOnly())
+		if err != nil {
+			return errors.Wrapf(err, "could not count %s ips", state)
+		}
+		*counts[state] = resp.Count
+	}
+
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "could not encode utilization snapshot")
+	}
+	if _, err := kvc.Put(ctx, p.keys.Utilization(snapshot.Time), string(value)); err != nil {
+		return errors.Wrap(err, "could not store utilization snapshot")
+	}
+
+	cutoff := snapshot.Time.Add(-p.config.UtilizationHistory)
+	resp, err := kvc.Delete(ctx, p.keys.Utilization(time.Time{}), etcd.WithRange(p.keys.Utilization(cutoff)))
+	if err != nil {
+		return errors.Wrap(err, "could not delete expired utilization snapshots")
+	}
+	log.Debugf("stored utilization snapshot %+v, expired %d", snapshot, resp.Deleted)
+
+	return nil
+}
+
+// UtilizationHistory returns the stored utilization snapshots, oldest first
+func (p *PluginState) UtilizationHistory(ctx context.Context) ([]UtilizationSnapshot, error) {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.Utilization(time.Time{}), etcd.WithPrefix(),
+		etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list utilization snapshots")
+	}
+
+	snapshots := make([]UtilizationSnapshot, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var snapshot UtilizationSnapshot
+		if err := json.Unmarshal(kv.Value, &snapshot); err != nil {
+			log.Warningf("skipping unreadable utilization snapshot %s: %v", kv.Key, err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
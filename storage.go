@@ -4,145 +4,320 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
-	etcdpb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	etcd "go.etcd.io/etcd/client/v3"
 	etcdutil "go.etcd.io/etcd/client/v3/clientv3util"
 )
 
-func (p *PluginState) bootstrapLeasableRange(ctx context.Context) error {
-	kvc := etcd.NewKV(p.client)
+// prefixLayout are the first components of the keys the plugin keeps under
+// its prefix
+var prefixLayout = []string{"ips", "nics", "config", "admin", "stats", "declines", "malformed", "instances", "ips6", "duids"}
+
+// checkPrefix refuses a prefix holding keys outside of the plugin's layout,
+// which are likely another application's, unless configured to share it
+func (p *PluginState) checkPrefix(ctx context.Context) error {
+	known := make(map[string]struct{})
+	for _, component := range prefixLayout {
+		known[component] = struct{}{}
+	}
+	// the DNS records may live under the same prefix
+	if p.config.DNSPrefix == p.config.Prefix {
+		known[p.config.DNSZone] = struct{}{}
+		known["owners"] = struct{}{}
+	}
+
+	resp, err := p.kv().
+		Get(ctx, p.keys.Root(), etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return errors.Wrap(err, "could not list prefix")
+	}
+
+	for _, kv := range resp.Kvs {
+		if _, ok := known[p.keys.Component(string(kv.Key))]; ok {
+			continue
+		}
+
+		if p.config.ForceSharedPrefix {
+			log.Warningf("prefix %s holds foreign key %s, sharing it as configured", p.config.Prefix, kv.Key)
+			return nil
+		}
+		return fmt.Errorf("prefix %s holds foreign key %s, set ForceSharedPrefix to use it anyway",
+			p.config.Prefix, kv.Key)
+	}
+
+	return nil
+}
 
+func (p *PluginState) bootstrapLeasableRange(ctx context.Context) error {
 	for _, ipnet := range p.allocator.Range() {
-		freeIPKey := p.config.Prefix + p.config.Separator +
-			"ips" + p.config.Separator +
-			"free" + p.config.Separator +
-			ipnet.IP.String()
-		leasedIPKey := p.config.Prefix + p.config.Separator +
-			"ips" + p.config.Separator +
-			"leased" + p.config.Separator +
-			ipnet.IP.String()
-
-		res, err := kvc.Txn(ctx).If(
-			etcdutil.KeyMissing(freeIPKey),
-			etcdutil.KeyMissing(leasedIPKey),
-		).Then(
-			etcd.OpPut(freeIPKey, ipnet.IP.String()),
-		).Commit()
+		ok, err := p.transition(ctx, ipnet.IP, IPStateMissing, IPStateFree)
 		if err != nil {
-			return errors.Wrap(err, "could not move ip to free state")
+			return err
 		}
 
-		if res.Succeeded {
+		if ok {
 			log.Debugf("established %s as free", ipnet.IP)
 		}
 	}
 
+	// ips reserved since they were freed leave the pool, the ones held by
+	// another nic do once it lets them go
+	for ip, nic := range p.reservations.byIPs() {
+		ok, err := p.transition(ctx, net.ParseIP(ip), IPStateFree, IPStateReserved)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Infof("reserved %s for %s", ip, nic)
+		}
+	}
+
 	return nil
 }
 
-func (p *PluginState) monitorLeases(ctx context.Context, interval time.Duration) error {
-	t := time.NewTicker(interval)
-	defer t.Stop()
+// pruneOutOfRange removes the keys of ips outside of the configured range,
+// or excluded from it, left behind by a previous configuration. Leased ips are only removed when
+// configured to, otherwise they are left to expire with their etcd lease
+func (p *PluginState) pruneOutOfRange(ctx context.Context) error {
+	kvc := p.kv()
 
-	for {
-		err := p.resurrectLeases(ctx)
+	for _, state := range ipStates {
+		prefix := p.keys.IP(state, "")
+
+		resp, err := kvc.Get(ctx, prefix, etcd.WithPrefix())
 		if err != nil {
-			log.Errorf("could not resurrect leases: %v", err)
+			return errors.Wrapf(err, "could not list %s ips", state)
+		}
+
+		for _, kv := range resp.Kvs {
+			_, ip, _ := p.keys.ParseIP(string(kv.Key))
+			if ip != nil && p.ranges.contains(ip) && !p.exclude.contains(ip) {
+				continue
+			}
+
+			if state != IPStateLeased {
+				if _, err := kvc.Delete(ctx, string(kv.Key)); err != nil {
+					return errors.Wrapf(err, "could not delete out of range %s ip", state)
+				}
+				log.Infof("deleted %s ip %s outside of the range", state, ip)
+				continue
+			}
+
+			if !p.config.PruneOutOfRangeLeases {
+				log.Infof("leased ip %s is outside of the range, leaving it to expire", ip)
+				continue
+			}
+
+			var leasedNicKey string
+			nicRev := int64(-1)
+			if leasedNic, err := leasedNicOf(kv.Value); err == nil {
+				leasedNicKey = p.keys.LeasedNIC(leasedNic)
+
+				if nic, err := net.ParseMAC(leasedNic); err == nil {
+					nicRev, _, err = leaseRevisions(ctx, kvc, leasedNicKey, string(kv.Key), ip, nic)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			_, err := kvc.Txn(ctx).If(
+				// only delete the nic's key if it's bound to this ip
+				etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev),
+			).Then(
+				etcd.OpDelete(string(kv.Key)),
+				etcd.OpDelete(leasedNicKey),
+			).Else(
+				etcd.OpDelete(string(kv.Key)),
+			).Commit()
+			if err != nil {
+				return errors.Wrap(err, "could not delete out of range lease")
+			}
+			log.Infof("deleted lease of ip %s outside of the range", ip)
+		}
+	}
+
+	return nil
+}
+
+func (p *PluginState) monitorLeases(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(Jitter(p.config.StartupJitter)):
+	}
+
+	for {
+		if err := p.loadPaused(ctx); err != nil {
+			log.Errorf("could not refresh pause state: %v", err)
+		}
+
+		// the active instance looks after the leases
+		if p.isStandby() {
+			log.Debug("standing by, skipping the lease sweep")
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(p.settings().MonitorInterval):
+			}
+			continue
+		}
+
+		// errors are logged by the sweep, the next one will try again
+		_, _ = p.sweep(ctx)
+
+		// catch up with the leases that expired or other instances granted
+		if p.ouiHeld != nil {
+			if _, err := p.countOUIs(ctx); err != nil {
+				log.Errorf("could not count the leases of reserved OUIs: %v", err)
+			}
+		}
+
+		p.retryDNSRegistrations(ctx)
+
+		if p.toggles != nil {
+			p.toggles.prune()
+		}
+
+		if p.config.UtilizationHistory > 0 {
+			if err := p.snapshotUtilization(ctx); err != nil {
+				log.Errorf("could not snapshot utilization: %v", err)
+			}
+		}
+
+		if p.config.MaxDNSRecords > 0 {
+			count, err := p.dns.CountRecords(ctx, p.etcdClient())
+			if err != nil {
+				log.Errorf("could not count DNS records: %v", err)
+			} else {
+				log.Debugf("zone %s has %d records", p.config.DNSZone, count)
+			}
 		}
 
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-t.C:
+		case <-time.After(p.settings().MonitorInterval):
 		}
 	}
 }
 
-func (p *PluginState) resurrectLeases(ctx context.Context) error {
-	kvc := etcd.NewKV(p.client)
-
-	leasedIPPrefix := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"leased" + p.config.Separator
+// SweepSummary is what a reclamation sweep changed
+type SweepSummary struct {
+	// declined ips whose quarantine ended
+	Promoted int `json:"promoted"`
+	// expired leases moved back to free
+	Reclaimed int `json:"reclaimed"`
+}
 
-	resp, err := kvc.Get(ctx, leasedIPPrefix, etcd.WithPrefix())
-	if err != nil {
-		return errors.Wrap(err, "could not list leased ips")
-	}
+// sweep reconciles recent grants and reclaims declined and expired ips, it
+// is run by the monitor and on demand by the admin API but never twice at
+// once. Every step runs even if a previous one failed, the first error is
+// returned
+func (p *PluginState) sweep(ctx context.Context) (SweepSummary, error) {
+	p.sweepMu.Lock()
+	defer p.sweepMu.Unlock()
 
-	leased := map[string]struct{}{}
-	for _, kv := range resp.Kvs {
-		parts := strings.Split(string(kv.Key), p.config.Separator)
-		ip := parts[len(parts)-1]
+	var summary SweepSummary
+	var first error
 
-		leased[ip] = struct{}{}
+	if err := p.reconcileGrants(ctx); err != nil {
+		log.Errorf("could not reconcile grants: %v", err)
+		first = errors.WithMessage(err, "could not reconcile grants")
 	}
 
-	freeIPPrefix := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"free" + p.config.Separator
+	promoted, err := p.promoteDeclined(ctx)
+	summary.Promoted = promoted
+	if err != nil {
+		log.Errorf("could not promote declined ips: %v", err)
+		if first == nil {
+			first = errors.WithMessage(err, "could not promote declined ips")
+		}
+	}
 
-	resp, err = kvc.Get(ctx, freeIPPrefix, etcd.WithPrefix())
+	reclaimed, err := p.resurrectLeases(ctx)
+	summary.Reclaimed = reclaimed
 	if err != nil {
-		return errors.Wrap(err, "could not list free ips")
+		log.Errorf("could not resurrect leases: %v", err)
+		if first == nil {
+			first = errors.WithMessage(err, "could not resurrect leases")
+		}
 	}
 
-	free := make(map[string]struct{})
-	for _, kv := range resp.Kvs {
-		parts := strings.Split(string(kv.Key), p.config.Separator)
-		ip := parts[len(parts)-1]
+	return summary, first
+}
+
+func (p *PluginState) resurrectLeases(ctx context.Context) (int, error) {
+	kvc := p.kv()
+
+	began := time.Now()
+	reclaimed := 0
+
+	known := make(map[string]struct{})
+	var free []net.IP
+	for _, state := range ipStates {
+		resp, err := kvc.Get(ctx, p.keys.IP(state, ""), etcd.WithPrefix(), etcd.WithKeysOnly())
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not list %s ips", state)
+		}
 
-		free[ip] = struct{}{}
+		for _, kv := range resp.Kvs {
+			_, ip, err := p.keys.ParseIP(string(kv.Key))
+			if err != nil {
+				log.Warningf("ignoring key: %v", err)
+				continue
+			}
+
+			known[ip.String()] = struct{}{}
+			if state == IPStateFree {
+				free = append(free, ip)
+			}
+		}
 	}
 
+	largest, score := fragmentation(free)
+	metricFreeLargestBlock.Set(int64(largest))
+	metricFreeFragmentation.Set(score)
+	log.Debugf("largest free block has %d ips, fragmentation %.2f", largest, score)
+
 	for _, ipnet := range p.allocator.Range() {
 		ip := ipnet.IP
 
-		if _, ok := free[ip.String()]; ok {
-			continue
-		}
-		if _, ok := leased[ip.String()]; ok {
+		if _, ok := known[ip.String()]; ok {
 			continue
 		}
 
 		log.Infof("moving %v from expired to free", ip)
-		freeIPKey := p.config.Prefix + p.config.Separator +
-			"ips" + p.config.Separator +
-			"free" + p.config.Separator +
-			ip.String()
-		leasedIPKey := p.config.Prefix + p.config.Separator +
-			"ips" + p.config.Separator +
-			"leased" + p.config.Separator +
-			ip.String()
-
-		res, err := kvc.Txn(ctx).If(
-			etcdutil.KeyMissing(freeIPKey),
-			etcdutil.KeyMissing(leasedIPKey),
-		).Then(
-			etcd.OpPut(freeIPKey, ip.String()),
-		).Commit()
+		ok, err := p.transition(ctx, ip, IPStateMissing, IPStateFree)
 		if err != nil {
-			return errors.Wrap(err, "could not move ip to free state")
+			return reclaimed, err
 		}
 
-		if res.Succeeded {
+		if ok {
 			log.Infof("resurrected expired %v back to free state", ip)
+			metricLeasesReclaimed.Add(1)
+			reclaimed++
 		}
 	}
-	return nil
+
+	// only bother operators when the sweep found something
+	logf := log.Debugf
+	if reclaimed > 0 {
+		logf = log.Infof
+	}
+	logf("reclaimed %d expired leases in %s", reclaimed, time.Since(began))
+
+	return reclaimed, nil
 }
 
 func (p *PluginState) nicLeasedIP(ctx context.Context, nic net.HardwareAddr) (net.IP, error) {
-	kvc := etcd.NewKV(p.client)
+	kvc := p.kv()
 
-	key := p.config.Prefix + p.config.Separator +
-		"nics" + p.config.Separator +
-		"leased" + p.config.Separator +
-		nic.String()
+	key := p.keys.LeasedNIC(nic.String())
 
 	resp, err := kvc.Get(ctx, key)
 	if err != nil {
@@ -154,81 +329,242 @@ func (p *PluginState) nicLeasedIP(ctx context.Context, nic net.HardwareAddr) (ne
 		return nil, nil
 	}
 
-	ip := net.ParseIP(string(resp.Kvs[0].Value))
+	value, err := leasedIPOf(resp.Kvs[0].Value)
+	if err != nil {
+		p.malformed(ctx, resp.Kvs[0], err)
+		return nil, errors.WithMessagef(err, "could not decode %v", key)
+	}
+
+	ip := net.ParseIP(value)
 
 	return ip, nil
 }
 
-func (p *PluginState) leaseIP(ctx context.Context, nic net.HardwareAddr, ip net.IP, ttl time.Duration) error {
-	kvc := etcd.NewKV(p.client)
+// persistHostname remembers the hostname a nic last sent, or returns it if
+// the nic sent none, so that renewals without one keep their DNS record
+func (p *PluginState) persistHostname(ctx context.Context, nic net.HardwareAddr, hostname string) (string, error) {
+	kvc := p.kv()
+
+	key := p.keys.Hostname(nic.String())
+
+	if hostname != "" {
+		if _, err := kvc.Put(ctx, key, hostname); err != nil {
+			return hostname, errors.Wrap(err, "could not store hostname")
+		}
+		return hostname, nil
+	}
 
-	lease, err := etcd.NewLease(p.client).
-		Grant(ctx, int64(ttl.Seconds()))
+	resp, err := kvc.Get(ctx, key)
 	if err != nil {
-		return errors.Wrap(err, "could not create new lease")
+		return "", errors.Wrap(err, "could not get hostname")
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
 	}
 
-	freeIPKey := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"free" + p.config.Separator +
-		ip.String()
+	log.Debugf("reusing hostname %s of %s", resp.Kvs[0].Value, nic)
 
-	leasedIPKey := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"leased" + p.config.Separator +
-		ip.String()
+	return string(resp.Kvs[0].Value), nil
+}
 
-	leasedNicKey := p.config.Prefix + p.config.Separator +
-		"nics" + p.config.Separator +
-		"leased" + p.config.Separator +
-		nic.String()
+// leaseIP leases ip to nic for ttl, recording the hostname the client goes
+// by in the lease value
+func (p *PluginState) leaseIP(ctx context.Context, nic net.HardwareAddr, ip net.IP,
+	ttl time.Duration, hostname string) (err error) {
+	kvc := p.kv()
 
-	res, err := kvc.Txn(ctx).If(
-		// if the ip was previously free
-		etcdutil.KeyExists(freeIPKey),
-	).Then(
-		etcd.OpTxn([]etcd.Cmp{
-			etcdutil.KeyMissing(leasedNicKey),
+	lease, err := p.lease().
+		Grant(ctx, LeaseTTL(ttl, p.config.MinEtcdLeaseTTL))
+	if err != nil {
+		return errors.Wrap(err, "could not create new lease")
+	}
+
+	leasedIPKey := p.keys.LeasedIP(ip)
+	leasedNicKey := p.keys.LeasedNIC(nic.String())
+	meta := withMetadata(newLeaseMetadata(hostname, ttl))
+
+	// a nic moving to another ip gives up the one it holds in the same
+	// transaction, so that it never holds two leases, nor loses the one it
+	// holds when it's not granted the other
+	grant := []transitionOption{withNic(nic, lease.ID), meta}
+	nicUnbound := etcdutil.KeyMissing(leasedNicKey)
+	current, err := p.nicLeasedIP(ctx, nic)
+	if err != nil {
+		return err
+	}
+	if current != nil && !current.Equal(ip) {
+		currentKey := p.keys.LeasedIP(current)
+		nicRev, currentRev, err := leaseRevisions(ctx, kvc, leasedNicKey, currentKey, current, nic)
+		if err != nil {
+			return err
+		}
+		if nicRev < 0 {
+			return fmt.Errorf("lease of nic %v changed while moving it from %s to %s", nic, current, ip)
+		}
+		nicUnbound = etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev)
+		grant = append(grant, withRelease(current),
+			withConditions(etcd.Compare(etcd.ModRevision(currentKey), "=", currentRev)))
+	}
+	defer func() {
+		if err == nil && current != nil && !current.Equal(ip) {
+			log.Infof("released %s of nic %s, it requested %s instead", current, nic, ip)
+		}
+		if err == nil && current == nil {
+			p.ouiHeld.add(nic, 1)
+		}
+	}()
+
+	// if the ip was previously free, unfree it and associate it with this nic
+	ok, err := p.transition(ctx, ip, IPStateFree, IPStateLeased,
+		append(grant, withConditions(
+			nicUnbound,
 			etcdutil.KeyMissing(leasedIPKey),
-		}, []etcd.Op{
-			// Unfree it, and associate it with this nic
-			etcd.OpDelete(freeIPKey),
-			etcd.OpPut(leasedNicKey, ip.String(), etcd.WithLease(lease.ID)),
-			etcd.OpPut(leasedIPKey, nic.String(), etcd.WithLease(lease.ID)),
-		}, nil),
-	).Else(
-		// Otherwise, we're _probably_ renewing it, so check that the current
-		// association still matches
-		etcd.OpTxn([]etcd.Cmp{
-			etcd.Compare(etcd.Value(leasedNicKey), "=", ip.String()),
-			etcd.Compare(etcd.Value(leasedIPKey), "=", nic.String()),
-		}, []etcd.Op{
-			// if it does, renew the lease
-			etcd.OpPut(leasedNicKey, ip.String(), etcd.WithLease(lease.ID)),
-			etcd.OpPut(leasedIPKey, nic.String(), etcd.WithLease(lease.ID)),
-		}, nil),
-	).Commit()
+		))...)
 	if err != nil {
-		return errors.Wrap(err, "could not update for leased ip")
+		return err
+	}
+	if ok {
+		return nil
 	}
 
-	// If we did an else in the nested transaction, we failed to actually update
-	// the lease
-	if !res.Responses[0].Response.(*etcdpb.ResponseOp_ResponseTxn).ResponseTxn.Succeeded {
+	// or if it is reserved for this nic
+	if from := p.unleasedState(nic, ip); from == IPStateReserved {
+		ok, err = p.transition(ctx, ip, from, IPStateLeased,
+			append(grant, withConditions(nicUnbound))...)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	// or if it was offered to this nic
+	ok, err = p.transition(ctx, ip, IPStateOffered, IPStateLeased,
+		append(grant, withConditions(
+			etcd.Compare(etcd.Value(p.keys.IP(IPStateOffered, ip.String())), "=", nic.String()),
+			nicUnbound,
+		))...)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	// Otherwise, we're _probably_ renewing it, so check that the current
+	// association, whatever the format of its values, still matches
+	nicRev, ipRev, err := leaseRevisions(ctx, kvc, leasedNicKey, leasedIPKey, ip, nic)
+	if err != nil {
+		return err
+	}
+
+	ok, err = p.transition(ctx, ip, IPStateLeased, IPStateLeased,
+		withNic(nic, lease.ID), meta,
+		withConditions(
+			etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev),
+			etcd.Compare(etcd.ModRevision(leasedIPKey), "=", ipRev),
+		))
+	if err != nil {
+		return err
+	}
+
+	// a partial failure may have left only one of the keys bound to this
+	// nic, in which case the client is better served by repairing it
+	if !ok && p.config.HealHalfBoundLeases {
+		ok, err = p.healHalfBound(ctx, kvc, nic, ip, lease.ID, meta)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Warningf("healed half bound lease of ip %s for nic %s", ip, nic)
+		}
+	}
+
+	if !ok {
 		return fmt.Errorf("ip %+v is no longer free: %w", ip, ErrAlreadyLeased)
 	}
 
 	return nil
 }
 
-func (p *PluginState) freeIP(ctx context.Context) (net.IP, error) {
-	kvc := etcd.NewKV(p.client)
+// healHalfBound rebinds ip and nic to each other when exactly one of their
+// keys binds them and the other one is not bound to another client
+func (p *PluginState) healHalfBound(ctx context.Context, kvc etcd.KV, nic net.HardwareAddr,
+	ip net.IP, lease etcd.LeaseID, meta transitionOption) (bool, error) {
+	leasedNicKey := p.keys.LeasedNIC(nic.String())
+	leasedIPKey := p.keys.LeasedIP(ip)
+
+	res, err := kvc.Txn(ctx).Then(
+		etcd.OpGet(leasedNicKey),
+		etcd.OpGet(leasedIPKey),
+	).Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "could not get current lease")
+	}
+	nicKvs := res.Responses[0].GetResponseRange().Kvs
+	ipKvs := res.Responses[1].GetResponseRange().Kvs
+
+	// the revisions are zero for missing keys
+	var nicRev, ipRev int64
+	nicBound := false
+	if len(nicKvs) > 0 {
+		nicRev = nicKvs[0].ModRevision
+		leasedIP, err := leasedIPOf(nicKvs[0].Value)
+		nicBound = err == nil && leasedIP == ip.String()
+	}
+
+	if len(ipKvs) > 0 {
+		ipRev = ipKvs[0].ModRevision
+		leasedNic, err := leasedNicOf(ipKvs[0].Value)
+		if err != nil || leasedNic != nic.String() {
+			// leased by another client
+			return false, nil
+		}
+
+		// the ip is bound to the nic but the nic's key is missing or
+		// points elsewhere
+		return p.transition(ctx, ip, IPStateLeased, IPStateLeased,
+			withNic(nic, lease), meta,
+			withConditions(
+				etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev),
+				etcd.Compare(etcd.ModRevision(leasedIPKey), "=", ipRev),
+			))
+	}
+	if !nicBound {
+		return false, nil
+	}
+
+	// the nic is bound to the ip but the ip's key is missing, the ip is
+	// either free or was not resurrected yet
+	unchanged := withConditions(
+		etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev),
+	)
+	ok, err := p.transition(ctx, ip, IPStateFree, IPStateLeased,
+		withNic(nic, lease), meta, unchanged)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	return p.transition(ctx, ip, IPStateMissing, IPStateLeased,
+		withNic(nic, lease), meta, unchanged)
+}
+
+// freeIP picks a free ip of ranges to offer nic
+func (p *PluginState) freeIP(ctx context.Context, nic net.HardwareAddr, ranges ipRanges) (net.IP, error) {
+	// the cache does not know when ips were freed
+	if p.freePool != nil && p.allocationStrategy != AllocationLRU {
+		ip, err := p.cachedFreeIP(ctx, nic, ranges)
+		if err != nil || ip != nil {
+			return ip, err
+		}
+		// fall back to scanning etcd
+		metricFreeCacheMisses.Add(1)
+	}
 
-	prefix := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"free" + p.config.Separator
+	kvc := p.kv()
 
-	resp, err := kvc.Get(ctx, prefix, etcd.WithPrefix(),
+	resp, err := kvc.Get(ctx, p.keys.IP(IPStateFree, ""), etcd.WithPrefix(),
 		etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get etcd key")
@@ -238,50 +574,333 @@ func (p *PluginState) freeIP(ctx context.Context) (net.IP, error) {
 		return nil, errors.New("no free IP addresses")
 	}
 
-	ip := net.ParseIP(string(resp.Kvs[0].Value))
+	reserved, err := p.reservedForOthers(ctx, nic)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) <= reserved {
+		return nil, fmt.Errorf("the %d free IP addresses are reserved for other OUIs", len(resp.Kvs))
+	}
 
-	return ip, nil
+	// look past the ones being offered to other nics, or outside of ranges
+	kvs := make([]*mvccpb.KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err == nil && (p.claims.claimed(ip.String()) || !ranges.contains(ip)) {
+			continue
+		}
+		kvs = append(kvs, kv)
+	}
+	if len(kvs) == 0 {
+		return nil, fmt.Errorf("the free IP addresses of %s are all being offered", ranges)
+	}
+
+	return p.pickFree(ctx, kvs)
+}
+
+// preferredFree picks the first free ip through the ranges, in order, at
+// or after the instance's start if it has one, wrapping around to the
+// first one, so that instances sharing the ranges draw from different
+// regions of them
+func (p *PluginState) preferredFree(kvs []*mvccpb.KeyValue) *mvccpb.KeyValue {
+	start := 0
+	if p.instanceStart != nil {
+		start = p.ranges.offset(p.instanceStart)
+	}
+
+	var after, lowest *mvccpb.KeyValue
+	var afterN, lowestN int
+	for _, kv := range kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err != nil {
+			continue
+		}
+		n := p.ranges.offset(ip)
+		if n < 0 {
+			continue
+		}
+
+		if lowest == nil || n < lowestN {
+			lowest, lowestN = kv, n
+		}
+		if n >= start && (after == nil || n < afterN) {
+			after, afterN = kv, n
+		}
+	}
+
+	switch {
+	case after != nil:
+		return after
+	case lowest != nil:
+		return lowest
+	default:
+		return kvs[0]
+	}
+}
+
+// offerIP reserves a free ip for a nic until it requests it, the offer
+// expires with its etcd lease and the ip is then resurrected as free. Offers
+// are held in etcd so that other instances' freeIP skip the ip
+func (p *PluginState) offerIP(ctx context.Context, nic net.HardwareAddr, ip net.IP) error {
+	lease, err := p.lease().
+		Grant(ctx, LeaseTTL(p.config.OfferTimeout, p.config.MinEtcdLeaseTTL))
+	if err != nil {
+		return errors.Wrap(err, "could not create new lease")
+	}
+
+	ok, err := p.transition(ctx, ip, p.unleasedState(nic, ip), IPStateOffered,
+		withNic(nic, lease.ID),
+		withValue(nic.String()))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("ip %+v: %w", ip, ErrNotFree)
+	}
+
+	return nil
+}
+
+// nicOfferedIP returns the ip currently offered to a nic, if any
+func (p *PluginState) nicOfferedIP(ctx context.Context, nic net.HardwareAddr) (net.IP, error) {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.IP(IPStateOffered, ""), etcd.WithPrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list offered ips")
+	}
+
+	for _, kv := range resp.Kvs {
+		if string(kv.Value) != nic.String() {
+			continue
+		}
+
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		return ip, err
+	}
+
+	return nil, nil
 }
 
 func (p *PluginState) revokeLease(ctx context.Context, nic net.HardwareAddr) error {
-	kvc := etcd.NewKV(p.client)
+	kvc := p.kv()
 
-	leasedNicKey := p.config.Prefix + p.config.Separator +
-		"nics" + p.config.Separator +
-		"leased" + p.config.Separator +
-		nic.String()
+	leasedNicKey := p.keys.LeasedNIC(nic.String())
 
 	res, err := kvc.Get(ctx, leasedNicKey)
 	if err != nil {
 		return errors.Wrap(err, "could not get nic's current lease")
 	}
 	if len(res.Kvs) == 0 {
-		return fmt.Errorf("nic %v has no lease", nic)
-	}
-
-	ip := string(res.Kvs[0].Value)
-
-	leasedIPKey := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"leased" + p.config.Separator +
-		ip
-	freeIPKey := p.config.Prefix + p.config.Separator +
-		"ips" + p.config.Separator +
-		"free" + p.config.Separator +
-		ip
-
-	txres, err := kvc.Txn(ctx).If(
-		etcdutil.KeyExists(leasedIPKey),
-		etcdutil.KeyExists(leasedNicKey),
-	).Then(
-		etcd.OpDelete(leasedIPKey),
-		etcd.OpDelete(leasedNicKey),
-		etcd.OpPut(freeIPKey, ip),
-	).Commit()
+		return fmt.Errorf("nic %v: %w", nic, ErrNoLease)
+	}
 
-	if !txres.Succeeded {
-		return errors.Wrap(err, "could not delete lease")
+	ip, err := leasedIPOf(res.Kvs[0].Value)
+	if err != nil {
+		p.malformed(ctx, res.Kvs[0], err)
+		return errors.WithMessagef(err, "could not decode lease of nic %v", nic)
+	}
+
+	ok, err := p.transition(ctx, net.ParseIP(ip), IPStateLeased, IPStateFree,
+		withNic(nic, etcd.NoLease),
+		withConditions(etcdutil.KeyExists(leasedNicKey)))
+	if err != nil {
+		return errors.WithMessage(err, "could not delete lease")
+	}
+	if !ok {
+		return fmt.Errorf("lease for nic %v changed while revoking it", nic)
 	}
+	p.ouiHeld.add(nic, -1)
+
+	return nil
+}
+
+// declineLease moves the ip leased by a nic into the declined state, where it
+// stays quarantined until the monitor promotes it back to free
+func (p *PluginState) declineLease(ctx context.Context, nic net.HardwareAddr) error {
+	kvc := p.kv()
+
+	leasedNicKey := p.keys.LeasedNIC(nic.String())
+
+	res, err := kvc.Get(ctx, leasedNicKey)
+	if err != nil {
+		return errors.Wrap(err, "could not get nic's current lease")
+	}
+	if len(res.Kvs) == 0 {
+		return fmt.Errorf("nic %v: %w", nic, ErrNoLease)
+	}
+
+	ip, err := leasedIPOf(res.Kvs[0].Value)
+	if err != nil {
+		p.malformed(ctx, res.Kvs[0], err)
+		return errors.WithMessagef(err, "could not decode lease of nic %v", nic)
+	}
+
+	if p.config.ProblemDeclines > 0 {
+		problem, err := p.recordDecline(ctx, ip)
+		if err != nil {
+			return errors.WithMessage(err, "could not record decline")
+		}
+		if problem {
+			ok, err := p.transition(ctx, net.ParseIP(ip), IPStateLeased, IPStateProblem,
+				withNic(nic, etcd.NoLease),
+				withValue(strconv.FormatInt(time.Now().Unix(), 10)),
+				withConditions(etcdutil.KeyExists(leasedNicKey)))
+			if err != nil {
+				return errors.WithMessage(err, "could not park declined ip")
+			}
+			if !ok {
+				return fmt.Errorf("lease for nic %v changed while declining it", nic)
+			}
+			p.ouiHeld.add(nic, -1)
+
+			log.Warningf("ip %s was declined %d times within %s, parked it out of the pool",
+				ip, p.config.ProblemDeclines, p.config.ProblemWindow)
+			return nil
+		}
+	}
+
+	until := time.Now().Add(p.config.QuarantineTime)
+
+	ok, err := p.transition(ctx, net.ParseIP(ip), IPStateLeased, IPStateDeclined,
+		withNic(nic, etcd.NoLease),
+		withValue(strconv.FormatInt(until.Unix(), 10)),
+		withConditions(etcdutil.KeyExists(leasedNicKey)))
+	if err != nil {
+		return errors.WithMessage(err, "could not decline lease")
+	}
+	if !ok {
+		return fmt.Errorf("lease for nic %v changed while declining it", nic)
+	}
+	p.ouiHeld.add(nic, -1)
+
+	log.Infof("quarantined declined ip %s until %s", ip, until)
+
+	return nil
+}
+
+// promoteDeclined returns declined ips whose quarantine is over back to the
+// free state, if probing is enabled and the ip still answers the quarantine
+// is extended instead
+func (p *PluginState) promoteDeclined(ctx context.Context) (int, error) {
+	kvc := p.kv()
+
+	resp, err := kvc.Get(ctx, p.keys.IP(IPStateDeclined, ""), etcd.WithPrefix())
+	if err != nil {
+		return 0, errors.Wrap(err, "could not list declined ips")
+	}
+
+	promoted := 0
+	now := time.Now()
+	for _, kv := range resp.Kvs {
+		_, ip, err := p.keys.ParseIP(string(kv.Key))
+		if err != nil {
+			log.Warningf("ignoring key: %v", err)
+			continue
+		}
+
+		until, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			log.Warningf("malformed quarantine for declined ip %s: %v", ip, err)
+		} else if now.Before(time.Unix(until, 0)) {
+			continue
+		}
+
+		// only move the ip if nobody touched it since it was listed
+		unchanged := withConditions(
+			etcd.Compare(etcd.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		)
+
+		if p.prober != nil {
+			inUse, err := p.prober.InUse(ctx, ip)
+			if err != nil {
+				log.Errorf("could not probe declined ip %s: %v", ip, err)
+				continue
+			}
+			if inUse {
+				extended := now.Add(p.config.QuarantineTime)
+				_, err := p.transition(ctx, ip, IPStateDeclined, IPStateDeclined,
+					withValue(strconv.FormatInt(extended.Unix(), 10)),
+					unchanged)
+				if err != nil {
+					return promoted, errors.WithMessage(err, "could not extend quarantine")
+				}
+
+				log.Warningf("declined ip %s is still in use, quarantined until %s", ip, extended)
+				continue
+			}
+		}
+
+		ok, err := p.transition(ctx, ip, IPStateDeclined, IPStateFree, unchanged)
+		if err != nil {
+			return promoted, errors.WithMessage(err, "could not move declined ip to free state")
+		}
+
+		if ok {
+			log.Infof("promoted declined %v back to free state", ip)
+			promoted++
+		}
+	}
+
+	return promoted, nil
+}
+
+// revokeLeaseByIP frees a leased ip whose nic is unknown to the caller
+func (p *PluginState) revokeLeaseByIP(ctx context.Context, ip net.IP) error {
+	kvc := p.kv()
+
+	leasedIPKey := p.keys.LeasedIP(ip)
+
+	res, err := kvc.Get(ctx, leasedIPKey)
+	if err != nil {
+		return errors.Wrap(err, "could not get ip's current lease")
+	}
+	if len(res.Kvs) == 0 {
+		return fmt.Errorf("ip %v: %w", ip, ErrNoLease)
+	}
+
+	nic, err := leasedNicOf(res.Kvs[0].Value)
+	if err != nil {
+		p.malformed(ctx, res.Kvs[0], err)
+		return errors.WithMessagef(err, "could not decode lease of ip %v", ip)
+	}
+
+	opts := []transitionOption{
+		withConditions(
+			etcd.Compare(etcd.ModRevision(leasedIPKey), "=", res.Kvs[0].ModRevision),
+		),
+	}
+	// the nic key may already be gone or point elsewhere, only delete it
+	// along with the ip's if it's still bound to it
+	var unbound net.HardwareAddr
+	if mac, err := net.ParseMAC(nic); err == nil {
+		leasedNicKey := p.keys.LeasedNIC(mac.String())
+
+		nicRev, _, err := leaseRevisions(ctx, kvc, leasedNicKey, leasedIPKey, ip, mac)
+		if err != nil {
+			return err
+		}
+		if nicRev > 0 {
+			unbound = mac
+			opts = append(opts,
+				withNic(mac, etcd.NoLease),
+				withConditions(etcd.Compare(etcd.ModRevision(leasedNicKey), "=", nicRev)),
+			)
+		}
+	}
+
+	ok, err := p.transition(ctx, ip, IPStateLeased, IPStateFree, opts...)
+	if err != nil {
+		return errors.WithMessage(err, "could not delete lease")
+	}
+	if !ok {
+		return fmt.Errorf("lease for ip %v changed while revoking it", ip)
+	}
+	if unbound != nil {
+		p.ouiHeld.add(unbound, -1)
+	}
+
+	log.Infof("revoked lease of ip %s held by nic %s", ip, nic)
 
 	return nil
 }
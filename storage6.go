@@ -0,0 +1,187 @@
+package etcdplugin
+
+import (
+	"context"
+	"hash/fnv"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	etcd "go.etcd.io/etcd/client/v3"
+	etcdutil "go.etcd.io/etcd/client/v3/clientv3util"
+)
+
+// how many addresses of the range a client is tried on before it's told
+// there are none available. IPv6 ranges are too large to keep their free
+// addresses in etcd, addresses are free unless leased
+const constLeaseAttempts6 = 16
+
+// binding6 is the identity association of a DHCPv6 client that addresses
+// are leased to. Leases key off the DUID and IAID of the client rather than
+// a hardware address, which DHCPv6 clients need not send
+type binding6 struct {
+	// hex encoded
+	duid, iaid string
+}
+
+func (b binding6) String() string {
+	return b.duid + "/" + b.iaid
+}
+
+// candidates6 returns the addresses of the range tried for b, the one the
+// client asked for first. The others start from where the DUID and IAID
+// hash to, so that a client is leased the same address again and clients
+// spread over the range
+func (p *PluginState) candidates6(b binding6, hint net.IP) []net.IP {
+	candidates := make([]net.IP, 0, constLeaseAttempts6+1)
+	if hint != nil && p.range6.contains(hint) {
+		candidates = append(candidates, hint.To16())
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(b.duid))
+	h.Write([]byte(b.iaid))
+	start := new(big.Int).SetUint64(h.Sum64())
+	for i := int64(0); i < constLeaseAttempts6; i++ {
+		candidates = append(candidates, p.range6.nth(new(big.Int).Add(start, big.NewInt(i))))
+	}
+
+	return candidates
+}
+
+// leasedIP6 returns the address leased to b along with the revision of its
+// binding, nil when there's none
+func (p *PluginState) leasedIP6(ctx context.Context, b binding6) (net.IP, int64, error) {
+	key := p.keys.LeasedDUID(b.duid, b.iaid)
+	resp, err := p.kv().Get(ctx, key)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not get leased duid")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+
+	kv := resp.Kvs[0]
+	ip := net.ParseIP(string(kv.Value))
+	if ip == nil || ip.To4() != nil {
+		log.Warningf("leased duid %s holds an invalid IPv6 address: %q", key, kv.Value)
+		return nil, kv.ModRevision, nil
+	}
+
+	return ip, kv.ModRevision, nil
+}
+
+// freeIP6 returns the address b would be leased, without leasing it: the
+// one it holds, or the first of its candidates nobody holds, nil when
+// there's none
+func (p *PluginState) freeIP6(ctx context.Context, b binding6, hint net.IP) (net.IP, error) {
+	current, _, err := p.leasedIP6(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && p.range6.contains(current) {
+		return current, nil
+	}
+
+	for _, ip := range p.candidates6(b, hint) {
+		resp, err := p.kv().Get(ctx, p.keys.IP6(IPStateLeased, ip), etcd.WithCountOnly())
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get leased IPv6 address")
+		}
+		if resp.Count == 0 {
+			return ip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// leaseIP6 leases b the address it holds for ttl, or one of its candidates
+// when it holds none, returning nil when none of them is free
+func (p *PluginState) leaseIP6(ctx context.Context, b binding6, hint net.IP, ttl time.Duration) (net.IP, error) {
+	kvc := p.kv()
+
+	lease, err := p.lease().
+		Grant(ctx, LeaseTTL(ttl, p.config.MinEtcdLeaseTTL))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new lease")
+	}
+
+	duidKey := p.keys.LeasedDUID(b.duid, b.iaid)
+	current, rev, err := p.leasedIP6(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	// renewing the address it holds, both keys share the etcd lease
+	if current != nil && p.range6.contains(current) {
+		ipKey := p.keys.IP6(IPStateLeased, current)
+		resp, err := kvc.Txn(ctx).
+			If(
+				etcd.Compare(etcd.ModRevision(duidKey), "=", rev),
+				etcd.Compare(etcd.Value(ipKey), "=", b.String()),
+			).
+			Then(
+				etcd.OpPut(ipKey, b.String(), etcd.WithLease(lease.ID)),
+				etcd.OpPut(duidKey, current.String(), etcd.WithLease(lease.ID)),
+			).
+			Commit()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not renew IPv6 lease")
+		}
+		if resp.Succeeded {
+			return current, nil
+		}
+		log.Warningf("%s no longer holds %s, leasing it another address", b, current)
+	}
+
+	// a binding left behind is replaced along with the lease
+	unbound := etcdutil.KeyMissing(duidKey)
+	if rev != 0 {
+		unbound = etcd.Compare(etcd.ModRevision(duidKey), "=", rev)
+	}
+	for _, ip := range p.candidates6(b, hint) {
+		ipKey := p.keys.IP6(IPStateLeased, ip)
+		resp, err := kvc.Txn(ctx).
+			If(unbound, etcdutil.KeyMissing(ipKey)).
+			Then(
+				etcd.OpPut(ipKey, b.String(), etcd.WithLease(lease.ID)),
+				etcd.OpPut(duidKey, ip.String(), etcd.WithLease(lease.ID)),
+			).
+			Commit()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not lease IPv6 address")
+		}
+		if resp.Succeeded {
+			return ip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// releaseIP6 releases the address leased to b, reporting false when it
+// holds none
+func (p *PluginState) releaseIP6(ctx context.Context, b binding6) (bool, error) {
+	current, _, err := p.leasedIP6(ctx, b)
+	if err != nil {
+		return false, err
+	}
+	if current == nil {
+		return false, nil
+	}
+
+	ipKey := p.keys.IP6(IPStateLeased, current)
+	duidKey := p.keys.LeasedDUID(b.duid, b.iaid)
+	resp, err := p.kv().Txn(ctx).
+		If(etcd.Compare(etcd.Value(ipKey), "=", b.String())).
+		Then(etcd.OpDelete(ipKey), etcd.OpDelete(duidKey)).
+		Else(etcd.OpDelete(duidKey)).
+		Commit()
+	if err != nil {
+		return false, errors.Wrap(err, "could not release IPv6 address")
+	}
+
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,177 @@
+package etcdplugin
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/pkg/errors"
+)
+
+// leasedTo returns the ip nic leases according to f
+func leasedTo(t testing.TB, f *fakeEtcd, p *PluginState, nic net.HardwareAddr) string {
+	t.Helper()
+
+	value, ok := f.get(p.keys.LeasedNIC(nic.String()))
+	if !ok {
+		return ""
+	}
+	ip, err := leasedIPOf([]byte(value))
+	if err != nil {
+		t.Fatalf("could not decode lease of %s: %v", nic, err)
+	}
+	return ip
+}
+
+func TestLeaseMovesNicToAnotherIP(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	nic := testMAC(1)
+	old := lease(t, p, nic)
+	ip := net.IPv4(10, 0, 0, 9).To4()
+
+	resp := sendRequest(t, p, nic, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		t.Fatalf("want %s acked, got %v", ip, resp)
+	}
+
+	if got := leasedTo(t, f, p, nic); got != ip.String() {
+		t.Errorf("want %s leasing %s, got %q", nic, ip, got)
+	}
+	if _, ok := f.get(p.keys.LeasedIP(old)); ok {
+		t.Errorf("want %s no longer leased", old)
+	}
+	if _, ok := f.get(p.keys.FreeIP(old)); !ok {
+		t.Errorf("want %s back in the free pool", old)
+	}
+}
+
+func TestLeaseKeepsIPWhenNotGrantedAnother(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+
+	nic, other := testMAC(1), testMAC(2)
+	old := lease(t, p, nic)
+	taken := lease(t, p, other)
+
+	resp := sendRequest(t, p, nic, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(taken)))
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeNak {
+		t.Fatalf("want the request for %s, leased to %s, NAKed, got %v", taken, other, resp)
+	}
+
+	if got := leasedTo(t, f, p, nic); got != old.String() {
+		t.Errorf("want %s still leasing %s, got %q", nic, old, got)
+	}
+	if _, ok := f.get(p.keys.LeasedIP(old)); !ok {
+		t.Errorf("want %s still leased", old)
+	}
+}
+
+func TestRevokeLeaseOfUnknownNic(t *testing.T) {
+	p := newTestPlugin(t, newFakeEtcd())
+
+	err := p.revokeLease(context.Background(), testMAC(1))
+	if !errors.Is(err, ErrNoLease) {
+		t.Fatalf("want %v, got %v", ErrNoLease, err)
+	}
+	if err := p.declineLease(context.Background(), testMAC(1)); !errors.Is(err, ErrNoLease) {
+		t.Fatalf("want %v declining, got %v", ErrNoLease, err)
+	}
+}
+
+func TestReleaseAndDeclineWithoutLease(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f)
+	before := f.keys(p.keys.Root())
+
+	for _, typ := range []dhcpv4.MessageType{dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline} {
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(testMAC(1)),
+			dhcpv4.WithMessageType(typ),
+			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(testServerID)),
+			dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 1))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := exchange(t, p, req); resp != nil {
+			t.Errorf("want no reply to a %v without a lease, got %v", typ, resp.MessageType())
+		}
+	}
+
+	if after := f.keys(p.keys.Root()); len(after) != len(before) {
+		t.Errorf("want the keys untouched, got %d keys instead of %d", len(after), len(before))
+	}
+}
+
+func TestRevokeMalformedLeaseQuarantinesIt(t *testing.T) {
+	f := newFakeEtcd()
+	p := newTestPlugin(t, f, "QuarantineMalformed = true")
+
+	ip := net.IPv4(10, 0, 0, 1)
+	key := p.keys.LeasedIP(ip)
+	f.delete(p.keys.FreeIP(ip))
+	f.put(key, "{not json")
+
+	if err := p.revokeLeaseByIP(context.Background(), ip); !errors.Is(err, ErrMalformedValue) {
+		t.Fatalf("want %v revoking, got %v", ErrMalformedValue, err)
+	}
+	if _, ok := f.get(key); ok {
+		t.Errorf("want %s moved out of the way", key)
+	}
+	if value, ok := f.get(p.keys.Malformed(key)); !ok || value != "{not json" {
+		t.Errorf("want %s quarantined as is, got %q", key, value)
+	}
+}
+
+func TestRelaxedReleaseWithoutServerID(t *testing.T) {
+	release := func(p *PluginState, nic net.HardwareAddr, ip, server net.IP) {
+		t.Helper()
+		modifiers := []dhcpv4.Modifier{
+			dhcpv4.WithHwAddr(nic),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease),
+			dhcpv4.WithClientIP(ip),
+		}
+		if server != nil {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(server)))
+		}
+		req, err := dhcpv4.New(modifiers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange(t, p, req)
+	}
+
+	for _, relaxed := range []bool{false, true} {
+		f := newFakeEtcd()
+		p := newTestPlugin(t, f, "RelaxedRelease = "+strconv.FormatBool(relaxed))
+		nic := testMAC(1)
+		ip := lease(t, p, nic)
+
+		// meant for another server
+		release(p, nic, ip, net.IPv4(10, 0, 0, 253))
+		if got := leasedTo(t, f, p, nic); got != ip.String() {
+			t.Errorf("relaxed=%t: want a release for another server ignored, got %s leasing %q", relaxed, nic, got)
+		}
+
+		// without a server identifier, for an ip the nic does not hold
+		release(p, nic, net.IPv4(10, 0, 0, 9), nil)
+		if got := leasedTo(t, f, p, nic); got != ip.String() {
+			t.Errorf("relaxed=%t: want a release of an ip not held ignored, got %s leasing %q", relaxed, nic, got)
+		}
+
+		// without a server identifier, for the ip it holds
+		release(p, nic, ip, nil)
+		got := leasedTo(t, f, p, nic)
+		if relaxed && got != "" {
+			t.Errorf("want the release honored, got %s leasing %q", nic, got)
+		}
+		if !relaxed && got != ip.String() {
+			t.Errorf("want the release ignored without RelaxedRelease, got %s leasing %q", nic, got)
+		}
+	}
+}
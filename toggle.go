@@ -0,0 +1,109 @@
+package etcdplugin
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how many switches between addresses within the window make a client
+	// toggling, A B A B is three
+	constToggleSwitches       = 3
+	constDefaultToggleCooloff = 5 * time.Minute
+)
+
+// ipRequest is an address a nic requested
+type ipRequest struct {
+	ip net.IP
+	at time.Time
+}
+
+// pin is the address a toggling nic is held to
+type pin struct {
+	ip    net.IP
+	until time.Time
+}
+
+// toggles detects nics alternately requesting different addresses and pins
+// them to their first choice for a cool-off period
+type toggles struct {
+	mu      sync.Mutex
+	window  time.Duration
+	cooloff time.Duration
+	// by nic, the requests within the window
+	recent map[string][]ipRequest
+	// by nic
+	pinned map[string]pin
+}
+
+func newToggles(window, cooloff time.Duration) *toggles {
+	return &toggles{
+		window:  window,
+		cooloff: cooloff,
+		recent:  make(map[string][]ipRequest),
+		pinned:  make(map[string]pin),
+	}
+}
+
+// check records that nic requested ip, reporting false along with the
+// address the nic is pinned to if it must be refused
+func (t *toggles) check(nic net.HardwareAddr, ip net.IP) (net.IP, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	key := nic.String()
+
+	if p, ok := t.pinned[key]; ok {
+		if now.Before(p.until) {
+			return p.ip, p.ip.Equal(ip)
+		}
+		delete(t.pinned, key)
+	}
+
+	requests := append(t.recent[key], ipRequest{ip: ip, at: now})
+	for len(requests) > 0 && now.Sub(requests[0].at) > t.window {
+		requests = requests[1:]
+	}
+	t.recent[key] = requests
+
+	switches := 0
+	for i := 1; i < len(requests); i++ {
+		if !requests[i].ip.Equal(requests[i-1].ip) {
+			switches++
+		}
+	}
+	if switches < constToggleSwitches {
+		return nil, true
+	}
+
+	first := requests[0].ip
+	t.pinned[key] = pin{
+		ip:    first,
+		until: now.Add(t.cooloff),
+	}
+	delete(t.recent, key)
+	log.Warningf("%s toggles between addresses, pinning it to %s until %s",
+		nic, first, now.Add(t.cooloff))
+
+	return first, first.Equal(ip)
+}
+
+// prune forgets the requests and pins that are over
+func (t *toggles) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, requests := range t.recent {
+		if now.Sub(requests[len(requests)-1].at) > t.window {
+			delete(t.recent, key)
+		}
+	}
+	for key, p := range t.pinned {
+		if !now.Before(p.until) {
+			delete(t.pinned, key)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package etcdplugin
 
 import (
 	"encoding/binary"
+	"math/big"
+	"math/rand"
 	"net"
+	"time"
 )
 
 // IPAdd returns a copy of start + add.
@@ -13,3 +16,49 @@ func IPAdd(start net.IP, add int) net.IP { // IPv4 only
 	binary.BigEndian.PutUint32(result, binary.BigEndian.Uint32(start)+uint32(add))
 	return result
 }
+
+// IPAdd6 returns a copy of start + add, wrapping around past the last
+// IPv6 address
+func IPAdd6(start net.IP, add *big.Int) net.IP {
+	n := new(big.Int).SetBytes(start.To16())
+	n.Add(n, add)
+	n.Mod(n, maxIPv6)
+
+	return n.FillBytes(make(net.IP, net.IPv6len))
+}
+
+// one past the last IPv6 address
+var maxIPv6 = new(big.Int).Lsh(big.NewInt(1), 8*net.IPv6len)
+
+// IPInRange reports whether ip lies within [start, end]
+func IPInRange(ip, start, end net.IP) bool { // IPv4 only
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	n := binary.BigEndian.Uint32(ip4)
+
+	return n >= binary.BigEndian.Uint32(start.To4()) &&
+		n <= binary.BigEndian.Uint32(end.To4())
+}
+
+// Jitter returns a random duration in [0, max)
+func Jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// LeaseTTL converts a duration to the seconds of an etcd lease, rounding
+// up and flooring it to min so that short durations don't truncate to zero
+func LeaseTTL(ttl, min time.Duration) int64 {
+	if ttl < min {
+		ttl = min
+	}
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}